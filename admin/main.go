@@ -0,0 +1,166 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// gandalf-admin runs administrative tasks on a gandalf server.
+//
+// Usage:
+//
+//	gandalf-admin [-config file] backup <file|->
+//	gandalf-admin [-config file] [-force] restore <file|->
+//	gandalf-admin [-config file] [-dry-run] [-preserve] rebuild-keys
+//	gandalf-admin [-config file] authorized-keys <fingerprint> [<type> <key>]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/backup"
+	"github.com/tsuru/gandalf/user"
+)
+
+const usage = `Usage: gandalf-admin [options] <command> [arg]
+
+Commands:
+  backup <file|->   creates a backup of the database and the repositories
+  restore <file|->  restores a backup, rebuilding the database, the
+                    repositories and the authorized_keys file
+  rebuild-keys      rewrites the authorized_keys file from the keys in the
+                    database, printing the lines added and removed
+  authorized-keys <fingerprint> [<type> <key>]
+                    prints the authorized_keys line of the key with the
+                    given SHA256 fingerprint, for sshd's AuthorizedKeysCommand,
+                    or of the certificate with the given type and key
+
+Options:
+`
+
+func printSummary(summary *backup.Summary) {
+	fmt.Fprintf(os.Stderr, "%d users, %d keys, %d repositories (%d bundles, %d hooks).\n",
+		summary.Users, summary.Keys, summary.Repositories, summary.Bundles, summary.Hooks)
+}
+
+func createBackup(path string) error {
+	if path == "-" {
+		summary, err := backup.Create(os.Stdout)
+		if err != nil {
+			return err
+		}
+		printSummary(summary)
+		return nil
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	summary, err := backup.Create(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	printSummary(summary)
+	return nil
+}
+
+func restoreBackup(path string, force bool) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	summary, err := backup.Restore(r, force)
+	if err != nil {
+		return err
+	}
+	printSummary(summary)
+	return nil
+}
+
+func rebuildKeys(dryRun, preserve bool) error {
+	diff, err := user.RebuildAuthorizedKeys(dryRun, preserve)
+	if err != nil {
+		return err
+	}
+	for _, line := range diff.Removed {
+		fmt.Printf("- %s\n", line)
+	}
+	for _, line := range diff.Added {
+		fmt.Printf("+ %s\n", line)
+	}
+	fmt.Fprintf(os.Stderr, "%d lines added, %d lines removed.\n", len(diff.Added), len(diff.Removed))
+	return nil
+}
+
+// authorizedKeys prints the authorized_keys line of the key offered to sshd,
+// looking up certificates by their authority and principals, and other keys
+// by fingerprint.
+func authorizedKeys(fp, keyType, key string) error {
+	var line string
+	var err error
+	if strings.HasSuffix(keyType, "-cert-v01@openssh.com") {
+		line, err = user.AuthorizedCertificate(keyType, key)
+	} else {
+		line, err = user.AuthorizedKey(fp)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Print(line)
+	return nil
+}
+
+func main() {
+	configFile := flag.String("config", "/etc/gandalf.conf", "Gandalf configuration file")
+	force := flag.Bool("force", false, "restore: replace the contents of a database that is not empty")
+	dryRun := flag.Bool("dry-run", false, "rebuild-keys: only print the differences, without changing the file")
+	preserve := flag.Bool("preserve", false, "rebuild-keys: preserve the unmanaged lines of the file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := map[string][]int{"backup": {2}, "restore": {2}, "rebuild-keys": {1}, "authorized-keys": {2, 4}}
+	valid := false
+	for _, n := range args[flag.Arg(0)] {
+		valid = valid || flag.NArg() == n
+	}
+	if !valid {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := config.ReadConfigFile(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "backup":
+		err = createBackup(flag.Arg(1))
+	case "restore":
+		err = restoreBackup(flag.Arg(1), *force)
+	case "rebuild-keys":
+		err = rebuildKeys(*dryRun, *preserve)
+	case "authorized-keys":
+		err = authorizedKeys(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
@@ -11,17 +11,24 @@ import (
 	"io"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/pat"
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/hook"
+	"github.com/tsuru/gandalf/lfs"
+	"github.com/tsuru/gandalf/mirror"
 	"github.com/tsuru/gandalf/multipartzip"
 	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/search"
 	"github.com/tsuru/gandalf/user"
 )
 
@@ -61,6 +68,8 @@ func SetupRouter() *pat.Router {
 	router.Delete("/user/{name}/key/{keyname}", http.HandlerFunc(removeKey))
 	router.Put("/user/{name}/key/{keyname}", http.HandlerFunc(updateKey))
 	router.Get("/user/{name}/keys", http.HandlerFunc(listKeys))
+	router.Post("/authorized_keys", http.HandlerFunc(rebuildAuthorizedKeys))
+	router.Get("/key-policy/violations", http.HandlerFunc(keyPolicyViolations))
 	router.Post("/user", http.HandlerFunc(newUser))
 	router.Delete("/user/{name}", http.HandlerFunc(removeUser))
 	router.Delete("/repository/revoke", http.HandlerFunc(revokeAccess))
@@ -68,15 +77,39 @@ func SetupRouter() *pat.Router {
 	router.Get("/repository/{name:[^/]*/?[^/]+}/contents", http.HandlerFunc(getFileContents))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/tree", http.HandlerFunc(getTree))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/branches", http.HandlerFunc(getBranches))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/branches", http.HandlerFunc(newBranch))
+	router.Delete("/repository/{name:[^/]*/?[^/]+}/branches/{branch:.+}", http.HandlerFunc(removeBranch))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/tags", http.HandlerFunc(getTags))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/tags", http.HandlerFunc(newTag))
+	router.Delete("/repository/{name:[^/]*/?[^/]+}/tags/{tag:.+}", http.HandlerFunc(removeTag))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/diff/commits", http.HandlerFunc(getDiff))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/files", http.HandlerFunc(commitFiles))
 	router.Post("/repository/{name:[^/]*/?[^/]+}/commit", http.HandlerFunc(commit))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/merges", http.HandlerFunc(merge))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/logs", http.HandlerFunc(getLogs))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/commits/search", http.HandlerFunc(searchRepositoryCommits))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/compare/{refs:.+}", http.HandlerFunc(compareRefs))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/info/lfs/objects/batch", http.HandlerFunc(lfsBatch))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/info/lfs/objects/{oid}", http.HandlerFunc(lfsDownload))
+	router.Put("/repository/{name:[^/]*/?[^/]+}/info/lfs/objects/{oid}", http.HandlerFunc(lfsUpload))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/lfs", http.HandlerFunc(getLFSUsage))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/mirror/sync", http.HandlerFunc(syncMirror))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/import", http.HandlerFunc(getImport))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/bundle", http.HandlerFunc(getBundle))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/deploykeys", http.HandlerFunc(listDeployKeys))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/deploykeys", http.HandlerFunc(addDeployKey))
+	router.Delete("/repository/{name:[^/]*/?[^/]+}/deploykeys/{keyname}", http.HandlerFunc(removeDeployKey))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/pushmirrors/sync", http.HandlerFunc(pushToMirrors))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/pushmirrors", http.HandlerFunc(getPushMirrors))
+	router.Post("/repository/{name:[^/]*/?[^/]+}/pushmirrors", http.HandlerFunc(addPushMirror))
+	router.Delete("/repository/{name:[^/]*/?[^/]+}/pushmirrors/{mirror}", http.HandlerFunc(removePushMirror))
 	router.Post("/repository/grant", http.HandlerFunc(grantAccess))
 	router.Post("/repository", http.HandlerFunc(newRepository))
 	router.Get("/repository/{name:[^/]*/?[^/]+}", http.HandlerFunc(getRepository))
 	router.Delete("/repository/{name:[^/]*/?[^/]+}", http.HandlerFunc(removeRepository))
 	router.Put("/repository/{name:[^/]*/?[^/]+}", http.HandlerFunc(updateRepository))
+	router.Get("/search/code", http.HandlerFunc(searchCode))
+	router.Get("/search/commits", http.HandlerFunc(searchCommits))
 	router.Get("/healthcheck", http.HandlerFunc(healthCheck))
 	router.Post("/hook/{name}", http.HandlerFunc(addHook))
 	return router
@@ -121,6 +154,20 @@ func revokeAccess(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Successfully revoked access to users \"%s\" into repositories \"%s\"", users, repositories)
 }
 
+// keyExpiry parses the expiry date of keys, in the expires parameter of the
+// query string, which is zero when missing.
+func keyExpiry(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("expires")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid value for expires: %q. It should be in RFC 3339 format.", value)
+	}
+	return expiresAt, nil
+}
+
 func addKey(w http.ResponseWriter, r *http.Request) {
 	keys := map[string]string{}
 	if err := parseBody(r.Body, &keys); err != nil {
@@ -131,8 +178,17 @@ func addKey(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "A key is needed", http.StatusBadRequest)
 		return
 	}
+	expiresAt, err := keyExpiry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	uName := r.URL.Query().Get(":name")
-	if err := user.AddKey(uName, keys); err != nil {
+	if err := user.AddKeyWithExpiry(uName, keys, expiresAt); err != nil {
+		if _, ok := err.(*user.KeyPolicyError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		switch err {
 		case user.ErrInvalidKey:
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -157,8 +213,17 @@ func updateKey(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	key := user.Key{Name: kName, Body: string(content)}
+	expiresAt, err := keyExpiry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := user.Key{Name: kName, Body: string(content), ExpiresAt: expiresAt}
 	if err := user.UpdateKey(uName, key); err != nil {
+		if _, ok := err.(*user.KeyPolicyError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		switch err {
 		case user.ErrInvalidKey:
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -183,13 +248,74 @@ func removeKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func listKeys(w http.ResponseWriter, r *http.Request) {
+	details, err := queryBool(r, "details")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	uName := r.URL.Query().Get(":name")
 	keys, err := user.ListKeys(uName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	out, err := json.Marshal(&keys)
+	var data interface{} = &keys
+	if details {
+		data = []user.Key(keys)
+	}
+	out, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+// queryBool parses the boolean parameter of the query string, which is false
+// when missing.
+func queryBool(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for %s: %q.", name, value)
+	}
+	return b, nil
+}
+
+func rebuildAuthorizedKeys(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := queryBool(r, "dry")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preserve, err := queryBool(r, "preserve")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	diff, err := user.RebuildAuthorizedKeys(dryRun, preserve)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(diff)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func keyPolicyViolations(w http.ResponseWriter, r *http.Request) {
+	violations, err := user.KeyPolicyViolations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(violations)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -208,13 +334,22 @@ func newUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Got error while parsing body: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	u, err := user.New(usr.Name, usr.Keys)
+	expiresAt, err := keyExpiry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := user.NewWithExpiry(usr.Name, usr.Keys, expiresAt)
 	if err != nil {
 		status := http.StatusInternalServerError
 		if err == user.ErrUserAlreadyExists {
 			status = http.StatusConflict
 		}
-		if _, ok := err.(*user.InvalidUserError); ok {
+		switch err.(type) {
+		case *user.InvalidUserError, *user.KeyPolicyError:
+			status = http.StatusBadRequest
+		}
+		if err == user.ErrInvalidKey {
 			status = http.StatusBadRequest
 		}
 		http.Error(w, err.Error(), status)
@@ -236,14 +371,81 @@ func removeUser(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "User \"%s\" successfully removed\n", name)
 }
 
+// parseImportBundle parses a multipart request for creating a repository
+// from a git bundle, which has the repository in the "repository" field, in
+// the same format of regular requests, and the bundle in the "bundle" file.
+// The bundle is copied to a temporary file, returning its path.
+func parseImportBundle(r *http.Request, repo *repository.Repository) (string, error) {
+	err := r.ParseMultipartForm(int64(maxMemoryValue()))
+	if err != nil {
+		return "", err
+	}
+	value, err := multipartzip.ValueField(r.MultipartForm, "repository")
+	if err != nil {
+		return "", err
+	}
+	if err = parseBody(ioutil.NopCloser(strings.NewReader(value)), repo); err != nil {
+		return "", err
+	}
+	fh, err := multipartzip.FileField(r.MultipartForm, "bundle")
+	if err != nil {
+		return "", err
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "gandalf-import-")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
 func newRepository(w http.ResponseWriter, r *http.Request) {
 	var repo repository.Repository
-	if err := parseBody(r.Body, &repo); err != nil {
+	var bundle string
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		bundle, err = parseImportBundle(r, &repo)
+	} else {
+		err = parseBody(r.Body, &repo)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err := repository.New(repo.Name, repo.Users, repo.ReadOnlyUsers, repo.IsPublic)
+	importing := repo.Import != nil || bundle != ""
+	if repo.Mirror != nil && importing {
+		if bundle != "" {
+			os.Remove(bundle)
+		}
+		http.Error(w, "Mirrors cannot be imported.", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case repo.Mirror != nil:
+		_, err = repository.NewMirror(repo.Name, repo.Users, repo.ReadOnlyUsers, repo.IsPublic, *repo.Mirror)
+	case importing:
+		var i repository.Import
+		if repo.Import != nil {
+			i = *repo.Import
+		}
+		i.Bundle = bundle
+		_, err = repository.NewImport(repo.Name, repo.Users, repo.ReadOnlyUsers, repo.IsPublic, i)
+	default:
+		_, err = repository.New(repo.Name, repo.Users, repo.ReadOnlyUsers, repo.IsPublic)
+	}
 	if err != nil {
+		if bundle != "" {
+			os.Remove(bundle)
+		}
 		status := http.StatusInternalServerError
 		if err == repository.ErrRepositoryAlreadyExists {
 			status = http.StatusConflict
@@ -254,9 +456,52 @@ func newRepository(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), status)
 		return
 	}
+	if repo.Mirror != nil {
+		go mirror.Sync(repo.Name)
+	}
+	if importing {
+		go runImport(repo.Name)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Repository \"%s\" successfully created, importing\n", repo.Name)
+		return
+	}
 	fmt.Fprintf(w, "Repository \"%s\" successfully created\n", repo.Name)
 }
 
+// runImport runs the import of the repository and indexes it for code
+// search.
+func runImport(name string) {
+	if err := repository.RunImport(name); err != nil {
+		return
+	}
+	if search.Enabled() {
+		search.Update(name)
+	}
+}
+
+func getImport(w http.ResponseWriter, r *http.Request) {
+	repo, err := repository.Get(r.URL.Query().Get(":name"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if repo.Import == nil {
+		http.Error(w, repository.ErrNotImported.Error(), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(repo.Import)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 func getRepository(w http.ResponseWriter, r *http.Request) {
 	repo, err := repository.Get(r.URL.Query().Get(":name"))
 	if err != nil {
@@ -302,13 +547,227 @@ func updateRepository(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	err = repository.Update(name, repo)
-	if err != nil && err == repository.ErrRepositoryNotFound {
+	if _, ok := err.(*repository.InvalidRepositoryError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err != nil && err == repository.ErrRepositoryNotFound {
 		http.Error(w, err.Error(), http.StatusNotFound)
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// rejectChanges answers with 409 (Conflict) when the repository is a pull
+// mirror, which can only be changed by synchronizing with its upstream, or
+// when it's being imported.
+func rejectChanges(w http.ResponseWriter, name string) bool {
+	repo, err := repository.Get(name)
+	if err != nil {
+		return false
+	}
+	if repo.Mirror != nil {
+		http.Error(w, repository.ErrMirror.Error(), http.StatusConflict)
+		return true
+	}
+	if repo.Importing() {
+		http.Error(w, repository.ErrImporting.Error(), http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// refsChanged updates the code search index of the repository and pushes
+// the changes to its push mirrors, in background.
+func refsChanged(name string) {
+	if search.Enabled() {
+		go search.Update(name)
+	}
+	go func() {
+		if err := repository.QueuePushMirrors(name); err == nil {
+			mirror.Push(name)
+		}
+	}()
+}
+
+func syncMirror(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	m, err := mirror.Sync(name)
+	if m == nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case repository.ErrRepositoryNotFound:
+			status = http.StatusNotFound
+		case repository.ErrNotMirror:
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	b, merr := json.Marshal(m)
+	if merr != nil {
+		http.Error(w, merr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	w.Write(b)
+}
+
+func pushMirrorErrorStatus(err error) int {
+	switch err {
+	case repository.ErrRepositoryNotFound, repository.ErrPushMirrorNotFound:
+		return http.StatusNotFound
+	case repository.ErrPushMirrorAlreadyExists:
+		return http.StatusConflict
+	}
+	if _, ok := err.(*repository.InvalidRepositoryError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func getPushMirrors(w http.ResponseWriter, r *http.Request) {
+	mirrors, err := repository.GetPushMirrors(r.URL.Query().Get(":name"))
+	if err != nil {
+		http.Error(w, err.Error(), pushMirrorErrorStatus(err))
+		return
+	}
+	b, err := json.Marshal(mirrors)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func addPushMirror(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var params repository.PushMirror
+	if err := parseBody(r.Body, &params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := repository.AddPushMirror(name, params)
+	if err != nil {
+		http.Error(w, err.Error(), pushMirrorErrorStatus(err))
+		return
+	}
+	go mirror.Push(name)
+	b, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func removePushMirror(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	mirrorName := r.URL.Query().Get(":mirror")
+	if err := repository.RemovePushMirror(name, mirrorName); err != nil {
+		http.Error(w, err.Error(), pushMirrorErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Push mirror \"%s\" successfully removed\n", mirrorName)
+}
+
+func pushToMirrors(w http.ResponseWriter, r *http.Request) {
+	mirrors, err := repository.PushToMirrors(r.URL.Query().Get(":name"), true)
+	if mirrors == nil {
+		http.Error(w, err.Error(), pushMirrorErrorStatus(err))
+		return
+	}
+	b, merr := json.Marshal(mirrors)
+	if merr != nil {
+		http.Error(w, merr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	w.Write(b)
+}
+
+func deployKeyErrorStatus(err error) int {
+	switch err {
+	case repository.ErrRepositoryNotFound, user.ErrDeployKeyNotFound:
+		return http.StatusNotFound
+	case user.ErrDuplicateKey:
+		return http.StatusConflict
+	case user.ErrInvalidKey:
+		return http.StatusBadRequest
+	}
+	if _, ok := err.(*user.KeyPolicyError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+type jsonDeployKey struct {
+	Name     string
+	Key      string
+	ReadOnly bool
+}
+
+func addDeployKey(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var params jsonDeployKey
+	if err := parseBody(r.Body, &params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Name == "" || params.Key == "" {
+		http.Error(w, "A name and a key are needed", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := keyExpiry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := user.AddDeployKey(name, params.Name, params.Key, params.ReadOnly, expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), deployKeyErrorStatus(err))
+		return
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func listDeployKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := user.ListDeployKeys(r.URL.Query().Get(":name"))
+	if err != nil {
+		http.Error(w, err.Error(), deployKeyErrorStatus(err))
+		return
+	}
+	b, err := json.Marshal(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func removeDeployKey(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	keyName := r.URL.Query().Get(":keyname")
+	if err := user.RemoveDeployKey(name, keyName); err != nil {
+		http.Error(w, err.Error(), deployKeyErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Deploy key \"%s\" successfully removed\n", keyName)
+}
+
 type repositoryHook struct {
 	Repositories []string
 	Content      string
@@ -444,6 +903,44 @@ func getArchive(w http.ResponseWriter, r *http.Request) {
 	w.Write(contents)
 }
 
+func getBundle(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	var since []string
+	for _, value := range r.URL.Query()["since"] {
+		for _, commit := range strings.Split(value, ",") {
+			if commit = strings.TrimSpace(commit); commit != "" {
+				since = append(since, commit)
+			}
+		}
+	}
+	bundle, err := repository.CreateBundle(repo, since)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case repository.ErrEmptyBundle:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case repository.ErrRepositoryNotFound:
+			status = http.StatusNotFound
+		case repository.ErrInvalidSince:
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer bundle.Close()
+	info, err := bundle.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.bundle\"", strings.Replace(repo, "/", "_", -1)))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Cache-Control", "private")
+	io.Copy(w, bundle)
+}
+
 func getTree(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
 	path := r.URL.Query().Get("path")
@@ -504,16 +1001,137 @@ func getTags(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func getDiff(w http.ResponseWriter, r *http.Request) {
+// refErrorStatus returns the HTTP status for errors of branch and tag
+// operations.
+func refErrorStatus(err error) int {
+	switch err {
+	case repository.ErrRefAlreadyExists:
+		return http.StatusConflict
+	case repository.ErrRefNotFound:
+		return http.StatusNotFound
+	case repository.ErrStaleRef:
+		return http.StatusPreconditionFailed
+	}
+	if _, ok := err.(*repository.InvalidRefError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func newBranch(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
-	previousCommit := r.URL.Query().Get("previous_commit")
-	lastCommit := r.URL.Query().Get("last_commit")
-	if previousCommit == "" || lastCommit == "" {
-		err := fmt.Errorf("Error when trying to obtain diff between hash commits of repository %s (Hash Commit(s) are required).", repo)
+	if rejectChanges(w, repo) {
+		return
+	}
+	var params struct {
+		Name string `json:"name"`
+		Ref  string `json:"ref"`
+	}
+	if err := parseBody(r.Body, &params); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	diff, err := repository.GetDiff(repo, previousCommit, lastCommit)
+	if params.Name == "" || params.Ref == "" {
+		err := fmt.Errorf("Error when trying to create branch of repository %s (name and ref are required).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	branch, err := repository.NewBranch(repo, params.Name, params.Ref)
+	if err != nil {
+		http.Error(w, err.Error(), refErrorStatus(err))
+		return
+	}
+	refsChanged(repo)
+	b, err := json.Marshal(branch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func removeBranch(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	if rejectChanges(w, repo) {
+		return
+	}
+	branch := r.URL.Query().Get(":branch")
+	if err := repository.RemoveBranch(repo, branch, r.URL.Query().Get("old")); err != nil {
+		http.Error(w, err.Error(), refErrorStatus(err))
+		return
+	}
+	refsChanged(repo)
+	fmt.Fprintf(w, "Branch \"%s\" successfully removed\n", branch)
+}
+
+func newTag(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	if rejectChanges(w, repo) {
+		return
+	}
+	var params struct {
+		Name    string             `json:"name"`
+		Ref     string             `json:"ref"`
+		Message string             `json:"message"`
+		Tagger  repository.GitUser `json:"tagger"`
+	}
+	if err := parseBody(r.Body, &params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Name == "" || params.Ref == "" {
+		err := fmt.Errorf("Error when trying to create tag of repository %s (name and ref are required).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Message != "" && (params.Tagger.Name == "" || params.Tagger.Email == "") {
+		err := fmt.Errorf("Error when trying to create tag of repository %s (tagger name and email are required for annotated tags).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag, err := repository.NewTag(repo, repository.GitTag{
+		Name:    params.Name,
+		Ref:     params.Ref,
+		Message: params.Message,
+		Tagger:  params.Tagger,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), refErrorStatus(err))
+		return
+	}
+	refsChanged(repo)
+	b, err := json.Marshal(tag)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func removeTag(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	if rejectChanges(w, repo) {
+		return
+	}
+	tag := r.URL.Query().Get(":tag")
+	if err := repository.RemoveTag(repo, tag, r.URL.Query().Get("old")); err != nil {
+		http.Error(w, err.Error(), refErrorStatus(err))
+		return
+	}
+	refsChanged(repo)
+	fmt.Fprintf(w, "Tag \"%s\" successfully removed\n", tag)
+}
+
+func getDiff(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	previousCommit := r.URL.Query().Get("previous_commit")
+	lastCommit := r.URL.Query().Get("last_commit")
+	if previousCommit == "" || lastCommit == "" {
+		err := fmt.Errorf("Error when trying to obtain diff between hash commits of repository %s (Hash Commit(s) are required).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	diff, err := repository.GetDiff(repo, previousCommit, lastCommit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -522,8 +1140,47 @@ func getDiff(w http.ResponseWriter, r *http.Request) {
 	w.Write(diff)
 }
 
+var commitModes = map[string]repository.CommitMode{
+	"":         repository.CommitOverlay,
+	"overlay":  repository.CommitOverlay,
+	"replace":  repository.CommitReplace,
+	"manifest": repository.CommitManifest,
+}
+
+// commitManifest returns the paths listed for deletion in the manifest part
+// of the form, which may be sent either as a value or as a file.
+func commitManifest(form *multipart.Form) ([]string, error) {
+	var content []byte
+	if file, err := multipartzip.FileField(form, "manifest"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if content, err = ioutil.ReadAll(f); err != nil {
+			return nil, err
+		}
+	} else {
+		value, err := multipartzip.ValueField(form, "manifest")
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(value)
+	}
+	var manifest struct {
+		Delete []string `json:"delete"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("Could not parse manifest: %s", err)
+	}
+	return manifest.Delete, nil
+}
+
 func commit(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if rejectChanges(w, repo) {
+		return
+	}
 	err := r.ParseMultipartForm(int64(maxMemoryValue()))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -557,11 +1214,113 @@ func commit(w http.ResponseWriter, r *http.Request) {
 			Email: data["committer-email"],
 		},
 	}
+	if parent, ok := form.Value["parent"]; ok && len(parent) == 1 {
+		commit.Parent = parent[0]
+	}
+	if mode, ok := form.Value["mode"]; ok && len(mode) == 1 {
+		if commit.Mode, ok = commitModes[mode[0]]; !ok {
+			http.Error(w, fmt.Sprintf("Invalid mode %q", mode[0]), http.StatusBadRequest)
+			return
+		}
+	}
+	if commit.Mode == repository.CommitManifest {
+		commit.Delete, err = commitManifest(form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	ref, err := repository.CommitZip(repo, r.MultipartForm.File["zipfile"][0], commit)
 	if err != nil {
+		status := http.StatusBadRequest
+		if err == repository.ErrStaleRef {
+			status = http.StatusPreconditionFailed
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	refsChanged(repo)
+	b, err := json.Marshal(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+var fileActions = map[string]repository.FileActionType{
+	"create": repository.FileCreate,
+	"update": repository.FileUpdate,
+	"move":   repository.FileMove,
+	"delete": repository.FileDelete,
+}
+
+func commitFiles(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	if rejectChanges(w, repo) {
+		return
+	}
+	var params struct {
+		Branch    string             `json:"branch"`
+		Message   string             `json:"message"`
+		Parent    string             `json:"parent"`
+		Author    repository.GitUser `json:"author"`
+		Committer repository.GitUser `json:"committer"`
+		Actions   []struct {
+			Action       string `json:"action"`
+			Path         string `json:"path"`
+			PreviousPath string `json:"previous_path"`
+			Content      []byte `json:"content"`
+			Executable   *bool  `json:"executable"`
+		} `json:"actions"`
+	}
+	if err := parseBody(r.Body, &params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Branch == "" || params.Author.Name == "" || params.Author.Email == "" || len(params.Actions) == 0 {
+		err := fmt.Errorf("Error when trying to commit files to repository %s (branch, author name and email and actions are required).", repo)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if params.Committer.Name == "" && params.Committer.Email == "" {
+		params.Committer = params.Author
+	}
+	commit := repository.GitFileCommit{
+		GitCommit: repository.GitCommit{
+			Branch:    params.Branch,
+			Message:   params.Message,
+			Author:    params.Author,
+			Committer: params.Committer,
+			Parent:    params.Parent,
+		},
+		Actions: make([]repository.FileAction, len(params.Actions)),
+	}
+	for i, action := range params.Actions {
+		actionType, ok := fileActions[action.Action]
+		if !ok {
+			err := fmt.Errorf("Error when trying to commit files to repository %s (Invalid action %q).", repo, action.Action)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		commit.Actions[i] = repository.FileAction{
+			Action:       actionType,
+			Path:         action.Path,
+			PreviousPath: action.PreviousPath,
+			Content:      action.Content,
+			Executable:   action.Executable,
+		}
+	}
+	ref, err := repository.CommitFiles(repo, commit)
+	if err != nil {
+		status := refErrorStatus(err)
+		if _, ok := err.(*repository.InvalidFileActionError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	refsChanged(repo)
 	b, err := json.Marshal(ref)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -570,17 +1329,124 @@ func commit(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+var mergeStrategies = map[string]repository.MergeStrategy{
+	"":             repository.MergeCommit,
+	"merge":        repository.MergeCommit,
+	"fast-forward": repository.FastForwardOnly,
+	"squash":       repository.Squash,
+}
+
+func merge(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	if rejectChanges(w, repo) {
+		return
+	}
+	var params struct {
+		Source    string             `json:"source"`
+		Target    string             `json:"target"`
+		Strategy  string             `json:"strategy"`
+		Message   string             `json:"message"`
+		Author    repository.GitUser `json:"author"`
+		Committer repository.GitUser `json:"committer"`
+	}
+	if err := parseBody(r.Body, &params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	strategy, ok := mergeStrategies[params.Strategy]
+	if !ok {
+		err := fmt.Errorf("Error when trying to merge into repository %s (Invalid strategy %q).", repo, params.Strategy)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Source == "" || params.Target == "" {
+		err := fmt.Errorf("Error when trying to merge into repository %s (source and target are required).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Committer.Name == "" && params.Committer.Email == "" {
+		params.Committer = params.Author
+	}
+	if strategy != repository.FastForwardOnly && (params.Author.Name == "" || params.Author.Email == "") {
+		err := fmt.Errorf("Error when trying to merge into repository %s (author name and email are required).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ref, err := repository.Merge(repo, repository.GitMerge{
+		Source:    params.Source,
+		Target:    params.Target,
+		Strategy:  strategy,
+		Message:   params.Message,
+		Author:    params.Author,
+		Committer: params.Committer,
+	})
+	if conflictErr, ok := err.(*repository.MergeConflictError); ok {
+		b, err := json.Marshal(map[string]interface{}{
+			"error":     conflictErr.Error(),
+			"conflicts": conflictErr.Conflicts,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(b)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	refsChanged(repo)
+	b, err := json.Marshal(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// logFilter builds a repository.LogFilter from the query string of the
+// request. The total of commits is left for the caller to define.
+func logFilter(r *http.Request) (repository.LogFilter, error) {
+	filter := repository.LogFilter{
+		Ref:       r.URL.Query().Get("ref"),
+		Path:      r.URL.Query().Get("path"),
+		Author:    r.URL.Query().Get("author"),
+		Committer: r.URL.Query().Get("committer"),
+		Since:     r.URL.Query().Get("since"),
+		Until:     r.URL.Query().Get("until"),
+		Grep:      r.URL.Query().Get("grep"),
+	}
+	if firstParent := r.URL.Query().Get("first_parent"); firstParent != "" {
+		var err error
+		filter.FirstParent, err = strconv.ParseBool(firstParent)
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
 func getLogs(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
 	ref := r.URL.Query().Get("ref")
-	path := r.URL.Query().Get("path")
 	total, err := strconv.Atoi(r.URL.Query().Get("total"))
 	if err != nil {
 		err = fmt.Errorf("Error when trying to obtain logs for ref %s of repository %s (%s).", ref, repo, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	logs, err := repository.GetLogs(repo, ref, total, path)
+	filter, err := logFilter(r)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to obtain logs for ref %s of repository %s (%s).", ref, repo, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Total = total
+	filter.Count = true
+	logs, err := repository.GetFilteredLogs(repo, filter)
 	if err != nil {
 		err = fmt.Errorf("Error when trying to obtain logs for ref %s of repository %s (%s).", ref, repo, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -594,3 +1460,309 @@ func getLogs(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(b)
 }
+
+func compareRefs(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	refs := r.URL.Query().Get(":refs")
+	parts := strings.SplitN(refs, "...", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		err := fmt.Errorf("Error when trying to compare %s of repository %s (refs must be in the form base...head).", refs, repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	total := 100
+	if t := r.URL.Query().Get("total"); t != "" {
+		var err error
+		total, err = strconv.Atoi(t)
+		if err != nil {
+			err = fmt.Errorf("Error when trying to compare %s of repository %s (%s).", refs, repo, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	comparison, err := repository.Compare(repo, parts[0], parts[1], total)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(comparison)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to compare %s of repository %s (%s).", refs, repo, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// searchTotal parses the optional "total" parameter of search requests.
+func searchTotal(r *http.Request) (int, error) {
+	if t := r.URL.Query().Get("total"); t != "" {
+		return strconv.Atoi(t)
+	}
+	return 20, nil
+}
+
+func searchRepositoryCommits(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get(":name")
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		err := fmt.Errorf("Error when trying to search commits of repository %s (q is required).", repo)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := logFilter(r)
+	if err == nil {
+		filter.Total, err = searchTotal(r)
+	}
+	if err == nil && r.URL.Query().Get("count") != "" {
+		filter.Count, err = strconv.ParseBool(r.URL.Query().Get("count"))
+	}
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	history, err := repository.SearchCommits(repo, query, filter)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(history)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func searchCommits(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	userName := r.URL.Query().Get("user")
+	if query == "" || userName == "" {
+		err := errors.New("Error when trying to search commits (q and user are required).")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	total, err := searchTotal(r)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search commits (%s).", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := search.Commits(userName, query, total)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search commits (%s).", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search commits (%s).", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func searchCode(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	userName := r.URL.Query().Get("user")
+	if query == "" || userName == "" {
+		err := errors.New("Error when trying to search code (q and user are required).")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var limit int
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			err = fmt.Errorf("Error when trying to search code (%s).", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	results, err := search.Code(userName, query, limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case search.ErrSearchDisabled:
+			status = http.StatusServiceUnavailable
+		case search.ErrInvalidQuery:
+			status = http.StatusBadRequest
+		}
+		err = fmt.Errorf("Error when trying to search code (%s).", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		err = fmt.Errorf("Error when trying to search code (%s).", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// lfsError writes an error of the LFS API, in the format expected by git-lfs
+// clients.
+func lfsError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", lfs.MediaType)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("LFS-Authenticate", `Basic realm="Git LFS"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+// lfsBaseURL returns the URL of the API as seen by the client, used in the
+// actions of batch responses. The "lfs:url" setting has precedence over the
+// request.
+func lfsBaseURL(r *http.Request) string {
+	if baseURL, err := config.GetString("lfs:url"); err == nil && baseURL != "" {
+		return baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// lfsAuthorize checks whether the user identified by the token in the
+// request may execute the given LFS operation in the repository. Requests
+// without a token are anonymous, and may only download objects from public
+// repositories.
+func lfsAuthorize(r *http.Request, operation string) (*repository.Repository, int, error) {
+	if !lfs.Enabled() {
+		return nil, http.StatusServiceUnavailable, lfs.ErrLFSDisabled
+	}
+	name := r.URL.Query().Get(":name")
+	repo, err := repository.Get(name)
+	if err != nil {
+		if err == repository.ErrRepositoryNotFound {
+			return nil, http.StatusNotFound, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	var userName string
+	if token := lfs.TokenFromHeader(r.Header); token != "" {
+		if userName, err = lfs.VerifyToken(token, repo.Name, operation); err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+	}
+	allowed := repo.ReadableBy(userName)
+	if operation == lfs.Upload {
+		allowed = repo.WritableBy(userName)
+	}
+	if !allowed && userName == "" {
+		return nil, http.StatusUnauthorized, errors.New("credentials needed")
+	}
+	if !allowed {
+		return nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to %s lfs objects of repository %q", userName, operation, repo.Name)
+	}
+	return &repo, http.StatusOK, nil
+}
+
+func lfsBatch(w http.ResponseWriter, r *http.Request) {
+	var req lfs.BatchRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lfsError(w, http.StatusUnprocessableEntity, fmt.Errorf("could not parse request: %s", err))
+		return
+	}
+	if req.Operation != lfs.Download && req.Operation != lfs.Upload {
+		lfsError(w, http.StatusUnprocessableEntity, fmt.Errorf("invalid operation %q", req.Operation))
+		return
+	}
+	repo, status, err := lfsAuthorize(r, req.Operation)
+	if err != nil {
+		lfsError(w, status, err)
+		return
+	}
+	var header map[string]string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header = map[string]string{"Authorization": auth}
+	}
+	resp, err := lfs.Batch(repo.Name, lfsBaseURL(r), header, req)
+	if err != nil {
+		lfsError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", lfs.MediaType)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func lfsDownload(w http.ResponseWriter, r *http.Request) {
+	repo, status, err := lfsAuthorize(r, lfs.Download)
+	if err != nil {
+		lfsError(w, status, err)
+		return
+	}
+	f, err := lfs.Open(repo.Name, r.URL.Query().Get(":oid"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case lfs.ErrObjectNotFound:
+			status = http.StatusNotFound
+		case lfs.ErrInvalidObject:
+			status = http.StatusUnprocessableEntity
+		}
+		lfsError(w, status, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
+
+func lfsUpload(w http.ResponseWriter, r *http.Request) {
+	repo, status, err := lfsAuthorize(r, lfs.Upload)
+	if err != nil {
+		lfsError(w, status, err)
+		return
+	}
+	defer r.Body.Close()
+	if r.ContentLength < 0 {
+		lfsError(w, http.StatusLengthRequired, errors.New("the size of the object is required"))
+		return
+	}
+	err = lfs.Store(repo.Name, r.URL.Query().Get(":oid"), r.ContentLength, r.Body)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == lfs.ErrInvalidObject || err == lfs.ErrObjectMismatch {
+			status = http.StatusUnprocessableEntity
+		}
+		lfsError(w, status, err)
+	}
+}
+
+func getLFSUsage(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if _, err := repository.Get(name); err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	usage, err := lfs.RepositoryUsage(name)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == lfs.ErrLFSDisabled {
+			status = http.StatusServiceUnavailable
+		}
+		err = fmt.Errorf("Error when trying to obtain lfs usage of repository %s (%s).", name, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	b, err := json.Marshal(usage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
@@ -33,6 +33,7 @@ func (s *S) SetUpSuite(c *check.C) {
 	c.Assert(err, check.IsNil)
 	config.Set("database:url", "127.0.0.1:27017")
 	config.Set("database:name", "gandalf_api_tests")
+	config.Set("git:remotes:allow-file", true)
 	s.tmpdir, err = commandmocker.Add("git", "")
 	c.Assert(err, check.IsNil)
 	s.router = SetupRouter()
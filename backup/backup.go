@@ -0,0 +1,492 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package backup creates and restores full backups of gandalf.
+//
+// A backup is a gzipped tarball with a snapshot of the users, keys and
+// repositories in the database, a git bundle of each bare repository and
+// the hooks installed in them:
+//
+//	manifest.json
+//	db/user.bson
+//	db/key.bson
+//	db/repository.bson
+//	repositories/<repository>.bundle
+//	hooks/<repository>/<hook>
+//
+// Collections are stored as sequences of BSON documents, like the output of
+// mongodump. Empty repositories have no bundle.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/db/storage"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Version is the version of the format of backups.
+const Version = 1
+
+const (
+	manifestFile   = "manifest.json"
+	dbDir          = "db/"
+	repositoryDir  = "repositories/"
+	hooksDir       = "hooks/"
+	bundleSuffix   = ".bundle"
+	maxDocumentLen = 16 * 1024 * 1024
+)
+
+var (
+	ErrInvalidBackup = errors.New("invalid backup: the archive is not a gandalf backup")
+	ErrNotEmpty      = errors.New("the database is not empty, use force to replace its contents")
+)
+
+// collections are the collections in backups, in the order they're saved.
+var collections = []string{"user", "key", "repository"}
+
+// Manifest describes a backup.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Summary counts the contents of a backup.
+type Summary struct {
+	Users        int
+	Keys         int
+	Repositories int
+	Bundles      int
+	Hooks        int
+}
+
+func collection(conn *db.Storage, name string) *storage.Collection {
+	switch name {
+	case "user":
+		return conn.User()
+	case "key":
+		return conn.Key()
+	}
+	return conn.Repository()
+}
+
+func (s *Summary) count(name string, n int) {
+	switch name {
+	case "user":
+		s.Users += n
+	case "key":
+		s.Keys += n
+	case "repository":
+		s.Repositories += n
+	}
+}
+
+func writeFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	h := tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(&h); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// dumpCollection writes all the documents of the collection as a sequence of
+// BSON documents.
+func dumpCollection(c *storage.Collection, w io.Writer) (int, error) {
+	var raw bson.Raw
+	var n int
+	iter := c.Find(nil).Iter()
+	for iter.Next(&raw) {
+		if _, err := w.Write(raw.Data); err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+	return n, iter.Close()
+}
+
+// readDocument reads the next BSON document of a sequence, returning io.EOF
+// at the end of the sequence.
+func readDocument(r io.Reader) ([]byte, error) {
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidBackup
+		}
+		return nil, err
+	}
+	if size < 5 || size > maxDocumentLen {
+		return nil, ErrInvalidBackup
+	}
+	doc := make([]byte, size)
+	binary.LittleEndian.PutUint32(doc, uint32(size))
+	if _, err := io.ReadFull(r, doc[4:]); err != nil {
+		return nil, ErrInvalidBackup
+	}
+	return doc, nil
+}
+
+// Create writes a backup of gandalf to w. The database is saved first, and
+// then the bare repositories, so repositories created in the meantime are
+// not included.
+func Create(w io.Writer) (*Summary, error) {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	manifest, err := json.Marshal(Manifest{Version: Version, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFile(tw, manifestFile, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var summary Summary
+	for _, name := range collections {
+		var buf bytes.Buffer
+		n, err := dumpCollection(collection(conn, name), &buf)
+		if err != nil {
+			return nil, err
+		}
+		summary.count(name, n)
+		if err = writeFile(tw, dbDir+name+".bson", int64(buf.Len()), &buf); err != nil {
+			return nil, err
+		}
+	}
+	var repos []repository.Repository
+	if err = conn.Repository().Find(nil).Select(bson.M{"_id": 1}).Sort("_id").All(&repos); err != nil {
+		return nil, err
+	}
+	for _, r := range repos {
+		if err = backupRepository(tw, r.Name, &summary); err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return &summary, gw.Close()
+}
+
+func backupRepository(tw *tar.Writer, name string, summary *Summary) error {
+	bundle, err := repository.CreateBundle(name, nil)
+	switch err {
+	case nil:
+		defer bundle.Close()
+		info, err := bundle.Stat()
+		if err != nil {
+			return err
+		}
+		if err = writeFile(tw, repositoryDir+name+bundleSuffix, info.Size(), bundle); err != nil {
+			return err
+		}
+		summary.Bundles++
+	case repository.ErrEmptyBundle, repository.ErrRepositoryNotFound:
+	default:
+		return err
+	}
+	hooks, err := repository.ReadHooks(name)
+	if err != nil {
+		return err
+	}
+	for hook, content := range hooks {
+		if err = writeFile(tw, hooksDir+name+"/"+hook, int64(len(content)), bytes.NewReader(content)); err != nil {
+			return err
+		}
+		summary.Hooks++
+	}
+	return nil
+}
+
+// archive holds the contents of a backup, read into a temporary directory
+// before anything is restored.
+type archive struct {
+	dir string
+	// collections maps the name of each collection to the file with its
+	// documents.
+	collections map[string]string
+	repos       map[string]*repository.Repository
+	// bundles maps the name of each repository to the file with its
+	// bundle.
+	bundles map[string]string
+	hooks   []hookFile
+	summary Summary
+}
+
+type hookFile struct {
+	repository string
+	hook       string
+	file       string
+}
+
+// copyEntry copies the content of the current entry of the archive to a new
+// file in the temporary directory, returning its path.
+func (a *archive) copyEntry(rd io.Reader) (string, error) {
+	f, err := ioutil.TempFile(a.dir, "entry-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, rd); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// readCollection checks the documents of the collection, keeping the
+// repositories in the backup, and copies them to the temporary directory.
+func (a *archive) readCollection(name string, rd io.Reader) error {
+	known := false
+	for _, c := range collections {
+		known = known || c == name
+	}
+	if !known {
+		return fmt.Errorf("invalid backup: unknown collection %q", name)
+	}
+	if _, ok := a.collections[name]; ok {
+		return fmt.Errorf("invalid backup: collection %q saved twice", name)
+	}
+	f, err := ioutil.TempFile(a.dir, "collection-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	a.collections[name] = f.Name()
+	var n int
+	for {
+		doc, err := readDocument(rd)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var raw bson.M
+		if err = bson.Unmarshal(doc, &raw); err != nil {
+			return ErrInvalidBackup
+		}
+		if name == "repository" {
+			var repo repository.Repository
+			if err = bson.Unmarshal(doc, &repo); err != nil {
+				return ErrInvalidBackup
+			}
+			a.repos[repo.Name] = &repo
+		}
+		if _, err = f.Write(doc); err != nil {
+			return err
+		}
+		n++
+	}
+	a.summary.count(name, n)
+	return nil
+}
+
+func (a *archive) readBundle(name string, rd io.Reader) error {
+	if _, ok := a.bundles[name]; ok {
+		return fmt.Errorf("invalid backup: repository %q saved twice", name)
+	}
+	file, err := a.copyEntry(rd)
+	if err != nil {
+		return err
+	}
+	a.bundles[name] = file
+	a.summary.Bundles++
+	return nil
+}
+
+func (a *archive) readHook(name string, rd io.Reader) error {
+	repoName, hook := path.Split(name)
+	repoName = strings.TrimSuffix(repoName, "/")
+	if !repository.ValidHookName(hook) {
+		return fmt.Errorf("invalid backup: invalid hook name %q", hook)
+	}
+	file, err := a.copyEntry(rd)
+	if err != nil {
+		return err
+	}
+	a.hooks = append(a.hooks, hookFile{repository: repoName, hook: hook, file: file})
+	a.summary.Hooks++
+	return nil
+}
+
+// readArchive reads the whole backup into the directory dir, checking its
+// format, so nothing is changed when the backup is invalid.
+func readArchive(rd io.Reader, dir string) (*archive, error) {
+	gr, err := gzip.NewReader(rd)
+	if err != nil {
+		return nil, ErrInvalidBackup
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	h, err := tr.Next()
+	if err != nil || h.Name != manifestFile {
+		return nil, ErrInvalidBackup
+	}
+	var manifest Manifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, ErrInvalidBackup
+	}
+	if manifest.Version != Version {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	a := archive{
+		dir:         dir,
+		collections: map[string]string{},
+		repos:       map[string]*repository.Repository{},
+		bundles:     map[string]string{},
+	}
+	for {
+		h, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidBackup
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		switch name := h.Name; {
+		case strings.HasPrefix(name, dbDir):
+			err = a.readCollection(strings.TrimSuffix(strings.TrimPrefix(name, dbDir), ".bson"), tr)
+		case strings.HasPrefix(name, repositoryDir) && strings.HasSuffix(name, bundleSuffix):
+			err = a.readBundle(strings.TrimSuffix(strings.TrimPrefix(name, repositoryDir), bundleSuffix), tr)
+		case strings.HasPrefix(name, hooksDir):
+			err = a.readHook(strings.TrimPrefix(name, hooksDir), tr)
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidBackup
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The gzip checksum is only verified at the end of the stream.
+	if _, err = io.Copy(ioutil.Discard, gr); err != nil {
+		return nil, ErrInvalidBackup
+	}
+	for name := range a.bundles {
+		if _, ok := a.repos[name]; !ok {
+			return nil, fmt.Errorf("invalid backup: unknown repository %q", name)
+		}
+	}
+	for _, h := range a.hooks {
+		if _, ok := a.repos[h.repository]; !ok {
+			return nil, fmt.Errorf("invalid backup: unknown repository %q", h.repository)
+		}
+	}
+	return &a, nil
+}
+
+// restoreCollection inserts the documents of the collection saved in the
+// file.
+func restoreCollection(conn *db.Storage, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := collection(conn, name)
+	for {
+		doc, err := readDocument(f)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.Insert(bson.Raw{Kind: 0x03, Data: doc}); err != nil {
+			return err
+		}
+	}
+}
+
+// Restore restores a backup created by Create, inserting the documents in
+// the database, recreating the bare repositories and rewriting the
+// authorized_keys file. Restoring to a database that is not empty fails
+// with ErrNotEmpty, unless force is true, in which case the collections in
+// the backup and the bare repositories in it are replaced. The whole backup
+// is read and checked before anything is replaced. Unmanaged lines of the
+// authorized_keys file are preserved.
+func Restore(rd io.Reader, force bool) (*Summary, error) {
+	dir, err := ioutil.TempDir("", "gandalf-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	a, err := readArchive(rd, dir)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, name := range collections {
+		c := collection(conn, name)
+		n, err := c.Count()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 && !force {
+			return nil, ErrNotEmpty
+		}
+		if n > 0 {
+			if _, err = c.RemoveAll(nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range collections {
+		if file, ok := a.collections[name]; ok {
+			if err = restoreCollection(conn, name, file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name, repo := range a.repos {
+		if err = repository.RestoreBundle(repo, a.bundles[name], force); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range a.hooks {
+		content, err := ioutil.ReadFile(h.file)
+		if err != nil {
+			return nil, err
+		}
+		if err = repository.WriteHook(h.repository, h.hook, content); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = user.RebuildAuthorizedKeys(false, true); err != nil {
+		return nil, err
+	}
+	return &a.summary, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	tmpdir string
+}
+
+var _ = check.Suite(&S{})
+
+const rawKey = "ssh-dss AAAAB3NzaC1kc3MAAACBAIHfSDLpSCfIIVEJ/Is3RFMQhsCi7WZtFQeeyfi+DzVP0NGX4j/rMoQEHgXgNlOKVCJvPk5e00/xSfVPPsv3E0E1KE6nKRz2J5FVTABP+4BRF+FXnVo/xEQhuYg9r/IoG+bPNOwvUvqj/NYoZ2yFtbsxtXIyOXvvcgQXiOuexx/5kuBjFtj9nrB4B9s= me@tsuru.io"
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "gandalf_backup_tests")
+	s.tmpdir, err = ioutil.TempDir("", "gandalf_backup")
+	c.Assert(err, check.IsNil)
+	config.Set("git:bare:location", path.Join(s.tmpdir, "repositories"))
+	config.Set("authorized-keys-path", path.Join(s.tmpdir, "authorized_keys"))
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	os.RemoveAll(s.tmpdir)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.User().Database.DropDatabase()
+}
+
+func (s *S) TestReadDocument(c *check.C) {
+	var buf bytes.Buffer
+	for _, doc := range []bson.M{{"_id": "gopher"}, {"_id": "glenda", "keys": []string{"wow"}}} {
+		data, err := bson.Marshal(doc)
+		c.Assert(err, check.IsNil)
+		buf.Write(data)
+	}
+	var names []string
+	for {
+		doc, err := readDocument(&buf)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		var m bson.M
+		err = bson.Unmarshal(doc, &m)
+		c.Assert(err, check.IsNil)
+		names = append(names, m["_id"].(string))
+	}
+	c.Assert(names, check.DeepEquals, []string{"gopher", "glenda"})
+}
+
+func (s *S) TestReadDocumentTruncated(c *check.C) {
+	data, err := bson.Marshal(bson.M{"_id": "gopher"})
+	c.Assert(err, check.IsNil)
+	_, err = readDocument(bytes.NewReader(data[:len(data)-2]))
+	c.Assert(err, check.Equals, ErrInvalidBackup)
+	_, err = readDocument(bytes.NewReader(data[:2]))
+	c.Assert(err, check.Equals, ErrInvalidBackup)
+	_, err = readDocument(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f}))
+	c.Assert(err, check.Equals, ErrInvalidBackup)
+}
+
+func (s *S) TestRestoreInvalidArchive(c *check.C) {
+	_, err := Restore(bytes.NewBufferString("not a backup"), false)
+	c.Assert(err, check.Equals, ErrInvalidBackup)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	err = writeFile(tw, "README", 3, bytes.NewBufferString("wow"))
+	c.Assert(err, check.IsNil)
+	tw.Close()
+	gw.Close()
+	_, err = Restore(&buf, false)
+	c.Assert(err, check.Equals, ErrInvalidBackup)
+}
+
+func (s *S) TestRestoreUnsupportedVersion(c *check.C) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	manifest := `{"version":42}`
+	err := writeFile(tw, manifestFile, int64(len(manifest)), bytes.NewBufferString(manifest))
+	c.Assert(err, check.IsNil)
+	tw.Close()
+	gw.Close()
+	_, err = Restore(&buf, false)
+	c.Assert(err, check.ErrorMatches, "unsupported backup version 42")
+}
+
+func (s *S) TestRestoreHookOfUnknownRepository(c *check.C) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	manifest := `{"version":1}`
+	err := writeFile(tw, manifestFile, int64(len(manifest)), bytes.NewBufferString(manifest))
+	c.Assert(err, check.IsNil)
+	err = writeFile(tw, hooksDir+"nothing/post-receive", 10, bytes.NewBufferString("#!/bin/sh\n"))
+	c.Assert(err, check.IsNil)
+	tw.Close()
+	gw.Close()
+	_, err = Restore(&buf, true)
+	c.Assert(err, check.ErrorMatches, `invalid backup: unknown repository "nothing"`)
+}
+
+func (s *S) TestRestoreTruncatedArchiveKeepsDatabase(c *check.C) {
+	_, err := user.New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("gopher")
+	var archive bytes.Buffer
+	_, err = Create(&archive)
+	c.Assert(err, check.IsNil)
+	truncated := archive.Bytes()[:archive.Len()-10]
+	_, err = Restore(bytes.NewReader(truncated), true)
+	c.Assert(err, check.Equals, ErrInvalidBackup)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	n, err := conn.User().FindId("gopher").Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+}
+
+func (s *S) TestCreateAndRestore(c *check.C) {
+	_, err := user.New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	_, err = repository.New("empty", []string{"gopher"}, nil, false)
+	c.Assert(err, check.IsNil)
+	_, err = repository.New("myrepo", []string{"gopher"}, []string{"glenda"}, true)
+	c.Assert(err, check.IsNil)
+	err = repository.WriteHook("myrepo", "post-receive", []byte("#!/bin/sh\n"))
+	c.Assert(err, check.IsNil)
+	cleanUp, err := repository.CreateTestRepository(s.tmpdir, "myrepo-work", "README", "much backup")
+	c.Assert(err, check.IsNil)
+	defer cleanUp()
+	cmd := exec.Command("git", "push", path.Join(s.tmpdir, "repositories", "myrepo.git"), "master")
+	cmd.Dir = path.Join(s.tmpdir, "myrepo-work.git")
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, check.IsNil, check.Commentf("%s", out))
+	var archive bytes.Buffer
+	summary, err := Create(&archive)
+	c.Assert(err, check.IsNil)
+	c.Assert(*summary, check.Equals, Summary{Users: 1, Keys: 1, Repositories: 2, Bundles: 1, Hooks: 1})
+	_, err = Restore(bytes.NewReader(archive.Bytes()), false)
+	c.Assert(err, check.Equals, ErrNotEmpty)
+	err = repository.Remove("myrepo")
+	c.Assert(err, check.IsNil)
+	err = user.Remove("gopher")
+	c.Assert(err, check.IsNil)
+	summary, err = Restore(bytes.NewReader(archive.Bytes()), true)
+	c.Assert(err, check.IsNil)
+	c.Assert(*summary, check.Equals, Summary{Users: 1, Keys: 1, Repositories: 2, Bundles: 1, Hooks: 1})
+	defer user.Remove("gopher")
+	defer repository.Remove("empty")
+	defer repository.Remove("myrepo")
+	r, err := repository.Get("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.ReadOnlyUsers, check.DeepEquals, []string{"glenda"})
+	c.Assert(r.IsPublic, check.Equals, true)
+	branches, err := repository.GetBranches("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(branches, check.HasLen, 1)
+	hooks, err := repository.ReadHooks("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(hooks, check.DeepEquals, map[string][]byte{"post-receive": []byte("#!/bin/sh\n")})
+	_, err = os.Stat(path.Join(s.tmpdir, "repositories", "empty.git"))
+	c.Assert(err, check.IsNil)
+	keys, err := ioutil.ReadFile(path.Join(s.tmpdir, "authorized_keys"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(keys), check.Matches, `(?s).*command=".* gopher SHA256:[^"]+" `+rawKey[:40]+`.*`)
+}
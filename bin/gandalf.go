@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,42 +14,26 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
 	"strings"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/lfs"
 	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/search"
 	"github.com/tsuru/gandalf/user"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var log *syslog.Writer
 
-func hasWritePermission(u *user.User, r *repository.Repository) (allowed bool) {
-	for _, userName := range r.Users {
-		if u.Name == userName {
-			return true
-		}
-	}
-	return false
+// See user.CheckAccess for who can push to repositories.
+func hasPushPermission(u *user.User, r *repository.Repository) (allowed bool) {
+	return user.CheckAccess(u.Name, "git-receive-pack", r) == nil
 }
 
 func hasReadPermission(u *user.User, r *repository.Repository) (allowed bool) {
-	if r.IsPublic {
-		return true
-	}
-	for _, userName := range r.Users {
-		if u.Name == userName {
-			return true
-		}
-	}
-	for _, userName := range r.ReadOnlyUsers {
-		if u.Name == userName {
-			return true
-		}
-	}
-	return false
+	return user.CheckAccess(u.Name, "git-upload-pack", r) == nil
 }
 
 // Returns the command being executed by ssh.
@@ -73,6 +58,10 @@ func requestedRepository() (repository.Repository, error) {
 	if err != nil {
 		return repository.Repository{}, err
 	}
+	return getRepository(repoName)
+}
+
+func getRepository(repoName string) (repository.Repository, error) {
 	var repo repository.Repository
 	conn, err := db.Conn()
 	if err != nil {
@@ -85,80 +74,174 @@ func requestedRepository() (repository.Repository, error) {
 	return repo, nil
 }
 
-// Checks whether a command is a valid git command
-// The following format is allowed:
-// (git-[a-z-]+) '/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'
+// Checks whether SSH_ORIGINAL_COMMAND is a valid git command, returning the
+// command and the name of the repository. See repository.ParseGitCommand for
+// the allowed format.
 func parseGitCommand() (command, name string, err error) {
-	// The following regex validates the git command, which is in the form:
-	//    <git-command> [<namespace>/]<name>
-	// with namespace being optional. If a namespace is used, we validate it
-	// according to the following:
-	//  - a namespace is optional
-	//  - a namespace contains only alphanumerics, underlines, @´s, -´s, +´s
-	//    and periods but it does not start with a period (.)
-	//  - one and exactly one slash (/) separates namespace and the actual name
-	r, err := regexp.Compile(`(git-[a-z-]+) '/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'`)
+	return repository.ParseGitCommand(os.Getenv("SSH_ORIGINAL_COMMAND"))
+}
+
+// Checks whether SSH_ORIGINAL_COMMAND is a valid git-lfs-authenticate
+// command, in the form "git-lfs-authenticate <repository>.git
+// <download|upload>".
+func parseLFSCommand() (name, operation string, err error) {
+	return repository.ParseLFSCommand(os.Getenv("SSH_ORIGINAL_COMMAND"))
+}
+
+func getUser(name string) (user.User, error) {
+	var u user.User
+	conn, err := db.Conn()
 	if err != nil {
-		panic(err)
+		return u, err
 	}
-	m := r.FindStringSubmatch(os.Getenv("SSH_ORIGINAL_COMMAND"))
-	if len(m) != 4 {
-		return "", "", errors.New("You've tried to execute some weird command, I'm deliberately denying you to do that, get over it.")
+	defer conn.Close()
+	if err = conn.User().Find(bson.M{"_id": name}).One(&u); err != nil {
+		return u, errors.New("Error obtaining user. Gandalf database is probably in an inconsistent state.")
+	}
+	return u, nil
+}
+
+// Answers the git-lfs-authenticate command, writing to stdout the LFS
+// endpoint of the repository and a token that identifies the user in it.
+func lfsAuthenticate(stdout io.Writer) {
+	repoName, operation, err := parseLFSCommand()
+	if err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	u, err := getUser(os.Args[1])
+	if err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	repo, err := getRepository(repoName)
+	if err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	if err = user.CheckLFSAccess(u.Name, operation, &repo); err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	auth, err := lfs.Authenticate(u.Name, repo.Name, operation)
+	if err == nil {
+		err = json.NewEncoder(stdout).Encode(auth)
+	}
+	if err != nil {
+		log.Err("Could not authenticate to git lfs: " + err.Error())
+		fmt.Fprintln(os.Stderr, "Could not authenticate to git lfs: "+err.Error())
 	}
-	return m[1], m[2] + m[3], nil
 }
 
 // Executes the SSH_ORIGINAL_COMMAND based on the condition
 // defined by the `f` parameter.
 // Also receives a custom error message to print to the end user and a
-// stdout object, where the SSH_ORIGINAL_COMMAND output is going to be written
-func executeAction(f func(*user.User, *repository.Repository) bool, errMsg string, stdout io.Writer) {
+// stdout object, where the SSH_ORIGINAL_COMMAND output is going to be written.
+// Returns whether the command was allowed and succeeded.
+func executeAction(f func(*user.User, *repository.Repository) bool, errMsg string, stdout io.Writer) bool {
 	var u user.User
 	conn, err := db.Conn()
 	if err != nil {
-		return
+		return false
 	}
 	defer conn.Close()
 	if err = conn.User().Find(bson.M{"_id": os.Args[1]}).One(&u); err != nil {
 		log.Err("Error obtaining user. Gandalf database is probably in an inconsistent state.")
 		fmt.Fprintln(os.Stderr, "Error obtaining user. Gandalf database is probably in an inconsistent state.")
-		return
+		return false
 	}
 	repo, err := requestedRepository()
 	if err != nil {
 		log.Err(err.Error())
 		fmt.Fprintln(os.Stderr, err.Error())
-		return
+		return false
 	}
 	if f(&u, &repo) {
-		// split into a function (maybe executeCmd)
-		c, err := formatCommand()
+		return runCommand("TSURU_USER="+u.Name, stdout) == nil
+	}
+	log.Err("Permission denied.")
+	log.Err(errMsg)
+	fmt.Fprintln(os.Stderr, "Permission denied.")
+	fmt.Fprintln(os.Stderr, errMsg)
+	return false
+}
+
+// Runs the SSH_ORIGINAL_COMMAND in the requested repository, adding env to
+// its environment.
+func runCommand(env string, stdout io.Writer) error {
+	c, err := formatCommand()
+	if err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+		return err
+	}
+	log.Info("Executing " + strings.Join(c, " "))
+	cmd := exec.Command(c[0], c[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	baseEnv := os.Environ()
+	baseEnv = append(baseEnv, env)
+	cmd.Env = baseEnv
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		log.Err("Got error while executing original command: " + err.Error())
+		log.Err(stderr.String())
+		fmt.Fprintln(os.Stderr, "Got error while executing original command: "+err.Error())
+		fmt.Fprintln(os.Stderr, stderr.String())
+	}
+	return err
+}
+
+// Executes the SSH_ORIGINAL_COMMAND for a deploy key, identified by the
+// fingerprint in the second argument. See user.Key.CheckAccess for what
+// deploy keys can do.
+func executeDeployKeyAction(stdout io.Writer) {
+	deny := func(msg string) {
+		log.Err("Permission denied: " + msg)
+		fmt.Fprintln(os.Stderr, "Permission denied.")
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	if len(os.Args) < 3 {
+		deny(user.ErrDeployKeyNotFound.Error())
+		return
+	}
+	key, err := user.UseDeployKey(os.Args[2])
+	if err != nil {
+		deny(err.Error())
+		return
+	}
+	var repoName string
+	if action() != "git-lfs-authenticate" {
+		_, repoName, err = parseGitCommand()
 		if err != nil {
 			log.Err(err.Error())
 			fmt.Fprintln(os.Stderr, err.Error())
+			return
 		}
-		log.Info("Executing " + strings.Join(c, " "))
-		cmd := exec.Command(c[0], c[1:]...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = stdout
-		baseEnv := os.Environ()
-		baseEnv = append(baseEnv, "TSURU_USER="+u.Name)
-		cmd.Env = baseEnv
-		stderr := &bytes.Buffer{}
-		cmd.Stderr = stderr
-		err = cmd.Run()
-		if err != nil {
-			log.Err("Got error while executing original command: " + err.Error())
-			log.Err(stderr.String())
-			fmt.Fprintln(os.Stderr, "Got error while executing original command: "+err.Error())
-			fmt.Fprintln(os.Stderr, stderr.String())
-		}
+	}
+	if _, err = key.CheckAccess(action(), repoName); err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		return
 	}
-	log.Err("Permission denied.")
-	log.Err(errMsg)
-	fmt.Fprintln(os.Stderr, "Permission denied.")
-	fmt.Fprintln(os.Stderr, errMsg)
+	if runCommand("GANDALF_DEPLOY_KEY="+key.Name, stdout) == nil && action() == "git-receive-pack" {
+		queueSearchUpdate()
+		queuePushMirrors()
+	}
+}
+
+// Tells the user that the command in SSH_ORIGINAL_COMMAND is a valid git
+// command that gandalf doesn't serve.
+func unsupportedCommand() {
+	err := &repository.UnsupportedCommandError{Command: action()}
+	log.Err(err.Error())
+	fmt.Fprintln(os.Stderr, err.Error())
 }
 
 func formatCommand() ([]string, error) {
@@ -182,6 +265,21 @@ func formatCommand() ([]string, error) {
 	return cmdList, nil
 }
 
+// Queues the update of the code search index of the requested repository.
+// The index is updated by the webserver, so the push doesn't wait for it.
+func queueSearchUpdate() {
+	if !search.Enabled() {
+		return
+	}
+	_, repoName, err := parseGitCommand()
+	if err != nil {
+		return
+	}
+	if err = search.Queue(repoName); err != nil {
+		log.Err("Could not queue search index update: " + err.Error())
+	}
+}
+
 func main() {
 	var err error
 	log, err = syslog.New(syslog.LOG_INFO, "gandalf-listener")
@@ -195,19 +293,63 @@ func main() {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == user.DeployKeyFlag {
+		executeDeployKeyAction(os.Stdout)
+		return
+	}
+	if err = useKey(); err != nil {
+		log.Err("Permission denied: " + err.Error())
+		fmt.Fprintln(os.Stderr, "Permission denied.")
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	if action() == "git-lfs-authenticate" {
+		lfsAuthenticate(os.Stdout)
+		return
+	}
 	_, _, err = parseGitCommand()
 	if err != nil {
 		log.Err(err.Error())
 		fmt.Fprintln(os.Stderr, err.Error())
 		return
 	}
-	a := action()
-	if a == "git-receive-pack" {
-		executeAction(hasWritePermission, "You don't have access to write in this repository.", os.Stdout)
-		return
+	switch action() {
+	case "git-receive-pack":
+		if executeAction(hasPushPermission, user.ErrPushDenied.Reason, os.Stdout) {
+			queueSearchUpdate()
+			queuePushMirrors()
+		}
+	case "git-upload-pack", "git-upload-archive":
+		executeAction(hasReadPermission, user.ErrReadDenied.Reason, os.Stdout)
+	default:
+		unsupportedCommand()
+	}
+}
+
+// Checks the key used to connect, identified by the fingerprint in the
+// second argument, and records its use. Keys written to authorized_keys
+// before fingerprints were stored don't have the argument, so they're
+// refused only when all the keys of the user expired. Users connecting
+// with certificates are identified by the principal in the first argument,
+// and the second one identifies the certificate authority.
+func useKey() error {
+	if len(os.Args) < 3 {
+		return user.CheckUserKeys(os.Args[1])
 	}
-	if a == "git-upload-pack" {
-		executeAction(hasReadPermission, "You don't have access to read this repository.", os.Stdout)
+	if strings.HasPrefix(os.Args[2], "cert:") {
+		return user.UseCertificate(os.Args[1], os.Args[2])
+	}
+	return user.UseKey(os.Args[1], os.Args[2])
+}
+
+// Queues the push mirrors of the requested repository. The accepted changes
+// are pushed to them by the webserver, so the push doesn't wait for them.
+func queuePushMirrors() {
+	_, repoName, err := parseGitCommand()
+	if err != nil {
 		return
 	}
+	if err = repository.QueuePushMirrors(repoName); err != nil {
+		log.Err("Could not queue push mirrors: " + err.Error())
+	}
 }
@@ -6,14 +6,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"log/syslog"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/tsuru/commandmocker"
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/lfs"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/gandalf/user"
 	"gopkg.in/check.v1"
@@ -54,22 +58,6 @@ func (s *S) TearDownSuite(c *check.C) {
 	conn.User().Database.DropDatabase()
 }
 
-func (s *S) TestHasWritePermissionSholdReturnTrueWhenUserCanWriteInRepo(c *check.C) {
-	allowed := hasWritePermission(s.user, s.repo)
-	c.Assert(allowed, check.Equals, true)
-}
-
-func (s *S) TestHasWritePermissionShouldReturnFalseWhenUserCannotWriteinRepo(c *check.C) {
-	r := &repository.Repository{Name: "myotherapp"}
-	conn, err := db.Conn()
-	c.Assert(err, check.IsNil)
-	defer conn.Close()
-	conn.Repository().Insert(&r)
-	defer conn.Repository().Remove(bson.M{"_id": r.Name})
-	allowed := hasWritePermission(s.user, r)
-	c.Assert(allowed, check.Equals, false)
-}
-
 func (s *S) TestHasReadPermissionShouldReturnTrueWhenRepositoryIsPublic(c *check.C) {
 	r := &repository.Repository{Name: "myotherapp", IsPublic: true}
 	conn, err := db.Conn()
@@ -192,6 +180,39 @@ func (s *S) TestParseGitCommandWithSlash(c *check.C) {
 	c.Assert(name, check.Equals, "foobar")
 }
 
+func (s *S) TestParseLFSCommand(c *check.C) {
+	defer os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	tests := []struct {
+		command, name, operation string
+	}{
+		{"git-lfs-authenticate 'foobar.git' download", "foobar", "download"},
+		{"git-lfs-authenticate foobar.git upload", "foobar", "upload"},
+		{"git-lfs-authenticate '/much/foobar.git' upload", "much/foobar", "upload"},
+	}
+	for _, t := range tests {
+		os.Setenv("SSH_ORIGINAL_COMMAND", t.command)
+		name, operation, err := parseLFSCommand()
+		c.Check(err, check.IsNil)
+		c.Check(name, check.Equals, t.name)
+		c.Check(operation, check.Equals, t.operation)
+	}
+}
+
+func (s *S) TestParseLFSCommandShouldReturnErrorWhenTheresNoMatch(c *check.C) {
+	defer os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	for _, command := range []string{
+		"git-lfs-authenticate 'foobar.git' delete",
+		"git-lfs-authenticate 'foobar.git'",
+		"git-lfs-authenticate '../foobar.git' download",
+		"git-lfs-authenticate 'foobar.git' download; rm -rf /",
+	} {
+		os.Setenv("SSH_ORIGINAL_COMMAND", command)
+		name, _, err := parseLFSCommand()
+		c.Check(err, check.ErrorMatches, "You've tried to execute some weird command, I'm deliberately denying you to do that, get over it.")
+		c.Check(name, check.Equals, "")
+	}
+}
+
 func (s *S) TestParseGitCommandShouldReturnErrorWhenTheresNoMatch(c *check.C) {
 	defer os.Setenv("SSH_ORIGINAL_COMMAND", "")
 	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack foobar")
@@ -240,7 +261,7 @@ func (s *S) TestExecuteActionShouldExecuteGitReceivePackWhenUserHasWritePermissi
 		os.Setenv("SSH_ORIGINAL_COMMAND", "")
 	}()
 	stdout := &bytes.Buffer{}
-	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	executeAction(hasPushPermission, "You don't have access to write in this repository.", stdout)
 	c.Assert(commandmocker.Ran(dir), check.Equals, true)
 	p, err := config.GetString("git:bare:location")
 	c.Assert(err, check.IsNil)
@@ -249,6 +270,96 @@ func (s *S) TestExecuteActionShouldExecuteGitReceivePackWhenUserHasWritePermissi
 	c.Assert(commandmocker.Envs(dir), check.Matches, `(?s).*TSURU_USER=testuser.*`)
 }
 
+func (s *S) TestExecuteActionShouldExecuteGitUploadArchiveWithGitProtocol(c *check.C) {
+	dir, err := commandmocker.Add("git-upload-archive", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-upload-archive 'myapp.git'")
+	os.Setenv("GIT_PROTOCOL", "version=2")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+		os.Unsetenv("GIT_PROTOCOL")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasReadPermission, "You don't have access to read this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, true)
+	p, err := config.GetString("git:bare:location")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, path.Join(p, "myapp.git"))
+	c.Assert(commandmocker.Envs(dir), check.Matches, `(?s).*GIT_PROTOCOL=version=2.*`)
+}
+
+func (s *S) TestExecuteDeployKeyAction(c *check.C) {
+	key := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDAlECFQUM9bcKHk76J7298DRWQCzf3RFOWZlPnmVoR6R54CCn5yzHgBJJfHXoUC9tBUO5HKcFmA9qzCg5Pznyi0LkBXUpBxaMqSml4pKVIjw7OFxdfv11zs+a/xIAC7v6jOEvJYatks6pyvf5y+/fqOoRcn3/jdyuhanx2Loyz9w== ci@host"
+	k, err := user.AddDeployKey(s.repo.Name, "ci", key, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	defer user.RemoveDeployKeys(s.repo.Name)
+	dir, err := commandmocker.Add("git-upload-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", user.DeployKeyFlag, k.Fingerprint}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-upload-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeDeployKeyAction(stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, true)
+	c.Assert(commandmocker.Envs(dir), check.Matches, `(?s).*GANDALF_DEPLOY_KEY=ci.*`)
+}
+
+func (s *S) TestExecuteDeployKeyActionRefusesPushesOfReadOnlyKeys(c *check.C) {
+	key := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDAlECFQUM9bcKHk76J7298DRWQCzf3RFOWZlPnmVoR6R54CCn5yzHgBJJfHXoUC9tBUO5HKcFmA9qzCg5Pznyi0LkBXUpBxaMqSml4pKVIjw7OFxdfv11zs+a/xIAC7v6jOEvJYatks6pyvf5y+/fqOoRcn3/jdyuhanx2Loyz9w== ci@host"
+	k, err := user.AddDeployKey(s.repo.Name, "ci", key, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	defer user.RemoveDeployKeys(s.repo.Name)
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", user.DeployKeyFlag, k.Fingerprint}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	executeDeployKeyAction(&bytes.Buffer{})
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+}
+
+func (s *S) TestUseKeyWithoutFingerprint(c *check.C) {
+	os.Args = []string{"gandalf", s.user.Name}
+	defer func() { os.Args = []string{} }()
+	c.Assert(useKey(), check.IsNil)
+}
+
+func (s *S) TestUseKeyRefusesExpiredKeys(c *check.C) {
+	key := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDAlECFQUM9bcKHk76J7298DRWQCzf3RFOWZlPnmVoR6R54CCn5yzHgBJJfHXoUC9tBUO5HKcFmA9qzCg5Pznyi0LkBXUpBxaMqSml4pKVIjw7OFxdfv11zs+a/xIAC7v6jOEvJYatks6pyvf5y+/fqOoRcn3/jdyuhanx2Loyz9w== testuser@host"
+	err := user.AddKeyWithExpiry(s.user.Name, map[string]string{"expired": key}, time.Now().Add(-time.Hour))
+	c.Assert(err, check.IsNil)
+	defer user.RemoveKey(s.user.Name, "expired")
+	keys, err := user.ListKeys(s.user.Name)
+	c.Assert(err, check.IsNil)
+	os.Args = []string{"gandalf", s.user.Name, keys[0].Fingerprint}
+	defer func() { os.Args = []string{} }()
+	c.Assert(useKey(), check.Equals, user.ErrKeyExpired)
+	os.Args = []string{"gandalf", s.user.Name}
+	c.Assert(useKey(), check.Equals, user.ErrKeyExpired)
+}
+
+func (s *S) TestUseKeyWithCertificate(c *check.C) {
+	ca := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDAlECFQUM9bcKHk76J7298DRWQCzf3RFOWZlPnmVoR6R54CCn5yzHgBJJfHXoUC9tBUO5HKcFmA9qzCg5Pznyi0LkBXUpBxaMqSml4pKVIjw7OFxdfv11zs+a/xIAC7v6jOEvJYatks6pyvf5y+/fqOoRcn3/jdyuhanx2Loyz9w== ca@host"
+	config.Set("ssh-ca:keys", []interface{}{ca})
+	defer config.Unset("ssh-ca")
+	os.Args = []string{"gandalf", s.user.Name, "cert:SHA256:V6FRMsKJmSeVweH2Z8jPnQ3YLd0bbQOn+9qrLNwDIT8"}
+	defer func() { os.Args = []string{} }()
+	c.Assert(useKey(), check.IsNil)
+	os.Args = []string{"gandalf", s.user.Name, "cert:SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM"}
+	c.Assert(useKey(), check.Equals, user.ErrUntrustedCertificate)
+}
+
 func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenUserDoesNotExist(c *check.C) {
 	dir, err := commandmocker.Add("git-receive-pack", "$*")
 	c.Check(err, check.IsNil)
@@ -261,7 +372,7 @@ func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenUserDoesNotExi
 	}()
 	stdout := new(bytes.Buffer)
 	errorMsg := "You don't have access to write in this repository."
-	executeAction(hasWritePermission, errorMsg, stdout)
+	executeAction(hasPushPermission, errorMsg, stdout)
 	c.Assert(commandmocker.Ran(dir), check.Equals, false)
 }
 
@@ -277,7 +388,7 @@ func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenRepositoryDoes
 	}()
 	stdout := &bytes.Buffer{}
 	errorMsg := "You don't have access to write in this repository."
-	executeAction(hasWritePermission, errorMsg, stdout)
+	executeAction(hasPushPermission, errorMsg, stdout)
 	c.Assert(commandmocker.Ran(dir), check.Equals, false)
 }
 
@@ -313,3 +424,55 @@ func (s *S) TestFormatCommandShouldReceiveAGitCommandProjectWithDash(c *check.C)
 	expected := path.Join(p, "myproject.git")
 	c.Assert(cmd, check.DeepEquals, []string{"git-receive-pack", expected})
 }
+
+func (s *S) TestLFSAuthenticateShouldWriteTokenWhenUserHasWritePermission(c *check.C) {
+	config.Set("lfs:location", "/tmp/gandalf-lfs")
+	config.Set("lfs:secret", "much secret")
+	config.Set("lfs:url", "http://localhost:8000")
+	defer func() {
+		config.Unset("lfs:location")
+		config.Unset("lfs:secret")
+		config.Unset("lfs:url")
+	}()
+	os.Args = []string{"gandalf", s.user.Name}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-lfs-authenticate myapp.git upload")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	lfsAuthenticate(stdout)
+	var auth lfs.Authentication
+	err := json.Unmarshal(stdout.Bytes(), &auth)
+	c.Assert(err, check.IsNil)
+	c.Assert(auth.Href, check.Equals, "http://localhost:8000/repository/myapp/info/lfs")
+	token := strings.TrimPrefix(auth.Header["Authorization"], "RemoteAuth ")
+	user, err := lfs.VerifyToken(token, "myapp", lfs.Upload)
+	c.Assert(err, check.IsNil)
+	c.Assert(user, check.Equals, s.user.Name)
+}
+
+func (s *S) TestLFSAuthenticateShouldNotWriteTokenWhenUserDoesNotExist(c *check.C) {
+	os.Args = []string{"gandalf", "god"}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-lfs-authenticate 'myapp.git' download")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	lfsAuthenticate(stdout)
+	c.Assert(stdout.String(), check.Equals, "")
+}
+
+func (s *S) TestHasPushPermissionShouldReturnFalseWhenRepositoryIsMirror(c *check.C) {
+	c.Assert(hasPushPermission(s.user, s.repo), check.Equals, true)
+	mirror := repository.Repository{Name: "mirrored", Users: []string{s.user.Name}, Mirror: &repository.Mirror{URL: "file:///tmp/nothing.git"}}
+	c.Assert(hasPushPermission(s.user, &mirror), check.Equals, false)
+}
+
+func (s *S) TestHasPushPermissionShouldReturnFalseWhileImporting(c *check.C) {
+	imported := repository.Repository{Name: "imported", Users: []string{s.user.Name}, Import: &repository.Import{URL: "https://example.com/wow.git", Status: repository.ImportRunning}}
+	c.Assert(hasPushPermission(s.user, &imported), check.Equals, false)
+	imported.Import.Status = repository.ImportSucceeded
+	c.Assert(hasPushPermission(s.user, &imported), check.Equals, true)
+}
@@ -6,9 +6,12 @@
 package db
 
 import (
+	"strings"
+
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/db/storage"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -62,9 +65,41 @@ func (s *Storage) User() *storage.Collection {
 
 func (s *Storage) Key() *storage.Collection {
 	bodyIndex := mgo.Index{Key: []string{"body"}, Unique: true}
-	nameIndex := mgo.Index{Key: []string{"username", "name"}, Unique: true}
+	nameIndex := mgo.Index{Key: []string{"username", "repository", "name"}, Unique: true}
+	fingerprintIndex := mgo.Index{Key: []string{"fingerprint"}}
 	c := s.Collection("key")
 	c.EnsureIndex(bodyIndex)
 	c.EnsureIndex(nameIndex)
+	c.EnsureIndex(fingerprintIndex)
 	return c
 }
+
+// Migrate updates the database created by older versions of gandalf. It's
+// called by the webserver when it starts, so the other processes don't need
+// to check it on every connection.
+func Migrate() error {
+	conn, err := Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The unique index of key names by user was replaced by an index that
+	// includes the repository of deploy keys, since they belong to no user.
+	// Keys stored before it have no repository, which the new index takes
+	// as null instead of the empty string of newer user keys, so it would
+	// accept two keys with the same name for the same user.
+	_, err = conn.Key().UpdateAll(bson.M{"repository": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"repository": ""}})
+	if err != nil {
+		return err
+	}
+	indexes, err := conn.Key().Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if strings.Join(index.Key, ",") == "username,name" {
+			return conn.Key().DropIndex(index.Key...)
+		}
+	}
+	return nil
+}
@@ -9,6 +9,8 @@ import (
 
 	"github.com/tsuru/config"
 	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func Test(t *testing.T) { check.TestingT(t) }
@@ -63,11 +65,49 @@ func (s *S) TestSessionKeyIndexes(c *check.C) {
 	key := conn.Key()
 	indexes, err := key.Indexes()
 	c.Assert(err, check.IsNil)
-	c.Check(indexes, check.HasLen, 3)
+	c.Check(indexes, check.HasLen, 4)
 	c.Check(indexes[1].Key, check.DeepEquals, []string{"body"})
 	c.Check(indexes[1].Unique, check.DeepEquals, true)
-	c.Check(indexes[2].Key, check.DeepEquals, []string{"username", "name"})
-	c.Check(indexes[2].Unique, check.DeepEquals, true)
+	c.Check(indexes[2].Key, check.DeepEquals, []string{"fingerprint"})
+	c.Check(indexes[2].Unique, check.DeepEquals, false)
+	c.Check(indexes[3].Key, check.DeepEquals, []string{"username", "repository", "name"})
+	c.Check(indexes[3].Unique, check.DeepEquals, true)
+}
+
+func (s *S) TestMigrateDropsUserKeyNameIndex(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	key := conn.Key()
+	err = key.EnsureIndex(mgo.Index{Key: []string{"username", "name"}, Unique: true})
+	c.Assert(err, check.IsNil)
+	err = Migrate()
+	c.Assert(err, check.IsNil)
+	indexes, err := key.Indexes()
+	c.Assert(err, check.IsNil)
+	c.Assert(indexes, check.HasLen, 4)
+	for _, index := range indexes {
+		c.Check(index.Key, check.Not(check.DeepEquals), []string{"username", "name"})
+	}
+	err = Migrate()
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestMigrateSetsRepositoryOfOldKeys(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	key := conn.Key()
+	defer key.RemoveAll(bson.M{"username": "gopher"})
+	err = key.Insert(bson.M{"name": "my-key", "username": "gopher", "body": "ssh-rsa old"})
+	c.Assert(err, check.IsNil)
+	err = Migrate()
+	c.Assert(err, check.IsNil)
+	n, err := key.Find(bson.M{"username": "gopher", "repository": ""}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+	err = key.Insert(bson.M{"name": "my-key", "username": "gopher", "repository": "", "body": "ssh-rsa new"})
+	c.Assert(mgo.IsDup(err), check.Equals, true)
 }
 
 func (s *S) TestConnect(c *check.C) {
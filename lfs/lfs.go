@@ -0,0 +1,419 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lfs implements the server side of Git LFS: the batch API, a local
+// filesystem object store and the tokens used to authenticate clients.
+//
+// Objects are stored in the directory defined by the "lfs:location" setting,
+// with one directory per repository, so an object is only available in the
+// repositories it was uploaded to. The directories are named after the
+// escaped names of the repositories, so the store of a repository is never
+// inside the store of another one, like "foo/objects" inside "foo". Clients get a token by running
+// git-lfs-authenticate through gandalf's SSH wrapper; the token is signed
+// with the "lfs:secret" setting and identifies the user in the API.
+package lfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/repository"
+)
+
+const (
+	Download = "download"
+	Upload   = "upload"
+
+	// MediaType is the content type of the requests and responses of the
+	// batch API.
+	MediaType = "application/vnd.git-lfs+json"
+
+	tokenExpiration = time.Hour
+	tokenScheme     = "RemoteAuth "
+)
+
+var (
+	ErrLFSDisabled    = errors.New("git lfs is disabled, please configure lfs:location and lfs:secret")
+	ErrInvalidToken   = errors.New("invalid or expired lfs token")
+	ErrInvalidObject  = errors.New("invalid lfs object id")
+	ErrObjectNotFound = errors.New("lfs object not found")
+	ErrObjectMismatch = errors.New("lfs object does not match its id or size")
+)
+
+var oidRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Pointer identifies an object by its SHA-256 hash and its size.
+type Pointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// BatchRequest is the body of a request to the batch API.
+type BatchRequest struct {
+	Operation string    `json:"operation"`
+	Transfers []string  `json:"transfers,omitempty"`
+	Objects   []Pointer `json:"objects"`
+}
+
+// Action tells the client where an object should be transferred to or from.
+type Action struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+// ObjectError describes why an object of a batch request can't be
+// transferred.
+type ObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchObject is the response for each object of a batch request.
+type BatchObject struct {
+	Pointer
+	Authenticated bool              `json:"authenticated,omitempty"`
+	Actions       map[string]Action `json:"actions,omitempty"`
+	Error         *ObjectError      `json:"error,omitempty"`
+}
+
+// BatchResponse is the body of a response of the batch API.
+type BatchResponse struct {
+	Transfer string        `json:"transfer"`
+	Objects  []BatchObject `json:"objects"`
+}
+
+// Authentication is the output of git-lfs-authenticate.
+type Authentication struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header"`
+	ExpiresIn int               `json:"expires_in"`
+}
+
+// Usage is the amount of LFS storage used by a repository.
+type Usage struct {
+	Objects int   `json:"objects"`
+	Size    int64 `json:"size"`
+}
+
+func location() (string, error) {
+	location, err := config.GetString("lfs:location")
+	if err != nil || location == "" {
+		return "", ErrLFSDisabled
+	}
+	return location, nil
+}
+
+func secret() ([]byte, error) {
+	secret, err := config.GetString("lfs:secret")
+	if err != nil || secret == "" {
+		return nil, ErrLFSDisabled
+	}
+	return []byte(secret), nil
+}
+
+// Enabled returns whether Git LFS is configured.
+func Enabled() bool {
+	_, locErr := location()
+	_, secretErr := secret()
+	return locErr == nil && secretErr == nil
+}
+
+// Href returns the LFS endpoint of the repository, relative to the base URL
+// of the API.
+func Href(baseURL, repo string) string {
+	return fmt.Sprintf("%s/repository/%s/info/lfs", strings.TrimRight(baseURL, "/"), repo)
+}
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewToken returns a token that identifies the user in the LFS API of the
+// given repository, allowing the given operation until the expiration time.
+// Upload tokens may also be used for downloads.
+func NewToken(user, repo, operation string, expires time.Time) (string, error) {
+	key, err := secret()
+	if err != nil {
+		return "", err
+	}
+	fields := []string{user, repo, operation, strconv.FormatInt(expires.Unix(), 10)}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join(fields, "\n")))
+	return payload + "." + sign(key, payload), nil
+}
+
+// VerifyToken checks the token against the repository and the operation,
+// returning the name of the user it was issued to.
+func VerifyToken(token, repo, operation string) (string, error) {
+	key, err := secret()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(sign(key, parts[0])), []byte(parts[1])) {
+		return "", ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 4 || fields[1] != repo {
+		return "", ErrInvalidToken
+	}
+	if fields[2] != operation && fields[2] != Upload {
+		return "", ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", ErrInvalidToken
+	}
+	return fields[0], nil
+}
+
+// AuthorizationHeader returns the value of the Authorization header that
+// carries the token.
+func AuthorizationHeader(token string) string {
+	return tokenScheme + token
+}
+
+// TokenFromHeader extracts the token from an Authorization header, returning
+// an empty string when the header doesn't carry one.
+func TokenFromHeader(h http.Header) string {
+	auth := h.Get("Authorization")
+	if !strings.HasPrefix(auth, tokenScheme) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, tokenScheme)
+}
+
+// Authenticate returns the response of git-lfs-authenticate: the endpoint of
+// the repository, configured by the "lfs:url" setting, and the header that
+// authenticates the user.
+func Authenticate(user, repo, operation string) (*Authentication, error) {
+	baseURL, err := config.GetString("lfs:url")
+	if err != nil || baseURL == "" {
+		return nil, errors.New("git lfs is disabled, please configure lfs:url")
+	}
+	token, err := NewToken(user, repo, operation, time.Now().Add(tokenExpiration))
+	if err != nil {
+		return nil, err
+	}
+	return &Authentication{
+		Href:      Href(baseURL, repo),
+		Header:    map[string]string{"Authorization": AuthorizationHeader(token)},
+		ExpiresIn: int(tokenExpiration.Seconds()),
+	}, nil
+}
+
+// repositoryDir returns the directory of the objects of the repository. The
+// slash of namespaced names is escaped, and repository names can't contain
+// "%", so each repository has its own directory.
+func repositoryDir(repo string) (string, error) {
+	location, err := location()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(location, url.PathEscape(repo)), nil
+}
+
+func objectPath(repo, oid string) (string, error) {
+	if !oidRegexp.MatchString(oid) {
+		return "", ErrInvalidObject
+	}
+	dir, err := repositoryDir(repo)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "objects", oid[0:2], oid[2:4], oid), nil
+}
+
+// Stat returns the size of the object, or ErrObjectNotFound.
+func Stat(repo, oid string) (int64, error) {
+	p, err := objectPath(repo, oid)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Open opens the object for reading. The caller must close it.
+func Open(repo, oid string) (*os.File, error) {
+	p, err := objectPath(repo, oid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+// Store reads the object from r and saves it, after checking that the
+// content matches both the oid and the size. Objects are written to a
+// temporary file first, so concurrent downloads never see partial objects.
+func Store(repo, oid string, size int64, r io.Reader) error {
+	p, err := objectPath(repo, oid)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(p), oid+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, size+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size || hex.EncodeToString(hash.Sum(nil)) != oid {
+		return ErrObjectMismatch
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Batch answers a request of the batch API. The actions point to the LFS
+// endpoint of the repository in the given base URL, and carry the given
+// header.
+func Batch(repo, baseURL string, header map[string]string, req BatchRequest) (*BatchResponse, error) {
+	if req.Operation != Download && req.Operation != Upload {
+		return nil, fmt.Errorf("invalid operation %q", req.Operation)
+	}
+	if _, err := location(); err != nil {
+		return nil, err
+	}
+	href := Href(baseURL, repo)
+	resp := BatchResponse{Transfer: "basic", Objects: make([]BatchObject, len(req.Objects))}
+	for i, p := range req.Objects {
+		resp.Objects[i] = BatchObject{Pointer: p, Authenticated: true}
+		if !oidRegexp.MatchString(p.Oid) || p.Size < 0 {
+			resp.Objects[i].Error = &ObjectError{Code: 422, Message: ErrInvalidObject.Error()}
+			continue
+		}
+		size, err := Stat(repo, p.Oid)
+		if err != nil && err != ErrObjectNotFound {
+			return nil, err
+		}
+		action := Action{
+			Href:      href + "/objects/" + p.Oid,
+			Header:    header,
+			ExpiresIn: int(tokenExpiration.Seconds()),
+		}
+		switch {
+		case req.Operation == Upload && err == ErrObjectNotFound:
+			resp.Objects[i].Actions = map[string]Action{Upload: action}
+		case req.Operation == Download && err == ErrObjectNotFound:
+			resp.Objects[i].Error = &ObjectError{Code: 404, Message: ErrObjectNotFound.Error()}
+		case req.Operation == Download:
+			resp.Objects[i].Size = size
+			resp.Objects[i].Actions = map[string]Action{Download: action}
+		}
+	}
+	return &resp, nil
+}
+
+// RepositoryUsage returns the number of objects and the total size of the
+// objects stored for the repository.
+func RepositoryUsage(repo string) (Usage, error) {
+	var usage Usage
+	dir, err := repositoryDir(repo)
+	if err != nil {
+		return usage, err
+	}
+	err = filepath.Walk(path.Join(dir, "objects"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && oidRegexp.MatchString(info.Name()) {
+			usage.Objects++
+			usage.Size += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
+
+func init() {
+	repository.OnRemove(removeRepository)
+	repository.OnRename(renameRepository)
+}
+
+// removeRepository removes the objects of a repository that is being
+// removed, when Git LFS is enabled.
+func removeRepository(repo string) error {
+	if !Enabled() {
+		return nil
+	}
+	return Remove(repo)
+}
+
+// renameRepository moves the objects of a repository that was renamed, when
+// Git LFS is enabled.
+func renameRepository(oldName, newName string) error {
+	if !Enabled() {
+		return nil
+	}
+	return Rename(oldName, newName)
+}
+
+// Remove removes all the objects of the repository.
+func Remove(repo string) error {
+	dir, err := repositoryDir(repo)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Rename moves the objects of a repository that has been renamed.
+func Rename(oldName, newName string) error {
+	oldDir, err := repositoryDir(oldName)
+	if err != nil {
+		return err
+	}
+	newDir, err := repositoryDir(newName)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	return os.Rename(oldDir, newDir)
+}
@@ -0,0 +1,260 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	location string
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpTest(c *check.C) {
+	var err error
+	s.location, err = ioutil.TempDir("", "gandalf_lfs")
+	c.Assert(err, check.IsNil)
+	config.Set("lfs:location", s.location)
+	config.Set("lfs:secret", "much secret")
+	config.Set("lfs:url", "https://gandalf.example.com/")
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.RemoveAll(s.location)
+	config.Unset("lfs:location")
+	config.Unset("lfs:secret")
+	config.Unset("lfs:url")
+}
+
+func oidOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *S) TestEnabled(c *check.C) {
+	c.Assert(Enabled(), check.Equals, true)
+	config.Unset("lfs:secret")
+	c.Assert(Enabled(), check.Equals, false)
+}
+
+func (s *S) TestToken(c *check.C) {
+	token, err := NewToken("doge", "myrepo", Download, time.Now().Add(time.Minute))
+	c.Assert(err, check.IsNil)
+	user, err := VerifyToken(token, "myrepo", Download)
+	c.Assert(err, check.IsNil)
+	c.Assert(user, check.Equals, "doge")
+	_, err = VerifyToken(token, "myrepo", Upload)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+	_, err = VerifyToken(token, "otherrepo", Download)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+}
+
+func (s *S) TestUploadTokenAllowsDownload(c *check.C) {
+	token, err := NewToken("doge", "myrepo", Upload, time.Now().Add(time.Minute))
+	c.Assert(err, check.IsNil)
+	user, err := VerifyToken(token, "myrepo", Download)
+	c.Assert(err, check.IsNil)
+	c.Assert(user, check.Equals, "doge")
+}
+
+func (s *S) TestVerifyTokenExpired(c *check.C) {
+	token, err := NewToken("doge", "myrepo", Download, time.Now().Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	_, err = VerifyToken(token, "myrepo", Download)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+}
+
+func (s *S) TestVerifyTokenTampered(c *check.C) {
+	token, err := NewToken("doge", "myrepo", Download, time.Now().Add(time.Minute))
+	c.Assert(err, check.IsNil)
+	config.Set("lfs:secret", "other secret")
+	_, err = VerifyToken(token, "myrepo", Download)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+	for _, t := range []string{"", "wow", "wow.much", strings.Replace(token, ".", "", 1)} {
+		_, err = VerifyToken(t, "myrepo", Download)
+		c.Check(err, check.Equals, ErrInvalidToken)
+	}
+}
+
+func (s *S) TestTokenFromHeader(c *check.C) {
+	h := http.Header{}
+	c.Assert(TokenFromHeader(h), check.Equals, "")
+	h.Set("Authorization", "Basic d293Om11Y2g=")
+	c.Assert(TokenFromHeader(h), check.Equals, "")
+	h.Set("Authorization", AuthorizationHeader("much.token"))
+	c.Assert(TokenFromHeader(h), check.Equals, "much.token")
+}
+
+func (s *S) TestAuthenticate(c *check.C) {
+	auth, err := Authenticate("doge", "ns/myrepo", Upload)
+	c.Assert(err, check.IsNil)
+	c.Assert(auth.Href, check.Equals, "https://gandalf.example.com/repository/ns/myrepo/info/lfs")
+	c.Assert(auth.ExpiresIn, check.Equals, 3600)
+	token := TokenFromHeader(http.Header{"Authorization": {auth.Header["Authorization"]}})
+	user, err := VerifyToken(token, "ns/myrepo", Upload)
+	c.Assert(err, check.IsNil)
+	c.Assert(user, check.Equals, "doge")
+}
+
+func (s *S) TestAuthenticateRequiresURL(c *check.C) {
+	config.Unset("lfs:url")
+	_, err := Authenticate("doge", "myrepo", Upload)
+	c.Assert(err, check.ErrorMatches, "git lfs is disabled, please configure lfs:url")
+}
+
+func (s *S) TestStoreAndOpen(c *check.C) {
+	oid := oidOf("much content")
+	err := Store("myrepo", oid, 12, strings.NewReader("much content"))
+	c.Assert(err, check.IsNil)
+	size, err := Stat("myrepo", oid)
+	c.Assert(err, check.IsNil)
+	c.Assert(size, check.Equals, int64(12))
+	f, err := Open("myrepo", oid)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "much content")
+	_, err = Open("otherrepo", oid)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+}
+
+func (s *S) TestStoreMismatch(c *check.C) {
+	oid := oidOf("much content")
+	err := Store("myrepo", oid, 12, strings.NewReader("wow content!"))
+	c.Assert(err, check.Equals, ErrObjectMismatch)
+	err = Store("myrepo", oid, 11, strings.NewReader("much content"))
+	c.Assert(err, check.Equals, ErrObjectMismatch)
+	err = Store("myrepo", oid, 13, strings.NewReader("much content"))
+	c.Assert(err, check.Equals, ErrObjectMismatch)
+	_, err = Stat("myrepo", oid)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+	usage, err := RepositoryUsage("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.Equals, Usage{})
+}
+
+func (s *S) TestStoreInvalidOid(c *check.C) {
+	err := Store("myrepo", "../../../etc/passwd", 4, strings.NewReader("root"))
+	c.Assert(err, check.Equals, ErrInvalidObject)
+}
+
+func (s *S) TestBatchUpload(c *check.C) {
+	existing := oidOf("much content")
+	c.Assert(Store("myrepo", existing, 12, strings.NewReader("much content")), check.IsNil)
+	missing := oidOf("wow")
+	header := map[string]string{"Authorization": "RemoteAuth much.token"}
+	req := BatchRequest{Operation: Upload, Objects: []Pointer{{existing, 12}, {missing, 3}, {"wow", 3}}}
+	resp, err := Batch("myrepo", "http://localhost:8000", header, req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Transfer, check.Equals, "basic")
+	c.Assert(resp.Objects, check.DeepEquals, []BatchObject{
+		{Pointer: Pointer{existing, 12}, Authenticated: true},
+		{Pointer: Pointer{missing, 3}, Authenticated: true, Actions: map[string]Action{
+			Upload: {Href: "http://localhost:8000/repository/myrepo/info/lfs/objects/" + missing, Header: header, ExpiresIn: 3600},
+		}},
+		{Pointer: Pointer{"wow", 3}, Authenticated: true, Error: &ObjectError{Code: 422, Message: "invalid lfs object id"}},
+	})
+}
+
+func (s *S) TestBatchDownload(c *check.C) {
+	existing := oidOf("much content")
+	c.Assert(Store("myrepo", existing, 12, strings.NewReader("much content")), check.IsNil)
+	missing := oidOf("wow")
+	req := BatchRequest{Operation: Download, Objects: []Pointer{{existing, 12}, {missing, 3}}}
+	resp, err := Batch("myrepo", "http://localhost:8000", nil, req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Objects, check.DeepEquals, []BatchObject{
+		{Pointer: Pointer{existing, 12}, Authenticated: true, Actions: map[string]Action{
+			Download: {Href: "http://localhost:8000/repository/myrepo/info/lfs/objects/" + existing, ExpiresIn: 3600},
+		}},
+		{Pointer: Pointer{missing, 3}, Authenticated: true, Error: &ObjectError{Code: 404, Message: "lfs object not found"}},
+	})
+}
+
+func (s *S) TestBatchInvalidOperation(c *check.C) {
+	_, err := Batch("myrepo", "http://localhost:8000", nil, BatchRequest{Operation: "delete"})
+	c.Assert(err, check.ErrorMatches, `invalid operation "delete"`)
+}
+
+func (s *S) TestRepositoryUsage(c *check.C) {
+	usage, err := RepositoryUsage("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.Equals, Usage{})
+	for _, content := range []string{"much content", "wow"} {
+		err = Store("myrepo", oidOf(content), int64(len(content)), strings.NewReader(content))
+		c.Assert(err, check.IsNil)
+	}
+	err = Store("otherrepo", oidOf("doge"), 4, strings.NewReader("doge"))
+	c.Assert(err, check.IsNil)
+	usage, err = RepositoryUsage("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.Equals, Usage{Objects: 2, Size: 15})
+}
+
+func (s *S) TestRenameAndRemove(c *check.C) {
+	oid := oidOf("much content")
+	c.Assert(Store("myrepo", oid, 12, strings.NewReader("much content")), check.IsNil)
+	err := Rename("myrepo", "ns/newrepo")
+	c.Assert(err, check.IsNil)
+	_, err = Stat("myrepo", oid)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+	_, err = Stat("ns/newrepo", oid)
+	c.Assert(err, check.IsNil)
+	c.Assert(Rename("nothing", "stillnothing"), check.IsNil)
+	err = Remove("ns/newrepo")
+	c.Assert(err, check.IsNil)
+	_, err = Stat("ns/newrepo", oid)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+}
+
+func (s *S) TestNamespacedRepositoriesDoNotShareObjects(c *check.C) {
+	oid := oidOf("much content")
+	c.Assert(Store("foo", oid, 12, strings.NewReader("much content")), check.IsNil)
+	other := oidOf("wow")
+	c.Assert(Store("foo/objects", other, 3, strings.NewReader("wow")), check.IsNil)
+	usage, err := RepositoryUsage("foo")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.Equals, Usage{Objects: 1, Size: 12})
+	_, err = Stat("foo", other)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+	err = Remove("foo")
+	c.Assert(err, check.IsNil)
+	_, err = Stat("foo", oid)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+	size, err := Stat("foo/objects", other)
+	c.Assert(err, check.IsNil)
+	c.Assert(size, check.Equals, int64(3))
+}
+
+func (s *S) TestRepositoryListeners(c *check.C) {
+	oid := oidOf("much content")
+	c.Assert(Store("myrepo", oid, 12, strings.NewReader("much content")), check.IsNil)
+	err := renameRepository("myrepo", "newrepo")
+	c.Assert(err, check.IsNil)
+	_, err = Stat("newrepo", oid)
+	c.Assert(err, check.IsNil)
+	err = removeRepository("newrepo")
+	c.Assert(err, check.IsNil)
+	_, err = Stat("newrepo", oid)
+	c.Assert(err, check.Equals, ErrObjectNotFound)
+	config.Unset("lfs:secret")
+	c.Assert(removeRepository("newrepo"), check.IsNil)
+	c.Assert(renameRepository("newrepo", "myrepo"), check.IsNil)
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mirror keeps pull mirrors in sync with their upstreams.
+//
+// The worker started by Run looks for mirrors whose next synchronization is
+// due every minute, fetching their upstreams one at a time and updating
+// their code search index. It also retries the pending pushes to push
+// mirrors.
+package mirror
+
+import (
+	"time"
+
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/search"
+	"github.com/tsuru/tsuru/log"
+)
+
+const pollInterval = time.Minute
+
+// Sync synchronizes the mirror with its upstream and updates its code search
+// index, returning the status of the mirror.
+func Sync(name string) (*repository.Mirror, error) {
+	m, err := repository.SyncMirror(name)
+	if err == nil && search.Enabled() {
+		if err := search.Update(name); err != nil {
+			log.Errorf("mirror.Sync: could not index repository %q: %s", name, err)
+		}
+	}
+	return m, err
+}
+
+// SyncPending synchronizes all the mirrors whose next synchronization is
+// due. Failures are recorded in the status of each mirror.
+func SyncPending() error {
+	names, err := repository.PendingMirrors(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := Sync(name); err != nil {
+			log.Errorf("mirror.SyncPending: %s", err)
+		}
+	}
+	return nil
+}
+
+// Push pushes the repository to its pending push mirrors, returning their
+// status.
+func Push(name string) ([]repository.PushMirror, error) {
+	return repository.PushToMirrors(name, false)
+}
+
+// PushPending retries the pushes to the push mirrors whose next retry is
+// due. Failures are recorded in the status of each push mirror.
+func PushPending() error {
+	names, err := repository.PendingPushMirrors(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := Push(name); err != nil {
+			log.Errorf("mirror.PushPending: %s", err)
+		}
+	}
+	return nil
+}
+
+// Run synchronizes the pending mirrors and retries the pending pushes
+// periodically, until the stop channel is closed.
+func Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := SyncPending(); err != nil {
+			log.Errorf("mirror.Run: could not list pending mirrors: %s", err)
+		}
+		if err := PushPending(); err != nil {
+			log.Errorf("mirror.Run: could not list pending push mirrors: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
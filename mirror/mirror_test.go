@@ -0,0 +1,111 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	bareDir string
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "gandalf_mirror_tests")
+	config.Set("git:remotes:allow-file", true)
+	s.bareDir, err = ioutil.TempDir("", "gandalf_mirror_bare")
+	c.Assert(err, check.IsNil)
+	config.Set("git:bare:location", s.bareDir)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	os.RemoveAll(s.bareDir)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.Repository().Database.DropDatabase()
+}
+
+func (s *S) TestSyncPending(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "upstream-work", "README", "will bark")
+	c.Assert(err, check.IsNil)
+	defer cleanUp()
+	cleanUpBare, err := repository.CreateBareClone(s.bareDir, "upstream-work", "upstream")
+	c.Assert(err, check.IsNil)
+	defer cleanUpBare()
+	upstream := "file://" + path.Join(s.bareDir, "upstream.git")
+	_, err = repository.NewMirror("mirrored", []string{"doge"}, nil, false, repository.Mirror{URL: upstream})
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("mirrored")
+	_, err = repository.NewMirror("broken", []string{"doge"}, nil, false, repository.Mirror{URL: "file:///nothing.git"})
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("broken")
+	err = SyncPending()
+	c.Assert(err, check.IsNil)
+	r, err := repository.Get("mirrored")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Mirror.LastSync.IsZero(), check.Equals, false)
+	c.Assert(r.Mirror.LastError, check.Equals, "")
+	branches, err := repository.GetBranches("mirrored")
+	c.Assert(err, check.IsNil)
+	c.Assert(branches, check.HasLen, 1)
+	c.Assert(branches[0].Name, check.Equals, "master")
+	r, err = repository.Get("broken")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Mirror.LastError, check.Not(check.Equals), "")
+}
+
+func (s *S) TestSyncWhenRepositoryDoesNotExist(c *check.C) {
+	m, err := Sync("nothing")
+	c.Assert(err, check.Equals, repository.ErrRepositoryNotFound)
+	c.Assert(m, check.IsNil)
+}
+
+func (s *S) TestPushPending(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "pushed-work", "README", "will bark")
+	c.Assert(err, check.IsNil)
+	defer cleanUp()
+	cleanUpBare, err := repository.CreateBareClone(s.bareDir, "pushed-work", "pushed")
+	c.Assert(err, check.IsNil)
+	defer cleanUpBare()
+	cleanUpRemote, err := repository.CreateEmptyTestBareRepository(s.bareDir, "remote")
+	c.Assert(err, check.IsNil)
+	defer cleanUpRemote()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(repository.Repository{Name: "pushed"})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("pushed")
+	_, err = repository.AddPushMirror("pushed", repository.PushMirror{Name: "backup", URL: "file://" + path.Join(s.bareDir, "remote.git")})
+	c.Assert(err, check.IsNil)
+	err = PushPending()
+	c.Assert(err, check.IsNil)
+	mirrors, err := repository.GetPushMirrors("pushed")
+	c.Assert(err, check.IsNil)
+	c.Assert(mirrors[0].Pending, check.Equals, false)
+	c.Assert(mirrors[0].LastError, check.Equals, "")
+	cmd := exec.Command("git", "for-each-ref", "--format=%(refname)")
+	cmd.Dir = path.Join(s.bareDir, "remote.git")
+	out, err := cmd.Output()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(out), check.Equals, "refs/heads/master\n")
+}
@@ -4,8 +4,8 @@
 # Use of this source code is governed by a BSD-style
 # license that can be found in the LICENSE file.
 
-# This script is used to build components from gandalf server (webserver and
-# git wrapper). It's based on misc/build-server.bash from tsuru repository.
+# This script is used to build components from gandalf server (webserver, git
+# wrapper and admin command). It's based on misc/build-server.bash from tsuru repository.
 
 destination_dir="dist-server"
 
@@ -22,3 +22,4 @@ echo "ok"
 
 build_and_package bin
 build_and_package webserver
+build_and_package admin
@@ -5,6 +5,7 @@
 package multipartzip
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"io"
@@ -38,6 +39,31 @@ func CreateZipBuffer(files []File) (*bytes.Buffer, error) {
 	return buf, nil
 }
 
+func CreateTarBuffer(files []File) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, file := range files {
+		err := w.WriteHeader(&tar.Header{
+			Name:     file.Name,
+			Mode:     0644,
+			Size:     int64(len(file.Body)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write([]byte(file.Body))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func StreamWriteMultipartForm(params map[string]string, fileField, path, boundary string, pw *io.PipeWriter, buf *bytes.Buffer) {
 	defer pw.Close()
 	mpw := multipart.NewWriter(pw)
@@ -5,13 +5,22 @@
 package multipartzip
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 
+	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/fs"
 )
 
@@ -40,43 +49,306 @@ func FileField(f *multipart.Form, n string) (*multipart.FileHeader, error) {
 	return v[0], nil
 }
 
-func CopyZipFile(f *zip.File, d, p string) error {
-	if p != "" {
-		dirname := path.Dir(p)
-		if dirname != "." {
-			err := os.MkdirAll(path.Join(d, dirname), 0755)
-			if err != nil {
-				return err
-			}
+const (
+	defaultMaxArchiveSize    = 1 << 30
+	defaultMaxArchiveEntries = 100000
+
+	// maxLinkTarget is the size of the longest symbolic link target.
+	maxLinkTarget = 4096
+)
+
+var (
+	ErrUnknownArchive  = errors.New("unknown archive format, expected zip, tar, tar.gz or tar.zst")
+	ErrArchiveTooLarge = errors.New("archive exceeds the maximum extracted size")
+	ErrTooManyEntries  = errors.New("archive exceeds the maximum number of entries")
+)
+
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte("\x1f\x8b")
+	zstdMagic     = []byte("\x28\xb5\x2f\xfd")
+	tarMagic      = []byte("ustar")
+)
+
+// tarMagicOffset is the offset of the magic field in a tar header.
+const tarMagicOffset = 257
+
+// InvalidEntryError is returned when an entry of an archive would be
+// extracted outside of the destination directory.
+type InvalidEntryError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidEntryError) Error() string {
+	return fmt.Sprintf("invalid archive entry %q: %s", e.Name, e.Reason)
+}
+
+// extractor extracts entries of an archive into dir, keeping track of the
+// number of entries and of the amount of data extracted so far.
+type extractor struct {
+	dir        string
+	maxSize    int64
+	maxEntries int
+	size       int64
+	entries    int
+}
+
+// newExtractor returns an extractor for the directory d, using the limits
+// defined by the settings api:request:maxArchiveSize and
+// api:request:maxArchiveEntries.
+func newExtractor(d string) *extractor {
+	e := extractor{dir: d, maxSize: defaultMaxArchiveSize, maxEntries: defaultMaxArchiveEntries}
+	if size, err := config.GetInt("api:request:maxArchiveSize"); err == nil && size > 0 {
+		e.maxSize = int64(size)
+	}
+	if entries, err := config.GetInt("api:request:maxArchiveEntries"); err == nil && entries > 0 {
+		e.maxEntries = entries
+	}
+	return &e
+}
+
+// target validates the name of an entry, returning the cleaned path of the
+// entry, relative to the destination directory. An empty path means that
+// the entry should be skipped.
+func (e *extractor) target(name string) (string, error) {
+	e.entries++
+	if e.entries > e.maxEntries {
+		return "", ErrTooManyEntries
+	}
+	if name == "" {
+		return "", nil
+	}
+	if path.IsAbs(name) {
+		return "", &InvalidEntryError{Name: name, Reason: "absolute paths are not allowed"}
+	}
+	p := path.Clean(name)
+	if p == "." {
+		return "", nil
+	}
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", &InvalidEntryError{Name: name, Reason: "path escapes the destination directory"}
+	}
+	parts := strings.Split(p, "/")
+	if strings.EqualFold(parts[0], ".git") {
+		return "", &InvalidEntryError{Name: name, Reason: "the .git directory is reserved"}
+	}
+	current := e.dir
+	for _, part := range parts[:len(parts)-1] {
+		current = path.Join(current, part)
+		stat, err := os.Lstat(current)
+		if err != nil {
+			break
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return "", &InvalidEntryError{Name: name, Reason: "path traverses a symbolic link"}
+		}
+	}
+	return p, nil
+}
+
+// copy copies the content of r to w, failing when the total amount of data
+// extracted from the archive exceeds the limit.
+func (e *extractor) copy(w io.Writer, r io.Reader) error {
+	n, err := io.Copy(w, io.LimitReader(r, e.maxSize-e.size+1))
+	e.size += n
+	if e.size > e.maxSize {
+		return ErrArchiveTooLarge
+	}
+	return err
+}
+
+// fileMode returns the permissions used when extracting a regular file:
+// files with any executable bit become executable by everyone.
+func fileMode(m os.FileMode) os.FileMode {
+	if m&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// writeFile writes the content of r to the path p, replacing whatever is in
+// p unless it is a directory.
+func (e *extractor) writeFile(p string, mode os.FileMode, r io.Reader) error {
+	if err := e.mkdirParent(p); err != nil {
+		return err
+	}
+	p = path.Join(e.dir, p)
+	stat, err := os.Lstat(p)
+	if err == nil && stat.IsDir() {
+		return nil
+	}
+	if err == nil && stat.Mode()&os.ModeSymlink != 0 {
+		if err = fs.Filesystem().Remove(p); err != nil {
+			return err
+		}
+	}
+	file, err := fs.Filesystem().OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = e.copy(file, r); err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+// writeSymlink creates the symbolic link p pointing to target, replacing any
+// file in p. The target must be a relative path that stays inside the
+// destination directory.
+func (e *extractor) writeSymlink(p, target string) error {
+	if path.IsAbs(target) {
+		return &InvalidEntryError{Name: p, Reason: "symbolic link points to an absolute path"}
+	}
+	resolved := path.Clean(path.Join(path.Dir(p), target))
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return &InvalidEntryError{Name: p, Reason: "symbolic link points outside the destination directory"}
+	}
+	if err := e.mkdirParent(p); err != nil {
+		return err
+	}
+	p = path.Join(e.dir, p)
+	if stat, err := os.Lstat(p); err == nil {
+		if stat.IsDir() {
+			return fmt.Errorf("cannot replace directory %q with a symbolic link", p)
+		}
+		if err = fs.Filesystem().Remove(p); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, p)
+}
+
+func (e *extractor) mkdirParent(p string) error {
+	dirname := path.Dir(p)
+	if dirname == "." {
+		return nil
+	}
+	return os.MkdirAll(path.Join(e.dir, dirname), 0755)
+}
+
+func (e *extractor) copyZipFile(f *zip.File, name string) error {
+	p, err := e.target(name)
+	if err != nil || p == "" || f.FileInfo().IsDir() {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if f.Mode()&os.ModeSymlink != 0 {
+		var target bytes.Buffer
+		if _, err = io.Copy(&target, io.LimitReader(rc, maxLinkTarget)); err != nil {
+			return err
+		}
+		return e.writeSymlink(p, target.String())
+	}
+	return e.writeFile(p, fileMode(f.Mode()), rc)
+}
+
+func (e *extractor) copyTarEntry(r *tar.Reader, h *tar.Header, name string) error {
+	p, err := e.target(name)
+	if err != nil || p == "" {
+		return err
+	}
+	switch h.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(path.Join(e.dir, p), 0755)
+	case tar.TypeSymlink:
+		return e.writeSymlink(p, h.Linkname)
+	case tar.TypeReg, tar.TypeRegA:
+		return e.writeFile(p, fileMode(os.FileMode(h.Mode)), r)
+	}
+	return nil
+}
+
+func (e *extractor) extractZip(r *zip.Reader) error {
+	if len(r.File) > e.maxEntries {
+		return ErrTooManyEntries
+	}
+	var size uint64
+	for _, f := range r.File {
+		size += f.UncompressedSize64
+	}
+	if size > uint64(e.maxSize) {
+		return ErrArchiveTooLarge
+	}
+	for _, f := range r.File {
+		if err := e.copyZipFile(f, f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
 		}
-		rc, err := f.Open()
-		defer rc.Close()
 		if err != nil {
 			return err
 		}
-		path := path.Join(d, p)
-		stat, err := os.Stat(path)
-		if err != nil || !stat.IsDir() {
-			file, err := fs.Filesystem().Create(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(file, rc)
-			if err != nil {
-				return err
-			}
+		if err = e.copyTarEntry(tr, h, h.Name); err != nil {
+			return err
 		}
 	}
+}
+
+// extractZstdTar decompresses r using the zstd command line tool, extracting
+// the resulting tar stream.
+func (e *extractor) extractZstdTar(r io.Reader) error {
+	zstdPath, err := exec.LookPath("zstd")
+	if err != nil {
+		return fmt.Errorf("cannot extract tar.zst archive: %s", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(zstdPath, "-d", "-c", "-q")
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	if err = e.extractTar(out); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	io.Copy(ioutil.Discard, out)
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("cannot decompress tar.zst archive: %s (%s)", err, bytes.TrimSpace(stderr.Bytes()))
+	}
 	return nil
 }
 
+// CopyZipFile extracts the zip entry f to the path p inside the directory d.
+// Regular files keep their executable bit and symbolic links are recreated.
+func CopyZipFile(f *zip.File, d, p string) error {
+	return newExtractor(d).copyZipFile(f, p)
+}
+
+// CopyTarEntry extracts the current entry of the tar reader to the path p
+// inside the directory d. Regular files keep their executable bit and
+// symbolic links are recreated; other kinds of entries are ignored.
+func CopyTarEntry(r *tar.Reader, h *tar.Header, d, p string) error {
+	return newExtractor(d).copyTarEntry(r, h, p)
+}
+
 func ExtractZip(f *multipart.FileHeader, d string) error {
 	file, err := f.Open()
-	defer file.Close()
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	size, err := file.Seek(0, 2)
 	if err != nil {
 		return err
@@ -85,11 +357,45 @@ func ExtractZip(f *multipart.FileHeader, d string) error {
 	if err != nil {
 		return err
 	}
-	for _, f := range r.File {
-		err := CopyZipFile(f, d, f.Name)
+	return newExtractor(d).extractZip(r)
+}
+
+// ExtractTar extracts the uncompressed tar stream r into the directory d.
+func ExtractTar(r io.Reader, d string) error {
+	return newExtractor(d).extractTar(r)
+}
+
+// ExtractArchive extracts the uploaded archive into the directory d. The
+// format is detected by the content of the file, not by its name, and may
+// be zip, tar, tar.gz or tar.zst.
+//
+// Entries with absolute paths, entries that would be written outside of d
+// and symbolic links pointing outside of d are rejected with an
+// InvalidEntryError. The number of entries and the total size of the
+// extracted files are limited by the settings api:request:maxArchiveEntries
+// and api:request:maxArchiveSize.
+func ExtractArchive(f *multipart.FileHeader, d string) error {
+	file, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, tarMagicOffset+len(tarMagic))
+	header, _ := r.Peek(tarMagicOffset + len(tarMagic))
+	switch {
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, emptyZipMagic):
+		return ExtractZip(f, d)
+	case bytes.HasPrefix(header, gzipMagic):
+		gz, err := gzip.NewReader(r)
 		if err != nil {
 			return err
 		}
+		defer gz.Close()
+		return ExtractTar(gz, d)
+	case bytes.HasPrefix(header, zstdMagic):
+		return newExtractor(d).extractZstdTar(r)
+	case len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic):
+		return ExtractTar(r, d)
 	}
-	return nil
+	return ErrUnknownArchive
 }
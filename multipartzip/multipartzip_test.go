@@ -5,15 +5,20 @@
 package multipartzip
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 	"testing"
 
+	"github.com/tsuru/config"
 	"gopkg.in/check.v1"
 )
 
@@ -36,8 +41,8 @@ func (s *S) TestCopyZipFile(c *check.C) {
 		{"much.txt", "Much mucho"},
 		{"WOW/WOW.WOW1", "WOW\nWOW"},
 		{"WOW/WOW.WOW2", "WOW\nWOW"},
-		{"/usr/WOW/WOW.WOW3", "WOW\nWOW"},
-		{"/usr/WOW/WOW.WOW4", "WOW\nWOW"},
+		{"usr/WOW/WOW.WOW3", "WOW\nWOW"},
+		{"usr/WOW/WOW.WOW4", "WOW\nWOW"},
 	}
 	buf, err := CreateZipBuffer(files)
 	c.Assert(err, check.IsNil)
@@ -100,8 +105,8 @@ func (s *S) TestExtractZip(c *check.C) {
 		{"much.txt", "Much mucho"},
 		{"WOW/WOW.WOW1", "WOW\nWOW"},
 		{"WOW/WOW.WOW2", "WOW\nWOW"},
-		{"/usr/WOW/WOW.WOW3", "WOW\nWOW"},
-		{"/usr/WOW/WOW.WOW4", "WOW\nWOW"},
+		{"usr/WOW/WOW.WOW3", "WOW\nWOW"},
+		{"usr/WOW/WOW.WOW4", "WOW\nWOW"},
 	}
 	buf, err := CreateZipBuffer(files)
 	c.Assert(err, check.IsNil)
@@ -227,3 +232,276 @@ func (s *S) TestFileFieldWhenFieldEmpty(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(fs, check.Equals, int64(0))
 }
+
+func archiveFormFile(c *check.C, buf *bytes.Buffer) *multipart.FileHeader {
+	reader, writer := io.Pipe()
+	go StreamWriteMultipartForm(map[string]string{}, "zipfile", "upload.bin", "muchBOUNDARY", writer, buf)
+	form, err := multipart.NewReader(reader, "muchBOUNDARY").ReadForm(0)
+	c.Assert(err, check.IsNil)
+	return form.File["zipfile"][0]
+}
+
+func createSpecialTar(c *check.C) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "bin/", Mode: 0755, Typeflag: tar.TypeDir}), check.IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "bin/run", Mode: 0700, Size: 10, Typeflag: tar.TypeReg}), check.IsNil)
+	_, err := w.Write([]byte("#!/bin/sh\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "README", Mode: 0600, Size: 4, Typeflag: tar.TypeReg}), check.IsNil)
+	_, err = w.Write([]byte("wow!"))
+	c.Assert(err, check.IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "run", Linkname: "bin/run", Typeflag: tar.TypeSymlink}), check.IsNil)
+	c.Assert(w.Close(), check.IsNil)
+	return buf
+}
+
+func checkSpecialFiles(c *check.C, dir string) {
+	stat, err := os.Lstat(path.Join(dir, "bin/run"))
+	c.Assert(err, check.IsNil)
+	c.Assert(stat.Mode().Perm(), check.Equals, os.FileMode(0755))
+	stat, err = os.Lstat(path.Join(dir, "README"))
+	c.Assert(err, check.IsNil)
+	c.Assert(stat.Mode().Perm(), check.Equals, os.FileMode(0644))
+	target, err := os.Readlink(path.Join(dir, "run"))
+	c.Assert(err, check.IsNil)
+	c.Assert(target, check.Equals, "bin/run")
+}
+
+func (s *S) TestCopyZipFileKeepsModeAndSymlinks(c *check.C) {
+	tempDir, err := ioutil.TempDir("", "TestCopyZipFileDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	entries := []struct {
+		name, body string
+		mode       os.FileMode
+	}{
+		{"bin/run", "#!/bin/sh\n", 0700},
+		{"README", "wow!", 0600},
+		{"run", "bin/run", os.ModeSymlink | 0777},
+	}
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name}
+		h.SetMode(e.mode)
+		f, err := w.CreateHeader(h)
+		c.Assert(err, check.IsNil)
+		_, err = f.Write([]byte(e.body))
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(w.Close(), check.IsNil)
+	err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+	c.Assert(err, check.IsNil)
+	checkSpecialFiles(c, tempDir)
+}
+
+func (s *S) TestExtractArchiveTar(c *check.C) {
+	files := []File{
+		{"doge.txt", "Much doge"},
+		{"WOW/WOW.WOW1", "WOW\nWOW"},
+	}
+	buf, err := CreateTarBuffer(files)
+	c.Assert(err, check.IsNil)
+	tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+	c.Assert(err, check.IsNil)
+	for _, file := range files {
+		body, err := ioutil.ReadFile(path.Join(tempDir, file.Name))
+		c.Assert(err, check.IsNil)
+		c.Assert(string(body), check.Equals, file.Body)
+	}
+}
+
+func (s *S) TestExtractArchiveTarGz(c *check.C) {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	_, err := io.Copy(gz, createSpecialTar(c))
+	c.Assert(err, check.IsNil)
+	c.Assert(gz.Close(), check.IsNil)
+	tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+	c.Assert(err, check.IsNil)
+	checkSpecialFiles(c, tempDir)
+	body, err := ioutil.ReadFile(path.Join(tempDir, "README"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, "wow!")
+}
+
+func (s *S) TestExtractArchiveTarZst(c *check.C) {
+	zstdPath, err := exec.LookPath("zstd")
+	if err != nil {
+		c.Skip("zstd is not installed")
+	}
+	cmd := exec.Command(zstdPath, "-q", "-c")
+	cmd.Stdin = createSpecialTar(c)
+	out, err := cmd.Output()
+	c.Assert(err, check.IsNil)
+	tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	err = ExtractArchive(archiveFormFile(c, bytes.NewBuffer(out)), tempDir)
+	c.Assert(err, check.IsNil)
+	checkSpecialFiles(c, tempDir)
+}
+
+func (s *S) TestExtractArchiveReplacesFileWithSymlink(c *check.C) {
+	tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	err = ioutil.WriteFile(path.Join(tempDir, "run"), []byte("old"), 0644)
+	c.Assert(err, check.IsNil)
+	err = ExtractArchive(archiveFormFile(c, createSpecialTar(c)), tempDir)
+	c.Assert(err, check.IsNil)
+	checkSpecialFiles(c, tempDir)
+}
+
+func (s *S) TestExtractArchiveRejectsSymlinkEscapes(c *check.C) {
+	var tests = []struct {
+		headers []tar.Header
+		reason  string
+	}{
+		{
+			[]tar.Header{{Name: "../evil", Mode: 0644, Typeflag: tar.TypeReg}},
+			"path escapes the destination directory",
+		},
+		{
+			[]tar.Header{{Name: "etc", Linkname: "/etc", Typeflag: tar.TypeSymlink}},
+			"symbolic link points to an absolute path",
+		},
+		{
+			[]tar.Header{{Name: "up/out", Linkname: "../../outside", Typeflag: tar.TypeSymlink}},
+			"symbolic link points outside the destination directory",
+		},
+		{
+			[]tar.Header{
+				{Name: "sub/", Mode: 0755, Typeflag: tar.TypeDir},
+				{Name: "link", Linkname: "sub", Typeflag: tar.TypeSymlink},
+				{Name: "link/evil", Mode: 0644, Typeflag: tar.TypeReg},
+			},
+			"path traverses a symbolic link",
+		},
+	}
+	for _, t := range tests {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		for i := range t.headers {
+			c.Assert(w.WriteHeader(&t.headers[i]), check.IsNil)
+		}
+		c.Assert(w.Close(), check.IsNil)
+		tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+		c.Assert(err, check.IsNil)
+		err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+		os.RemoveAll(tempDir)
+		c.Assert(err, check.FitsTypeOf, &InvalidEntryError{})
+		c.Assert(err.(*InvalidEntryError).Reason, check.Equals, t.reason)
+	}
+}
+
+func (s *S) TestExtractArchiveUnknownFormat(c *check.C) {
+	tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	err = ExtractArchive(archiveFormFile(c, bytes.NewBufferString("just some text")), tempDir)
+	c.Assert(err, check.Equals, ErrUnknownArchive)
+}
+
+type tarEntry struct {
+	name, link, body string
+}
+
+func createTar(c *check.C, entries []tarEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			h = tar.Header{Name: e.name, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		c.Assert(w.WriteHeader(&h), check.IsNil)
+		_, err := w.Write([]byte(e.body))
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(w.Close(), check.IsNil)
+	return buf
+}
+
+func (s *S) TestExtractArchiveRejectsEscapingEntries(c *check.C) {
+	tests := []struct {
+		entries []tarEntry
+		name    string
+		reason  string
+	}{
+		{[]tarEntry{{name: "/etc/passwd", body: "root"}}, "/etc/passwd", "absolute paths are not allowed"},
+		{[]tarEntry{{name: "much/../../passwd", body: "root"}}, "much/../../passwd", "path escapes the destination directory"},
+		{[]tarEntry{{name: ".git/hooks/pre-commit", body: "rm -rf /"}}, ".git/hooks/pre-commit", "the .git directory is reserved"},
+		{[]tarEntry{{name: "etc", link: "/etc"}}, "etc", "symbolic link points to an absolute path"},
+		{[]tarEntry{{name: "much/etc", link: "../../etc"}}, "much/etc", "symbolic link points outside the destination directory"},
+		{[]tarEntry{{name: "wow", link: "much"}, {name: "wow/doge.txt", body: "Much doge"}}, "wow/doge.txt", "path traverses a symbolic link"},
+	}
+	for _, t := range tests {
+		parent, err := ioutil.TempDir("", "TestExtractArchiveDir")
+		c.Assert(err, check.IsNil)
+		tempDir := path.Join(parent, "root")
+		c.Assert(os.Mkdir(tempDir, 0755), check.IsNil)
+		err = ExtractArchive(archiveFormFile(c, createTar(c, t.entries)), tempDir)
+		c.Check(err, check.DeepEquals, &InvalidEntryError{Name: t.name, Reason: t.reason})
+		files, err := ioutil.ReadDir(parent)
+		c.Check(err, check.IsNil)
+		c.Check(files, check.HasLen, 1)
+		os.RemoveAll(parent)
+	}
+}
+
+func (s *S) TestExtractArchiveRejectsAbsoluteZipEntries(c *check.C) {
+	tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempDir)
+	buf, err := CreateZipBuffer([]File{{"/usr/WOW/WOW.WOW3", "WOW\nWOW"}})
+	c.Assert(err, check.IsNil)
+	err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+	c.Assert(err, check.DeepEquals, &InvalidEntryError{Name: "/usr/WOW/WOW.WOW3", Reason: "absolute paths are not allowed"})
+}
+
+func (s *S) TestExtractArchiveMaxEntries(c *check.C) {
+	config.Set("api:request:maxArchiveEntries", 2)
+	defer config.Unset("api:request:maxArchiveEntries")
+	files := []File{{"doge.txt", "Much doge"}, {"much.txt", "Much mucho"}, {"wow.txt", "WOW"}}
+	zipBuf, err := CreateZipBuffer(files)
+	c.Assert(err, check.IsNil)
+	tarBuf, err := CreateTarBuffer(files)
+	c.Assert(err, check.IsNil)
+	for _, buf := range []*bytes.Buffer{zipBuf, tarBuf} {
+		tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+		c.Assert(err, check.IsNil)
+		err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+		c.Check(err, check.Equals, ErrTooManyEntries)
+		os.RemoveAll(tempDir)
+	}
+}
+
+func (s *S) TestExtractArchiveMaxSize(c *check.C) {
+	config.Set("api:request:maxArchiveSize", 1024)
+	defer config.Unset("api:request:maxArchiveSize")
+	files := []File{{"small.txt", "Much doge"}, {"big.txt", strings.Repeat("WOW", 1024)}}
+	zipBuf, err := CreateZipBuffer(files)
+	c.Assert(err, check.IsNil)
+	tarBuf, err := CreateTarBuffer(files)
+	c.Assert(err, check.IsNil)
+	gzBuf := new(bytes.Buffer)
+	gz := gzip.NewWriter(gzBuf)
+	_, err = gz.Write(tarBuf.Bytes())
+	c.Assert(err, check.IsNil)
+	c.Assert(gz.Close(), check.IsNil)
+	for _, buf := range []*bytes.Buffer{zipBuf, tarBuf, gzBuf} {
+		tempDir, err := ioutil.TempDir("", "TestExtractArchiveDir")
+		c.Assert(err, check.IsNil)
+		err = ExtractArchive(archiveFormFile(c, buf), tempDir)
+		c.Check(err, check.Equals, ErrArchiveTooLarge)
+		os.RemoveAll(tempDir)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tsuru/gandalf/fs"
+)
+
+var (
+	ErrEmptyBundle  = errors.New("there is nothing to bundle")
+	ErrInvalidSince = errors.New("since should contain only full commit hashes")
+
+	commitHashRegexp = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+	hookNameRegexp   = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// CreateBundle creates a git bundle with all the refs of the repository and
+// the objects they need, which can be imported as a new repository. When
+// since is not empty, the bundle is incremental: it doesn't include the
+// objects reachable from the given commits, which must be in the repository
+// where the bundle is applied. Commits in since that don't exist in the
+// repository are ignored.
+//
+// The bundle is returned as an open file that was already removed from the
+// filesystem, so it's gone once closed.
+func CreateBundle(repo string, since []string) (*os.File, error) {
+	for _, commit := range since {
+		if !commitHashRegexp.MatchString(commit) {
+			return nil, ErrInvalidSince
+		}
+	}
+	cwd := barePath(repo)
+	if repoExists, err := exists(cwd); err != nil || !repoExists {
+		return nil, ErrRepositoryNotFound
+	}
+	tmp, err := ioutil.TempFile("", "gandalf-bundle-")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	args := []string{"bundle", "create", tmp.Name(), "--ignore-missing", "--all"}
+	for _, commit := range since {
+		args = append(args, "^"+commit)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = cwd
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		out := strings.TrimSpace(stderr.String())
+		if strings.Contains(out, "Refusing to create empty bundle") {
+			return nil, ErrEmptyBundle
+		}
+		return nil, fmt.Errorf("Error when trying to create bundle of repository %s (%s: %s).", repo, err, out)
+	}
+	return os.Open(tmp.Name())
+}
+
+// RestoreBundle recreates the bare repository of r from a bundle created by
+// CreateBundle, or empty when bundle is empty. An existing bare repository
+// is replaced only when replace is true, otherwise ErrRepositoryAlreadyExists
+// is returned.
+func RestoreBundle(r *Repository, bundle string, replace bool) error {
+	if repoExists, err := exists(barePath(r.Name)); err != nil {
+		return err
+	} else if repoExists {
+		if !replace {
+			return ErrRepositoryAlreadyExists
+		}
+		if err = removeBare(r.Name); err != nil {
+			return err
+		}
+	}
+	if err := newBare(r.Name); err != nil {
+		return err
+	}
+	if r.IsPublic {
+		if f, err := fs.Filesystem().Create(barePath(r.Name) + "/git-daemon-export-ok"); err == nil {
+			f.Close()
+		}
+	}
+	if bundle == "" {
+		return nil
+	}
+	if _, err := fetchImport(r.Name, bundle, func(string) {}); err != nil {
+		return err
+	}
+	return setImportedHead(r.Name, bundle)
+}
+
+// ReadHooks returns the hooks installed in the bare repository, by name,
+// ignoring the samples created by git.
+func ReadHooks(name string) (map[string][]byte, error) {
+	dir := path.Join(barePath(name), "hooks")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hooks := map[string][]byte{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".sample") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		hooks[f.Name()] = content
+	}
+	return hooks, nil
+}
+
+// ValidHookName returns whether hook can be used as the name of a hook.
+func ValidHookName(hook string) bool {
+	return hookNameRegexp.MatchString(hook)
+}
+
+// WriteHook installs a hook in the bare repository.
+func WriteHook(name, hook string, content []byte) error {
+	if !ValidHookName(hook) {
+		return fmt.Errorf("invalid hook name %q", hook)
+	}
+	dir := path.Join(barePath(name), "hooks")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	p := path.Join(dir, hook)
+	os.Remove(p)
+	return ioutil.WriteFile(p, content, 0755)
+}
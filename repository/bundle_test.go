@@ -0,0 +1,152 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"gopkg.in/check.v1"
+)
+
+func saveBundle(c *check.C, bundle *os.File) string {
+	defer bundle.Close()
+	f, err := ioutil.TempFile("", "gandalf-test-bundle-")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	_, err = io.Copy(f, bundle)
+	c.Assert(err, check.IsNil)
+	return f.Name()
+}
+
+func (s *S) TestCreateBundle(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	bundle, err := CreateBundle(repo, nil)
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(bundle.Name())
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	path := saveBundle(c, bundle)
+	defer os.Remove(path)
+	cleanUpRestored, err := CreateEmptyTestBareRepository(bare, "gandalf-test-restored")
+	c.Assert(err, check.IsNil)
+	defer cleanUpRestored()
+	_, err = fetchImport("gandalf-test-restored", path, func(string) {})
+	c.Assert(err, check.IsNil)
+	c.Assert(refNames(c, "gandalf-test-restored"), check.Equals, refNames(c, repo))
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	restored, err := resolveCommit(barePath("gandalf-test-restored"), "git", "master")
+	c.Assert(err, check.IsNil)
+	c.Assert(restored, check.Equals, master)
+}
+
+func (s *S) TestCreateBundleIncremental(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	bundle, err := CreateBundle(repo, []string{master})
+	c.Assert(err, check.IsNil)
+	path := saveBundle(c, bundle)
+	defer os.Remove(path)
+	cmd := exec.Command("git", "bundle", "verify", path)
+	cmd.Dir = barePath(repo)
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, check.IsNil, check.Commentf("%s", out))
+	c.Assert(string(out), check.Matches, "(?s).*requires this ref.*")
+	_, err = CreateBundle(repo, []string{master, feature})
+	c.Assert(err, check.Equals, ErrEmptyBundle)
+}
+
+func (s *S) TestCreateBundleIgnoresMissingCommits(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	bundle, err := CreateBundle(repo, []string{"0000000000000000000000000000000000000001"})
+	c.Assert(err, check.IsNil)
+	bundle.Close()
+}
+
+func (s *S) TestCreateBundleWhenEmpty(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	cleanUpEmpty, err := CreateEmptyTestBareRepository(bare, "gandalf-test-empty")
+	c.Assert(err, check.IsNil)
+	defer cleanUpEmpty()
+	_, err = CreateBundle("gandalf-test-empty", nil)
+	c.Assert(err, check.Equals, ErrEmptyBundle)
+}
+
+func (s *S) TestCreateBundleInvalidSince(c *check.C) {
+	_, err := CreateBundle("gandalf-test-nothing", []string{"master"})
+	c.Assert(err, check.Equals, ErrInvalidSince)
+	_, err = CreateBundle("gandalf-test-nothing", []string{"--output=/tmp/wow"})
+	c.Assert(err, check.Equals, ErrInvalidSince)
+}
+
+func (s *S) TestCreateBundleRepositoryNotFound(c *check.C) {
+	_, err := CreateBundle("gandalf-test-nothing", nil)
+	c.Assert(err, check.Equals, ErrRepositoryNotFound)
+}
+
+func (s *S) TestRestoreBundle(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	bundle, err := CreateBundle(repo, nil)
+	c.Assert(err, check.IsNil)
+	path := saveBundle(c, bundle)
+	defer os.Remove(path)
+	r := &Repository{Name: "gandalf-test-restored", IsPublic: true}
+	err = RestoreBundle(r, path, false)
+	c.Assert(err, check.IsNil)
+	defer removeBare(r.Name)
+	c.Assert(refNames(c, r.Name), check.Equals, refNames(c, repo))
+	_, err = os.Stat(barePath(r.Name) + "/git-daemon-export-ok")
+	c.Assert(err, check.IsNil)
+	err = RestoreBundle(r, path, false)
+	c.Assert(err, check.Equals, ErrRepositoryAlreadyExists)
+	err = RestoreBundle(r, "", true)
+	c.Assert(err, check.IsNil)
+	_, err = CreateBundle(r.Name, nil)
+	c.Assert(err, check.Equals, ErrEmptyBundle)
+}
+
+func (s *S) TestReadAndWriteHooks(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	cleanUpEmpty, err := CreateEmptyTestBareRepository(bare, "gandalf-test-hooks")
+	c.Assert(err, check.IsNil)
+	defer cleanUpEmpty()
+	err = ioutil.WriteFile(barePath("gandalf-test-hooks")+"/hooks/update.sample", []byte("#!/bin/sh\n"), 0755)
+	c.Assert(err, check.IsNil)
+	err = WriteHook("gandalf-test-hooks", "post-receive", []byte("#!/bin/sh\necho wow\n"))
+	c.Assert(err, check.IsNil)
+	info, err := os.Stat(barePath("gandalf-test-hooks") + "/hooks/post-receive")
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0755))
+	hooks, err := ReadHooks("gandalf-test-hooks")
+	c.Assert(err, check.IsNil)
+	c.Assert(hooks, check.DeepEquals, map[string][]byte{"post-receive": []byte("#!/bin/sh\necho wow\n")})
+	err = WriteHook("gandalf-test-hooks", "../config", []byte("wow"))
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var ErrInvalidCommand = errors.New("You've tried to execute some weird command, I'm deliberately denying you to do that, get over it.")
+
+// UnsupportedCommandError is returned for git commands that are valid but
+// that gandalf doesn't serve over SSH.
+type UnsupportedCommandError struct {
+	Command string
+}
+
+func (e *UnsupportedCommandError) Error() string {
+	return fmt.Sprintf("Unsupported command: %s. Only git-upload-pack, git-receive-pack, git-upload-archive and git-lfs-authenticate are supported.", e.Command)
+}
+
+// gitCommandRegexp validates the git commands sent over SSH, which are in the
+// form:
+//
+//	<git-command> [<namespace>/]<name>
+//
+// with namespace being optional. If a namespace is used, we validate it
+// according to the following:
+//   - a namespace contains only alphanumerics, underlines, @´s, -´s, +´s
+//     and periods but it does not start with a period (.)
+//   - one and exactly one slash (/) separates namespace and the actual name
+var gitCommandRegexp = regexp.MustCompile(`(git-[a-z-]+) '/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'`)
+
+// lfsCommandRegexp validates the git-lfs-authenticate command. The repository
+// name follows the same rules of git commands, but git-lfs doesn't always
+// quote it.
+var lfsCommandRegexp = regexp.MustCompile(`^git-lfs-authenticate '?/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'? (download|upload)$`)
+
+// ParseGitCommand parses a git command sent over SSH, like
+// "git-receive-pack 'foo.git'", returning the command and the name of the
+// repository. It returns ErrInvalidCommand when the command doesn't match
+// the expected format.
+func ParseGitCommand(cmd string) (command, name string, err error) {
+	m := gitCommandRegexp.FindStringSubmatch(cmd)
+	if len(m) != 4 {
+		return "", "", ErrInvalidCommand
+	}
+	return m[1], m[2] + m[3], nil
+}
+
+// ParseLFSCommand parses a git-lfs-authenticate command, in the form
+// "git-lfs-authenticate <repository>.git <download|upload>", returning the
+// name of the repository and the operation.
+func ParseLFSCommand(cmd string) (name, operation string, err error) {
+	m := lfsCommandRegexp.FindStringSubmatch(cmd)
+	if len(m) != 4 {
+		return "", "", ErrInvalidCommand
+	}
+	return m[1] + m[2], m[3], nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import "gopkg.in/check.v1"
+
+func (s *S) TestParseGitCommand(c *check.C) {
+	tests := []struct {
+		cmd, command, name string
+	}{
+		{"git-receive-pack 'foobar.git'", "git-receive-pack", "foobar"},
+		{"git-upload-pack '/foobar.git'", "git-upload-pack", "foobar"},
+		{"git-upload-pack 'much/foo-bar.git'", "git-upload-pack", "much/foo-bar"},
+	}
+	for _, t := range tests {
+		command, name, err := ParseGitCommand(t.cmd)
+		c.Check(err, check.IsNil)
+		c.Check(command, check.Equals, t.command)
+		c.Check(name, check.Equals, t.name)
+	}
+}
+
+func (s *S) TestParseGitCommandInvalid(c *check.C) {
+	for _, cmd := range []string{"", "rm -rf /", "git-receive-pack foobar", "git-receive-pack '../foobar.git'", "git-receive-pack /etc"} {
+		_, name, err := ParseGitCommand(cmd)
+		c.Check(err, check.Equals, ErrInvalidCommand)
+		c.Check(name, check.Equals, "")
+	}
+}
+
+func (s *S) TestParseLFSCommand(c *check.C) {
+	name, operation, err := ParseLFSCommand("git-lfs-authenticate '/much/foobar.git' upload")
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "much/foobar")
+	c.Assert(operation, check.Equals, "upload")
+	_, _, err = ParseLFSCommand("git-lfs-authenticate 'foobar.git' delete")
+	c.Assert(err, check.Equals, ErrInvalidCommand)
+}
+
+func (s *S) TestUnsupportedCommandError(c *check.C) {
+	err := &UnsupportedCommandError{Command: "git-shell"}
+	c.Assert(err, check.ErrorMatches, "Unsupported command: git-shell. Only git-upload-pack, git-receive-pack, git-upload-archive and git-lfs-authenticate are supported.")
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import "sync"
+
+// Packages that keep data about repositories, and can't be imported by this
+// package because they import it, register functions to be called when
+// repositories are removed or renamed, so their data is kept in sync with
+// the repositories.
+var (
+	eventsMutex     sync.RWMutex
+	removeListeners []func(name string) error
+	renameListeners []func(oldName, newName string) error
+)
+
+// OnRemove registers a function called by Remove with the name of the
+// repository being removed, before it's removed from the database. When the
+// function fails, the removal is aborted.
+func OnRemove(fn func(name string) error) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	removeListeners = append(removeListeners, fn)
+}
+
+// OnRename registers a function called by Update after a repository is
+// renamed. Its error is returned by Update.
+func OnRename(fn func(oldName, newName string) error) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	renameListeners = append(renameListeners, fn)
+}
+
+func notifyRemove(name string) error {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+	for _, fn := range removeListeners {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func notifyRename(oldName, newName string) error {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+	for _, fn := range renameListeners {
+		if err := fn(oldName, newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"errors"
+
+	"github.com/tsuru/commandmocker"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/tsuru/fs/fstest"
+	"gopkg.in/check.v1"
+)
+
+// resetListeners restores the registered listeners when the test finishes.
+func resetListeners() func() {
+	remove, rename := removeListeners, renameListeners
+	return func() {
+		removeListeners, renameListeners = remove, rename
+	}
+}
+
+func (s *S) TestRemoveFailingListenerAbortsRemoval(c *check.C) {
+	defer resetListeners()()
+	OnRemove(func(name string) error {
+		return errors.New("could not remove data of " + name)
+	})
+	rfs := &fstest.RecordingFs{}
+	fs.Fsystem = rfs
+	defer func() { fs.Fsystem = nil }()
+	err := Remove("myRepo")
+	c.Assert(err, check.ErrorMatches, "could not remove data of myRepo")
+	c.Assert(rfs.HasAction("removeall "+barePath("myRepo")), check.Equals, false)
+}
+
+func (s *S) TestRemoveAndRenameNotifyListeners(c *check.C) {
+	defer resetListeners()()
+	var removed, renamed []string
+	OnRemove(func(name string) error {
+		removed = append(removed, name)
+		return nil
+	})
+	OnRename(func(oldName, newName string) error {
+		renamed = append(renamed, oldName, newName)
+		return nil
+	})
+	tmpdir, err := commandmocker.Add("git", "$*")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	rfs := &fstest.RecordingFs{}
+	fs.Fsystem = rfs
+	defer func() { fs.Fsystem = nil }()
+	r, err := New("freedom", []string{"c"}, nil, false)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId("freedom2")
+	err = Update(r.Name, Repository{Name: "freedom2", Users: r.Users})
+	c.Assert(err, check.IsNil)
+	c.Assert(renamed, check.DeepEquals, []string{"freedom", "freedom2"})
+	err = Update("freedom2", Repository{Name: "freedom2", Users: []string{"a"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(renamed, check.HasLen, 2)
+	err = Remove("freedom2")
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.DeepEquals, []string{"freedom2"})
+}
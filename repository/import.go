@@ -0,0 +1,355 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ImportPending   = "pending"
+	ImportRunning   = "running"
+	ImportSucceeded = "succeeded"
+	ImportFailed    = "failed"
+)
+
+// progressInterval is the minimum interval between two updates of the
+// progress of an import in the database.
+var progressInterval = time.Second
+
+// Running imports record a heartbeat every heartbeatInterval. Imports
+// without a heartbeat for leaseTimeout were interrupted, as the server
+// running them stopped.
+var (
+	heartbeatInterval = 30 * time.Second
+	leaseTimeout      = 2 * time.Minute
+)
+
+var (
+	ErrImportNotPending = errors.New("import is not pending")
+	ErrImporting        = errors.New("repository is being imported")
+	ErrNotImported      = errors.New("repository was not imported")
+
+	progressRegexp = regexp.MustCompile(`^[\w ]+:\s+\d+% \(`)
+)
+
+// Import holds the source of a repository that is initialized from an
+// existing repository, instead of starting empty, and the status of the
+// import.
+type Import struct {
+	// URL is the URL of the source repository, in any transport supported
+	// by git.
+	URL string `json:"url"`
+	// Bundle is the path of an uploaded git bundle, used as the source when
+	// URL is empty. It's removed when the import finishes.
+	Bundle     string    `json:"-"`
+	Status     string    `json:"-"`
+	Progress   string    `json:"-"`
+	Error      string    `json:"-"`
+	StartedAt  time.Time `json:"-"`
+	FinishedAt time.Time `json:"-"`
+	// Heartbeat is the last time the server running the import reported
+	// that it's alive.
+	Heartbeat time.Time `json:"-"`
+}
+
+// MarshalJSON marshals the status of the import, hiding the password of the
+// source URL.
+func (i *Import) MarshalJSON() ([]byte, error) {
+	status := map[string]interface{}{
+		"source": "bundle",
+		"status": i.Status,
+	}
+	if i.URL != "" {
+		status["source"] = redactURL(i.URL)
+	}
+	if i.Progress != "" {
+		status["progress"] = i.Progress
+	}
+	if i.Error != "" {
+		status["error"] = i.Error
+	}
+	if !i.StartedAt.IsZero() {
+		status["startedAt"] = i.StartedAt
+	}
+	if !i.FinishedAt.IsZero() {
+		status["finishedAt"] = i.FinishedAt
+	}
+	return json.Marshal(status)
+}
+
+// Running returns whether the import is still pending or running.
+func (i *Import) Running() bool {
+	return i.Status == ImportPending || i.Status == ImportRunning
+}
+
+func (i *Import) source() string {
+	if i.URL != "" {
+		return i.URL
+	}
+	return i.Bundle
+}
+
+// Importing returns whether the repository is being imported, in which case
+// it doesn't accept changes.
+func (r *Repository) Importing() bool {
+	return r.Import != nil && r.Import.Running()
+}
+
+// NewImport creates a repository that is initialized from the given source.
+// The repository is empty until the import, started by RunImport, finishes.
+func NewImport(name string, users, readOnlyUsers []string, isPublic bool, i Import) (*Repository, error) {
+	if i.URL == "" && i.Bundle == "" {
+		return nil, &InvalidRepositoryError{message: "import url or bundle is required"}
+	}
+	if i.URL != "" {
+		if err := checkRemoteURL(i.URL); err != nil {
+			return nil, &InvalidRepositoryError{message: "import url is not valid: " + err.Error()}
+		}
+	}
+	i = Import{URL: i.URL, Bundle: i.Bundle, Status: ImportPending, Heartbeat: currentTime()}
+	r := &Repository{Name: name, Users: users, ReadOnlyUsers: readOnlyUsers, IsPublic: isPublic, Import: &i}
+	return create(r)
+}
+
+// progressWriter keeps the last progress line written by git, reporting it
+// at most once per progressInterval, and the other lines written, which
+// describe errors.
+type progressWriter struct {
+	mu         sync.Mutex
+	partial    []byte
+	last       string
+	lastReport time.Time
+	output     []string
+	report     func(string)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+		if line == "" {
+			continue
+		}
+		if !progressRegexp.MatchString(line) {
+			w.output = append(w.output, line)
+			continue
+		}
+		w.last = line
+		if time.Since(w.lastReport) >= progressInterval {
+			w.lastReport = time.Now()
+			w.report(line)
+		}
+	}
+	return len(p), nil
+}
+
+// errorOutput returns the lines written by git that are not progress
+// reports.
+func (w *progressWriter) errorOutput() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lines := w.output
+	if rest := strings.TrimSpace(string(w.partial)); rest != "" {
+		lines = append(lines, rest)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fetchImport fetches all branches and tags of the source into the bare
+// repository, reporting the progress of the fetch.
+func fetchImport(name, source string, report func(string)) (string, error) {
+	w := &progressWriter{report: report}
+	cmd := exec.Command("git", "fetch", "--progress", "--end-of-options", source,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	cmd.Dir = barePath(name)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
+		out := w.errorOutput()
+		if redacted := redactURL(source); redacted != source {
+			out = strings.Replace(out, source, redacted, -1)
+		}
+		return w.last, fmt.Errorf("Error when trying to import repository %s (%s: %s).", name, err, out)
+	}
+	return w.last, nil
+}
+
+// setImportedHead points the HEAD of the imported repository to the default
+// branch of the source. Bundles don't record the name of their default
+// branch, so the branch is chosen by the commit of the HEAD of the bundle,
+// preferring the current HEAD of the repository.
+func setImportedHead(name, source string) error {
+	cmd := exec.Command("git", "ls-remote", "--symref", "--end-of-options", source, "HEAD")
+	cmd.Dir = barePath(name)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	var target, commit string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			target = fields[1]
+		} else if len(fields) == 2 && fields[1] == "HEAD" {
+			commit = fields[0]
+		}
+	}
+	if target == "" && commit != "" {
+		if head, err := resolveCommit(barePath(name), "git", "HEAD"); err == nil && head == commit {
+			return nil
+		}
+		cmd = exec.Command("git", "for-each-ref", "--points-at", commit, "--count=1", "--format=%(refname)", "refs/heads/")
+		cmd.Dir = barePath(name)
+		out, err = cmd.Output()
+		if err != nil {
+			return err
+		}
+		target = strings.TrimSpace(string(out))
+	}
+	if target == "" {
+		return nil
+	}
+	cmd = exec.Command("git", "symbolic-ref", "HEAD", target)
+	cmd.Dir = barePath(name)
+	return cmd.Run()
+}
+
+func updateImport(name string, fields bson.M) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	set := bson.M{}
+	for k, v := range fields {
+		set["import."+k] = v
+	}
+	err = conn.Repository().UpdateId(name, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrRepositoryNotFound
+	}
+	return err
+}
+
+// RunImport imports the pending import of the repository, fetching all
+// branches and tags of its source. The status and progress of the import
+// are recorded in the repository, so they can be polled while it runs.
+func RunImport(name string) error {
+	r, err := Get(name)
+	if err != nil {
+		return err
+	}
+	if r.Import == nil || r.Import.Status != ImportPending {
+		return ErrImportNotPending
+	}
+	i := r.Import
+	if i.Bundle != "" {
+		defer os.Remove(i.Bundle)
+	}
+	started := currentTime()
+	err = updateImport(name, bson.M{"status": ImportRunning, "startedat": started, "heartbeat": started})
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go heartbeat(name, done)
+	progress, importErr := fetchImport(name, i.source(), func(progress string) {
+		if err := updateImport(name, bson.M{"progress": progress}); err != nil {
+			log.Errorf("repository.RunImport(%q): could not record progress: %s", name, err)
+		}
+	})
+	status := bson.M{"status": ImportSucceeded, "progress": progress, "finishedat": currentTime(), "bundle": ""}
+	if importErr == nil {
+		if err := setImportedHead(name, i.source()); err != nil {
+			log.Errorf("repository.RunImport(%q): could not set HEAD: %s", name, err)
+		}
+	} else {
+		status["status"] = ImportFailed
+		status["error"] = importErr.Error()
+	}
+	if err = updateImport(name, status); err != nil {
+		return err
+	}
+	return importErr
+}
+
+// heartbeat records the heartbeat of the running import of the repository
+// periodically, until the done channel is closed.
+func heartbeat(name string, done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := updateImport(name, bson.M{"heartbeat": currentTime()}); err != nil {
+				log.Errorf("repository.RunImport(%q): could not record heartbeat: %s", name, err)
+			}
+		}
+	}
+}
+
+// FailInterruptedImports marks the imports that were left running, or that
+// never started, as failed. Imports run in the server process that created
+// them, which records their heartbeat, so only the imports whose heartbeat
+// is older than the lease timeout are considered interrupted, leaving alone
+// the ones running in other servers. It should be called periodically.
+func FailInterruptedImports() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var repos []Repository
+	q := bson.M{
+		"import.status":    bson.M{"$in": []string{ImportPending, ImportRunning}},
+		"import.heartbeat": bson.M{"$not": bson.M{"$gte": currentTime().Add(-leaseTimeout)}},
+	}
+	if err = conn.Repository().Find(q).All(&repos); err != nil {
+		return err
+	}
+	for _, r := range repos {
+		if r.Import.Bundle != "" {
+			os.Remove(r.Import.Bundle)
+		}
+		err = updateImport(r.Name, bson.M{
+			"status":     ImportFailed,
+			"error":      "import interrupted by a stop of the server running it",
+			"finishedat": currentTime(),
+			"bundle":     "",
+		})
+		if err != nil && err != ErrRepositoryNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultMirrorInterval = time.Hour
+	minMirrorInterval     = time.Minute
+)
+
+var (
+	ErrNotMirror = errors.New("repository is not a mirror")
+	ErrMirror    = errors.New("repository is a mirror, it can only be changed by synchronizing with its upstream")
+)
+
+// mirrorLocks serializes the synchronizations of each repository, so the
+// worker and manual synchronizations don't fetch at the same time.
+var mirrorLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+func mirrorLock(name string) *sync.Mutex {
+	mirrorLocks.Lock()
+	defer mirrorLocks.Unlock()
+	l, ok := mirrorLocks.m[name]
+	if !ok {
+		l = new(sync.Mutex)
+		mirrorLocks.m[name] = l
+	}
+	return l
+}
+
+// Mirror holds the upstream of a repository that is a pull mirror, and the
+// status of its synchronization. Branches and tags of mirrors are replaced
+// by the ones in the upstream on every synchronization, so mirrors don't
+// accept pushes.
+type Mirror struct {
+	URL string `json:"url"`
+	// Interval is the number of seconds between synchronizations. Defaults
+	// to one hour.
+	Interval  int       `json:"interval"`
+	LastSync  time.Time `json:"-"`
+	LastError string    `json:"-"`
+	NextSync  time.Time `json:"-"`
+}
+
+func (m *Mirror) interval() time.Duration {
+	if m.Interval <= 0 {
+		return defaultMirrorInterval
+	}
+	if interval := time.Duration(m.Interval) * time.Second; interval > minMirrorInterval {
+		return interval
+	}
+	return minMirrorInterval
+}
+
+func (m *Mirror) isValid() error {
+	if m.URL == "" {
+		return &InvalidRepositoryError{message: "mirror url is required"}
+	}
+	if err := checkRemoteURL(m.URL); err != nil {
+		return &InvalidRepositoryError{message: "mirror url is not valid: " + err.Error()}
+	}
+	if m.Interval < 0 {
+		return &InvalidRepositoryError{message: "mirror interval should not be negative"}
+	}
+	return nil
+}
+
+// MarshalJSON marshals the status of the mirror, hiding the password of the
+// upstream URL.
+func (m *Mirror) MarshalJSON() ([]byte, error) {
+	status := map[string]interface{}{
+		"url":      redactURL(m.URL),
+		"interval": int(m.interval().Seconds()),
+		"nextSync": m.NextSync,
+	}
+	if !m.LastSync.IsZero() {
+		status["lastSync"] = m.LastSync
+	}
+	if m.LastError != "" {
+		status["lastError"] = m.LastError
+	}
+	return json.Marshal(status)
+}
+
+// redactURL hides the password of URLs with credentials.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return u.String()
+}
+
+// NewMirror creates a repository that is a pull mirror of the given
+// upstream. The repository is empty until its first synchronization.
+func NewMirror(name string, users, readOnlyUsers []string, isPublic bool, m Mirror) (*Repository, error) {
+	if err := m.isValid(); err != nil {
+		return nil, err
+	}
+	m.LastSync, m.LastError, m.NextSync = time.Time{}, "", time.Time{}
+	r := &Repository{Name: name, Users: users, ReadOnlyUsers: readOnlyUsers, IsPublic: isPublic, Mirror: &m}
+	return create(r)
+}
+
+// fetchMirror fetches all branches and tags of the upstream into the bare
+// repository, forcing updates and removing the refs that no longer exist in
+// the upstream.
+func fetchMirror(name, upstream string) error {
+	if err := checkRemoteURL(upstream); err != nil {
+		return fmt.Errorf("Error when trying to synchronize mirror %s (invalid upstream: %s).", name, err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "fetch", "--prune", "--quiet", "--end-of-options", upstream,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	cmd.Dir = barePath(name)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stderr.String())
+		if redacted := redactURL(upstream); redacted != upstream {
+			out = strings.Replace(out, upstream, redacted, -1)
+		}
+		return fmt.Errorf("Error when trying to synchronize mirror %s (%s: %s).", name, err, out)
+	}
+	return nil
+}
+
+// SyncMirror synchronizes the mirror repository with its upstream, and
+// records the status of the synchronization. It returns the updated status
+// of the mirror, even when the synchronization fails.
+func SyncMirror(name string) (*Mirror, error) {
+	l := mirrorLock(name)
+	l.Lock()
+	defer l.Unlock()
+	r, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if r.Mirror == nil {
+		return nil, ErrNotMirror
+	}
+	m := r.Mirror
+	syncErr := fetchMirror(name, m.URL)
+	m.LastSync = currentTime()
+	m.NextSync = m.LastSync.Add(m.interval())
+	m.LastError = ""
+	if syncErr != nil {
+		m.LastError = syncErr.Error()
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return m, err
+	}
+	defer conn.Close()
+	err = conn.Repository().UpdateId(name, bson.M{"$set": bson.M{
+		"mirror.lastsync":  m.LastSync,
+		"mirror.nextsync":  m.NextSync,
+		"mirror.lasterror": m.LastError,
+	}})
+	if err == mgo.ErrNotFound {
+		return m, ErrRepositoryNotFound
+	}
+	if err != nil {
+		return m, err
+	}
+	return m, syncErr
+}
+
+// PendingMirrors returns the names of the mirrors whose next synchronization
+// is due.
+func PendingMirrors(now time.Time) ([]string, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var repos []Repository
+	q := bson.M{"mirror.url": bson.M{"$exists": true}, "mirror.nextsync": bson.M{"$lte": now}}
+	err = conn.Repository().Find(q).Select(bson.M{"_id": 1}).Sort("mirror.nextsync").All(&repos)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(repos))
+	for i, r := range repos {
+		names[i] = r.Name
+	}
+	return names, nil
+}
@@ -27,6 +27,18 @@ type MockContentRetriever struct {
 	ClonePath      string
 	CleanUp        func()
 	History        GitHistory
+	LastLogFilter  LogFilter
+	LastQuery      string
+	Comparison     Comparison
+	LastBase       string
+	LastHead       string
+	LastTotal      int
+	LastMerge      GitMerge
+	LastName       string
+	LastOldRef     string
+	LastTag        GitTag
+	LastFileCommit GitFileCommit
+	LastCommit     GitCommit
 }
 
 func (r *MockContentRetriever) GetContents(repo, ref, path string) ([]byte, error) {
@@ -235,6 +247,21 @@ func CreateTestRepository(tmpPath, repo, file, content string, folders ...string
 	return cleanup, err
 }
 
+// CreateBareClone creates the bare repository bareRepo out of the test
+// repository repo, so it can receive pushes.
+func CreateBareClone(tmpPath, repo, bareRepo string) (func(), error) {
+	barePath := path.Join(tmpPath, bareRepo+".git")
+	cleanup := func() {
+		os.RemoveAll(barePath)
+	}
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return cleanup, err
+	}
+	cmd := exec.Command(gitPath, "clone", "--bare", path.Join(tmpPath, repo+".git"), barePath)
+	return cleanup, cmd.Run()
+}
+
 func GetLastHashCommit(tmpPath, repo string) ([]byte, error) {
 	testPath := path.Join(tmpPath, repo+".git")
 	gitPath, err := exec.LookPath("git")
@@ -408,6 +435,7 @@ func (r *MockContentRetriever) CommitZip(repo string, z *multipart.FileHeader, c
 	if r.OutputError != nil {
 		return nil, r.OutputError
 	}
+	r.LastCommit = c
 	return &r.Ref, nil
 }
 
@@ -420,3 +448,110 @@ func (r *MockContentRetriever) GetLogs(repo, hash string, total int, path string
 	}
 	return &r.History, nil
 }
+
+func (r *MockContentRetriever) GetFilteredLogs(repo string, filter LogFilter) (*GitHistory, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastRef = filter.Ref
+	r.LastPath = filter.Path
+	r.LastLogFilter = filter
+	return &r.History, nil
+}
+
+func (r *MockContentRetriever) SearchCommits(repo, query string, filter LogFilter) (*GitHistory, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastQuery = query
+	r.LastLogFilter = filter
+	return &r.History, nil
+}
+
+func (r *MockContentRetriever) Compare(repo, base, head string, total int) (*Comparison, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastBase = base
+	r.LastHead = head
+	r.LastTotal = total
+	return &r.Comparison, nil
+}
+
+func (r *MockContentRetriever) Merge(repo string, m GitMerge) (*Ref, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastMerge = m
+	return &r.Ref, nil
+}
+
+func (r *MockContentRetriever) NewBranch(repo, name, ref string) (*Ref, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastName = name
+	r.LastRef = ref
+	return &r.Ref, nil
+}
+
+func (r *MockContentRetriever) RemoveBranch(repo, name, oldRef string) error {
+	if r.LookPathError != nil {
+		return r.LookPathError
+	}
+	if r.OutputError != nil {
+		return r.OutputError
+	}
+	r.LastName = name
+	r.LastOldRef = oldRef
+	return nil
+}
+
+func (r *MockContentRetriever) NewTag(repo string, t GitTag) (*Ref, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastTag = t
+	return &r.Ref, nil
+}
+
+func (r *MockContentRetriever) RemoveTag(repo, name, oldRef string) error {
+	if r.LookPathError != nil {
+		return r.LookPathError
+	}
+	if r.OutputError != nil {
+		return r.OutputError
+	}
+	r.LastName = name
+	r.LastOldRef = oldRef
+	return nil
+}
+
+func (r *MockContentRetriever) CommitFiles(repo string, c GitFileCommit) (*Ref, error) {
+	if r.LookPathError != nil {
+		return nil, r.LookPathError
+	}
+	if r.OutputError != nil {
+		return nil, r.OutputError
+	}
+	r.LastFileCommit = c
+	return &r.Ref, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const maxPushRetryInterval = time.Hour
+
+var (
+	ErrPushMirrorNotFound      = errors.New("push mirror not found")
+	ErrPushMirrorAlreadyExists = errors.New("push mirror already exists")
+
+	pushMirrorNameRegexp = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// PushMirror is a secondary remote that receives every change made to the
+// branches and tags of a repository. Pushes that fail stay pending, and are
+// retried with an increasing interval, up to one hour.
+type PushMirror struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Pending indicates that the remote is behind the repository.
+	Pending     bool      `json:"-"`
+	QueuedAt    time.Time `json:"-"`
+	Attempts    int       `json:"-"`
+	LastPush    time.Time `json:"-"`
+	LastAttempt time.Time `json:"-"`
+	LastError   string    `json:"-"`
+	NextRetry   time.Time `json:"-"`
+}
+
+// MarshalJSON marshals the push mirror and its status, hiding the password
+// of the remote URL.
+func (m *PushMirror) MarshalJSON() ([]byte, error) {
+	status := map[string]interface{}{
+		"name":     m.Name,
+		"url":      redactURL(m.URL),
+		"pending":  m.Pending,
+		"attempts": m.Attempts,
+	}
+	if !m.LastPush.IsZero() {
+		status["lastPush"] = m.LastPush
+	}
+	if m.LastError != "" {
+		status["lastError"] = m.LastError
+		status["lastAttempt"] = m.LastAttempt
+	}
+	if m.Pending {
+		status["nextRetry"] = m.NextRetry
+	}
+	return json.Marshal(status)
+}
+
+func (m *PushMirror) isValid() error {
+	if !pushMirrorNameRegexp.MatchString(m.Name) {
+		return &InvalidRepositoryError{message: "push mirror name is not valid"}
+	}
+	if m.URL == "" {
+		return &InvalidRepositoryError{message: "push mirror url is required"}
+	}
+	if err := checkRemoteURL(m.URL); err != nil {
+		return &InvalidRepositoryError{message: "push mirror url is not valid: " + err.Error()}
+	}
+	return nil
+}
+
+// retryInterval returns how long to wait before pushing again after the
+// given number of failed attempts: one minute after the first failure,
+// doubling on each failure, up to one hour.
+func retryInterval(attempts int) time.Duration {
+	interval := time.Minute
+	for i := 1; i < attempts && interval < maxPushRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxPushRetryInterval {
+		return maxPushRetryInterval
+	}
+	return interval
+}
+
+// currentTime returns the current time in the precision stored by the
+// database.
+func currentTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// GetPushMirrors returns the push mirrors of the repository.
+func GetPushMirrors(name string) ([]PushMirror, error) {
+	r, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if r.PushMirrors == nil {
+		return []PushMirror{}, nil
+	}
+	return r.PushMirrors, nil
+}
+
+// AddPushMirror adds a push mirror to the repository. The new remote is
+// queued, so it receives the current branches and tags of the repository in
+// the next push.
+func AddPushMirror(name string, m PushMirror) (*PushMirror, error) {
+	if err := m.isValid(); err != nil {
+		return nil, err
+	}
+	queued := currentTime()
+	m = PushMirror{Name: m.Name, URL: m.URL, Pending: true, QueuedAt: queued, NextRetry: queued}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	q := bson.M{"_id": name, "pushmirrors.name": bson.M{"$ne": m.Name}}
+	err = conn.Repository().Update(q, bson.M{"$push": bson.M{"pushmirrors": m}})
+	if err == mgo.ErrNotFound {
+		if _, err = Get(name); err == nil {
+			err = ErrPushMirrorAlreadyExists
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RemovePushMirror removes a push mirror from the repository. The remote
+// itself is left untouched.
+func RemovePushMirror(name, mirrorName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	q := bson.M{"_id": name, "pushmirrors.name": mirrorName}
+	err = conn.Repository().Update(q, bson.M{"$pull": bson.M{"pushmirrors": bson.M{"name": mirrorName}}})
+	if err == mgo.ErrNotFound {
+		if _, err = Get(name); err == nil {
+			err = ErrPushMirrorNotFound
+		}
+	}
+	return err
+}
+
+// QueuePushMirrors marks all the push mirrors of the repository as pending,
+// so they get pushed right away. It should be called whenever refs of the
+// repository change.
+func QueuePushMirrors(name string) error {
+	r, err := Get(name)
+	if err != nil {
+		return err
+	}
+	if len(r.PushMirrors) == 0 {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	queued := currentTime()
+	for _, m := range r.PushMirrors {
+		q := bson.M{"_id": name, "pushmirrors.name": m.Name}
+		err = conn.Repository().Update(q, bson.M{"$set": bson.M{
+			"pushmirrors.$.pending":   true,
+			"pushmirrors.$.queuedat":  queued,
+			"pushmirrors.$.nextretry": queued,
+		}})
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushMirror pushes all branches and tags of the bare repository to the
+// remote, removing the refs that no longer exist in the repository.
+func pushMirror(name, remote string) error {
+	if err := checkRemoteURL(remote); err != nil {
+		return fmt.Errorf("Error when trying to push to mirror %s (invalid remote: %s).", redactURL(remote), err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "push", "--quiet", "--prune", "--end-of-options", remote,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	cmd.Dir = barePath(name)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stderr.String())
+		if redacted := redactURL(remote); redacted != remote {
+			out = strings.Replace(out, remote, redacted, -1)
+		}
+		return fmt.Errorf("Error when trying to push to mirror %s (%s: %s).", redactURL(remote), err, out)
+	}
+	return nil
+}
+
+// recordPush stores the result of a push to the mirror. The mirror stays
+// pending when it's queued again while the push is running.
+func recordPush(conn *db.Storage, name string, m *PushMirror, started time.Time, pushErr error) error {
+	m.LastAttempt = currentTime()
+	sel := bson.M{"_id": name, "pushmirrors.name": m.Name}
+	var update bson.M
+	if pushErr != nil {
+		m.Attempts++
+		m.LastError = pushErr.Error()
+		m.NextRetry = m.LastAttempt.Add(retryInterval(m.Attempts))
+		update = bson.M{
+			"pushmirrors.$.attempts":    m.Attempts,
+			"pushmirrors.$.lasterror":   m.LastError,
+			"pushmirrors.$.lastattempt": m.LastAttempt,
+			"pushmirrors.$.nextretry":   m.NextRetry,
+		}
+	} else {
+		m.Attempts, m.LastError, m.LastPush = 0, "", m.LastAttempt
+		update = bson.M{
+			"pushmirrors.$.attempts":    0,
+			"pushmirrors.$.lasterror":   "",
+			"pushmirrors.$.lastattempt": m.LastAttempt,
+			"pushmirrors.$.lastpush":    m.LastPush,
+		}
+		done := bson.M{"_id": name, "pushmirrors": bson.M{"$elemMatch": bson.M{
+			"name":     m.Name,
+			"queuedat": bson.M{"$lte": started},
+		}}}
+		update["pushmirrors.$.pending"] = false
+		err := conn.Repository().Update(done, bson.M{"$set": update})
+		if err != mgo.ErrNotFound {
+			if err == nil {
+				m.Pending = false
+			}
+			return err
+		}
+		delete(update, "pushmirrors.$.pending")
+	}
+	err := conn.Repository().Update(sel, bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// PushToMirrors pushes the repository to its pending push mirrors whose
+// next retry is due, or to all of them when force is true. It returns the
+// updated push mirrors, along with the first error found.
+func PushToMirrors(name string, force bool) ([]PushMirror, error) {
+	l := mirrorLock(name)
+	l.Lock()
+	defer l.Unlock()
+	r, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.PushMirrors) == 0 {
+		return []PushMirror{}, nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var firstErr error
+	for i := range r.PushMirrors {
+		m := &r.PushMirrors[i]
+		started := currentTime()
+		if !force && (!m.Pending || m.NextRetry.After(started)) {
+			continue
+		}
+		pushErr := pushMirror(name, m.URL)
+		if pushErr != nil {
+			log.Errorf("repository.PushToMirrors(%q): %s", name, pushErr)
+		}
+		if err := recordPush(conn, name, m, started, pushErr); err != nil && pushErr == nil {
+			pushErr = err
+		}
+		if firstErr == nil {
+			firstErr = pushErr
+		}
+	}
+	return r.PushMirrors, firstErr
+}
+
+// PendingPushMirrors returns the names of the repositories with pending push
+// mirrors whose next retry is due.
+func PendingPushMirrors(at time.Time) ([]string, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var repos []Repository
+	q := bson.M{"pushmirrors": bson.M{"$elemMatch": bson.M{
+		"pending":   true,
+		"nextretry": bson.M{"$lte": at},
+	}}}
+	err = conn.Repository().Find(q).Select(bson.M{"_id": 1}).All(&repos)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(repos))
+	for i, r := range repos {
+		names[i] = r.Name
+	}
+	return names, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/tsuru/config"
+)
+
+// scpLikeRegexp matches the scp-like syntax of ssh remotes, like
+// "git@github.com:tsuru/gandalf.git".
+var scpLikeRegexp = regexp.MustCompile(`^(\w[\w.+-]*@)?\w[\w.-]*:[^:]`)
+
+// checkRemoteURL checks that the URL of a remote given by a user, which is
+// passed to git fetch, git push or git ls-remote, is safe to use. Only the
+// https, ssh and git transports are accepted, so users can't reach the
+// repositories stored in the server nor run commands through remote
+// helpers. The file transport, used in tests and in setups where every user
+// is trusted, is accepted when the setting git:remotes:allow-file is true.
+func checkRemoteURL(rawURL string) error {
+	if strings.HasPrefix(rawURL, "-") {
+		return errors.New("it must not start with a dash")
+	}
+	if !strings.Contains(rawURL, "://") {
+		if !scpLikeRegexp.MatchString(rawURL) {
+			return errors.New("only https, ssh and git URLs are supported")
+		}
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https", "ssh", "git":
+	case "file":
+		if allow, _ := config.GetBool("git:remotes:allow-file"); allow {
+			return nil
+		}
+		return errors.New("file URLs are not allowed")
+	default:
+		return errors.New("only https, ssh and git URLs are supported")
+	}
+	if u.Host == "" || strings.HasPrefix(u.Host, "-") {
+		return errors.New("the host is not valid")
+	}
+	if u.User != nil && strings.HasPrefix(u.User.Username(), "-") {
+		return errors.New("the user is not valid")
+	}
+	return nil
+}
@@ -5,16 +5,23 @@
 package repository
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
@@ -27,9 +34,16 @@ import (
 
 var tempDir string
 
+var hashPrefixRegexp = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+const logFormat = "%H%x09%an%x09%ae%x09%ad%x09%cn%x09%ce%x09%cd%x09%P%x09%s"
+
 var (
 	ErrRepositoryAlreadyExists = errors.New("repository already exists")
 	ErrRepositoryNotFound      = errors.New("repository not found")
+	ErrRefAlreadyExists        = errors.New("ref already exists")
+	ErrRefNotFound             = errors.New("ref not found")
+	ErrStaleRef                = errors.New("ref does not point to the expected object")
 )
 
 func tempDirLocation() string {
@@ -46,6 +60,9 @@ type Repository struct {
 	Users         []string
 	ReadOnlyUsers []string
 	IsPublic      bool
+	Mirror        *Mirror      `bson:",omitempty"`
+	PushMirrors   []PushMirror `json:"-" bson:",omitempty"`
+	Import        *Import      `bson:",omitempty"`
 }
 
 type Links struct {
@@ -63,11 +80,28 @@ func (gu GitUser) String() string {
 	return fmt.Sprintf("%s <%s>", gu.Name, gu.Email)
 }
 
+type CommitMode int
+
+const (
+	CommitOverlay CommitMode = iota
+	CommitReplace
+	CommitManifest
+)
+
+// GitCommit describes a commit. Parent is the commit the branch is expected
+// to point to, and is optional. Mode and Delete only apply to CommitZip: in
+// CommitOverlay mode, the contents of the zip are added to the tree of the
+// branch, in CommitReplace mode the tree becomes exactly the contents of the
+// zip, and in CommitManifest mode the paths in Delete are removed before the
+// contents of the zip are added.
 type GitCommit struct {
 	Message   string
 	Author    GitUser
 	Committer GitUser
 	Branch    string
+	Parent    string
+	Mode      CommitMode
+	Delete    []string
 }
 
 type Ref struct {
@@ -93,6 +127,79 @@ type GitLog struct {
 type GitHistory struct {
 	Commits []GitLog `json:"commits"`
 	Next    string   `json:"next"`
+	// Total is the number of commits matching the filter from its ref on,
+	// when it's counted. Pages after the first one start at the ref in
+	// Next, so their total is the number of commits remaining, including
+	// the ones in the page.
+	Total int `json:"total"`
+}
+
+// LogFilter holds the criteria used to select commits from the history of a
+// repository. Ref may be a single ref or a range in the form "a..b". Author,
+// Committer and Grep are regular expressions, as understood by git log. Since
+// and Until accept any date format supported by git. When Count is true, the
+// total number of commits matching the filter is computed as well.
+type LogFilter struct {
+	Ref         string
+	Total       int
+	Path        string
+	Author      string
+	Committer   string
+	Since       string
+	Until       string
+	Grep        string
+	FirstParent bool
+	Count       bool
+}
+
+func (f *LogFilter) args() []string {
+	var args []string
+	if f.Author != "" {
+		args = append(args, "--author="+f.Author)
+	}
+	if f.Committer != "" {
+		args = append(args, "--committer="+f.Committer)
+	}
+	if f.Since != "" {
+		args = append(args, "--since="+f.Since)
+	}
+	if f.Until != "" {
+		args = append(args, "--until="+f.Until)
+	}
+	if f.Grep != "" {
+		args = append(args, "--grep="+f.Grep)
+	}
+	if f.FirstParent {
+		args = append(args, "--first-parent")
+	}
+	args = append(args, f.Ref, "--")
+	if f.Path != "" {
+		args = append(args, f.Path)
+	}
+	return args
+}
+
+// validate checks that Ref can be safely given to git log. Refs starting
+// with a dash would be parsed as options, and symmetric ranges ("a...b") are
+// refused because the next page of such a range cannot be expressed as a
+// ref.
+func (f *LogFilter) validate() error {
+	if strings.HasPrefix(f.Ref, "-") {
+		return fmt.Errorf("invalid ref %q", f.Ref)
+	}
+	if strings.Contains(f.Ref, "...") {
+		return fmt.Errorf("invalid ref %q: symmetric ranges are not supported", f.Ref)
+	}
+	return nil
+}
+
+// nextRef returns the ref that should be used to retrieve the page starting
+// at the given commit, keeping the lower bound when the filter uses a range.
+func (f *LogFilter) nextRef(hash string) string {
+	if i := strings.Index(f.Ref, ".."); i > -1 {
+		return f.Ref[:i] + ".." + hash
+	}
+	return hash
 }
 
 // exists returns whether the given file or directory exists or not
@@ -115,15 +222,51 @@ func (r *Repository) MarshalJSON() ([]byte, error) {
 		"ssh_url": r.ReadWriteURL(),
 		"git_url": r.ReadOnlyURL(),
 	}
+	if r.Mirror != nil {
+		data["mirror"] = r.Mirror
+	}
+	if r.Import != nil {
+		data["import"] = r.Import
+	}
 	return json.Marshal(&data)
 }
 
+// ReadableBy returns whether the given user is allowed to read the
+// repository, either because it's public or because the user has full or
+// read-only access to it.
+func (r *Repository) ReadableBy(userName string) bool {
+	if r.IsPublic {
+		return true
+	}
+	return r.WritableBy(userName) || contains(r.ReadOnlyUsers, userName)
+}
+
+// WritableBy returns whether the given user has full access to the
+// repository.
+func (r *Repository) WritableBy(userName string) bool {
+	return userName != "" && contains(r.Users, userName)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // New creates a representation of a git repository. It creates a Git
 // repository using the "bare-dir" setting and saves repository's meta data in
 // the database.
 func New(name string, users, readOnlyUsers []string, isPublic bool) (*Repository, error) {
-	log.Debugf("Creating repository %q", name)
 	r := &Repository{Name: name, Users: users, ReadOnlyUsers: readOnlyUsers, IsPublic: isPublic}
+	return create(r)
+}
+
+func create(r *Repository) (*Repository, error) {
+	name, isPublic := r.Name, r.IsPublic
+	log.Debugf("Creating repository %q", name)
 	if v, err := r.isValid(); !v {
 		log.Errorf("repository.New: Invalid repository %q: %s", name, err)
 		return r, err
@@ -169,10 +312,33 @@ func Get(name string) (Repository, error) {
 	return r, err
 }
 
+// GetReadableBy returns the repositories that the given user is allowed to
+// read: public repositories and the ones in which the user has either full or
+// read-only access.
+func GetReadableBy(userName string) ([]Repository, error) {
+	var repos []Repository
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	q := bson.M{"$or": []bson.M{
+		{"ispublic": true},
+		{"users": userName},
+		{"readonlyusers": userName},
+	}}
+	err = conn.Repository().Find(q).Sort("_id").All(&repos)
+	return repos, err
+}
+
 // Remove deletes the repository from the database and removes it's bare Git
-// repository.
+// repository, after calling the functions registered with OnRemove.
 func Remove(name string) error {
 	log.Debugf("Removing repository %q", name)
+	if err := notifyRemove(name); err != nil {
+		log.Errorf("repository.Remove: Error removing data of repository %q: %s", name, err)
+		return err
+	}
 	if err := removeBare(name); err != nil {
 		log.Errorf("repository.Remove: Error removing bare repository %q: %s", name, err)
 	}
@@ -190,7 +356,8 @@ func Remove(name string) error {
 	return nil
 }
 
-// Update update a repository data.
+// Update update a repository data. When the repository is renamed, the
+// functions registered with OnRename are called.
 func Update(name string, newData Repository) error {
 	log.Debugf("Updating repository %q data", name)
 	repo, err := Get(name)
@@ -198,6 +365,11 @@ func Update(name string, newData Repository) error {
 		log.Errorf("repository.Update(%q): %s", name, err)
 		return err
 	}
+	if newData.Mirror != nil {
+		if err = newData.Mirror.isValid(); err != nil {
+			return err
+		}
+	}
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -221,6 +393,11 @@ func Update(name string, newData Repository) error {
 			log.Errorf("repository.Rename: Error renaming old repository in filesystem %q: %s", oldName, err)
 			return err
 		}
+		err = notifyRename(oldName, newData.Name)
+		if err != nil {
+			log.Errorf("repository.Rename: Error renaming data of repository %q: %s", oldName, err)
+			return err
+		}
 	} else {
 		err = conn.Repository().UpdateId(repo.Name, newData)
 		if err != nil {
@@ -385,6 +562,15 @@ type ContentRetriever interface {
 	Push(cloneDir, branch string) error
 	CommitZip(repo string, z *multipart.FileHeader, c GitCommit) (*Ref, error)
 	GetLogs(repo, hash string, total int, path string) (*GitHistory, error)
+	GetFilteredLogs(repo string, filter LogFilter) (*GitHistory, error)
+	SearchCommits(repo, query string, filter LogFilter) (*GitHistory, error)
+	Compare(repo, base, head string, total int) (*Comparison, error)
+	Merge(repo string, m GitMerge) (*Ref, error)
+	NewBranch(repo, name, ref string) (*Ref, error)
+	RemoveBranch(repo, name, oldRef string) error
+	NewTag(repo string, t GitTag) (*Ref, error)
+	RemoveTag(repo, name, oldRef string) error
+	CommitFiles(repo string, c GitFileCommit) (*Ref, error)
 }
 
 var Retriever ContentRetriever
@@ -597,6 +783,182 @@ func (*GitContentRetriever) GetTags(repo string) ([]Ref, error) {
 	return retriever().GetForEachRef(repo, "refs/tags/")
 }
 
+type GitTag struct {
+	Name    string
+	Ref     string
+	Message string
+	Tagger  GitUser
+}
+
+// findRef returns the ref with the given prefix (refs/heads/ or refs/tags/)
+// and short name, as described by GetForEachRef, or nil if there's no such
+// ref.
+func findRef(repo, prefix, name string) (*Ref, error) {
+	refs, err := retriever().GetForEachRef(repo, prefix+name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if ref.Name == name {
+			return &ref, nil
+		}
+	}
+	return nil, nil
+}
+
+// refValue returns the object the given full ref name points to, or an empty
+// string if the ref does not exist.
+func refValue(cwd, gitPath, fullName string) string {
+	cmd := exec.Command(gitPath, "rev-parse", "--verify", "--quiet", fullName)
+	cmd.Dir = cwd
+	out, _ := cmd.Output()
+	return strings.TrimSpace(string(out))
+}
+
+// updateRef points the full ref name dst to src, or deletes dst when src is
+// empty. The change is pushed to the repository itself, so its hooks (and
+// any policy implemented in them) apply, and it only succeeds if dst still
+// points to old (or doesn't exist, when old is empty).
+func updateRef(cwd, gitPath, src, dst, old string) error {
+	cmd := exec.Command(gitPath, "push", fmt.Sprintf("--force-with-lease=%s:%s", dst, old), ".", src+":"+dst)
+	cmd.Dir = cwd
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "stale info") {
+			return ErrStaleRef
+		}
+		return fmt.Errorf("%s [%s]", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func checkRefFormat(cwd, gitPath, fullName string) error {
+	cmd := exec.Command(gitPath, "check-ref-format", fullName)
+	cmd.Dir = cwd
+	if err := cmd.Run(); err != nil {
+		return &InvalidRefError{Name: strings.TrimPrefix(strings.TrimPrefix(fullName, "refs/heads/"), "refs/tags/")}
+	}
+	return nil
+}
+
+func (*GitContentRetriever) NewBranch(repo, name, ref string) (*Ref, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to create branch %s of repository %s (%s).", name, repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return nil, fmt.Errorf("Error when trying to create branch %s of repository %s (Repository does not exist).", name, repo)
+	}
+	fullName := "refs/heads/" + name
+	if err = checkRefFormat(cwd, gitPath, fullName); err != nil {
+		return nil, err
+	}
+	if refValue(cwd, gitPath, fullName) != "" {
+		return nil, ErrRefAlreadyExists
+	}
+	hash, err := resolveCommit(cwd, gitPath, ref)
+	if err != nil {
+		return nil, &InvalidRefError{Name: ref}
+	}
+	if err = updateRef(cwd, gitPath, hash, fullName, ""); err != nil {
+		if err == ErrStaleRef {
+			return nil, ErrRefAlreadyExists
+		}
+		return nil, fmt.Errorf("Error when trying to create branch %s of repository %s (%s).", name, repo, err)
+	}
+	branch, err := findRef(repo, "refs/heads/", name)
+	if err != nil || branch == nil {
+		return nil, fmt.Errorf("Error when trying to create branch %s of repository %s (could not check branch: %v).", name, repo, err)
+	}
+	return branch, nil
+}
+
+func (*GitContentRetriever) RemoveBranch(repo, name, oldRef string) error {
+	return removeRef(repo, "branch", "refs/heads/"+name, oldRef)
+}
+
+func (*GitContentRetriever) NewTag(repo string, t GitTag) (*Ref, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to create tag %s of repository %s (%s).", t.Name, repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return nil, fmt.Errorf("Error when trying to create tag %s of repository %s (Repository does not exist).", t.Name, repo)
+	}
+	fullName := "refs/tags/" + t.Name
+	if err = checkRefFormat(cwd, gitPath, fullName); err != nil {
+		return nil, err
+	}
+	if refValue(cwd, gitPath, fullName) != "" {
+		return nil, ErrRefAlreadyExists
+	}
+	object, err := resolveCommit(cwd, gitPath, t.Ref)
+	if err != nil {
+		return nil, &InvalidRefError{Name: t.Ref}
+	}
+	if t.Message != "" {
+		// annotated tags are created with mktag, so the tag object exists
+		// before the ref is pushed.
+		content := fmt.Sprintf("object %s\ntype commit\ntag %s\ntagger %s %d +0000\n\n%s\n", object, t.Name, t.Tagger, time.Now().Unix(), strings.TrimRight(t.Message, "\n"))
+		cmd := exec.Command(gitPath, "mktag")
+		cmd.Stdin = strings.NewReader(content)
+		cmd.Dir = cwd
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("Error when trying to create tag %s of repository %s (%s [%s]).", t.Name, repo, err, bytes.TrimSpace(out))
+		}
+		object = strings.TrimSpace(string(out))
+	}
+	if err = updateRef(cwd, gitPath, object, fullName, ""); err != nil {
+		if err == ErrStaleRef {
+			return nil, ErrRefAlreadyExists
+		}
+		return nil, fmt.Errorf("Error when trying to create tag %s of repository %s (%s).", t.Name, repo, err)
+	}
+	tag, err := findRef(repo, "refs/tags/", t.Name)
+	if err != nil || tag == nil {
+		return nil, fmt.Errorf("Error when trying to create tag %s of repository %s (could not check tag: %v).", t.Name, repo, err)
+	}
+	return tag, nil
+}
+
+func (*GitContentRetriever) RemoveTag(repo, name, oldRef string) error {
+	return removeRef(repo, "tag", "refs/tags/"+name, oldRef)
+}
+
+// removeRef deletes the given branch or tag. When oldRef is not empty, the
+// ref is only removed if it still points to oldRef.
+func removeRef(repo, kind, fullName, oldRef string) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(fullName, "refs/heads/"), "refs/tags/")
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return fmt.Errorf("Error when trying to remove %s %s of repository %s (%s).", kind, name, repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return fmt.Errorf("Error when trying to remove %s %s of repository %s (Repository does not exist).", kind, name, repo)
+	}
+	current := refValue(cwd, gitPath, fullName)
+	if current == "" {
+		return ErrRefNotFound
+	}
+	if oldRef != "" && oldRef != current {
+		return ErrStaleRef
+	}
+	if err = updateRef(cwd, gitPath, "", fullName, current); err != nil {
+		if err == ErrStaleRef {
+			return err
+		}
+		return fmt.Errorf("Error when trying to remove %s %s of repository %s (%s).", kind, name, repo, err)
+	}
+	return nil
+}
+
 func (*GitContentRetriever) TempClone(repo string) (cloneDir string, cleanUp func(), err error) {
 	gitPath, err := exec.LookPath("git")
 	if err != nil {
@@ -702,6 +1064,50 @@ func (*GitContentRetriever) Push(cloneDir, branch string) error {
 	return nil
 }
 
+// clearClone removes all the files of the clone, so only the files added
+// afterwards are part of the next commit.
+func clearClone(cloneDir string) error {
+	entries, err := ioutil.ReadDir(cloneDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+		if err = os.RemoveAll(path.Join(cloneDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromClone removes the given files and directories from the clone.
+func removeFromClone(cloneDir string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(gitPath, "rm", "-r", "-q", "--")
+	for _, p := range paths {
+		cleaned, err := cleanFilePath(p)
+		if err != nil {
+			return err
+		}
+		cmd.Args = append(cmd.Args, cleaned)
+	}
+	cmd.Env = append(os.Environ(), "GIT_LITERAL_PATHSPECS=1")
+	cmd.Dir = cloneDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s [%s]", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
 func (*GitContentRetriever) CommitZip(repo string, z *multipart.FileHeader, c GitCommit) (*Ref, error) {
 	cloneDir, cleanUp, err := TempClone(repo)
 	if cleanUp != nil {
@@ -717,7 +1123,21 @@ func (*GitContentRetriever) CommitZip(repo string, z *multipart.FileHeader, c Gi
 			return nil, fmt.Errorf("Error when trying to commit zip to repository %s, could not checkout: %s", repo, err)
 		}
 	}
-	err = multipartzip.ExtractZip(z, cloneDir)
+	if c.Parent != "" {
+		if head, err := resolveCommit(cloneDir, "git", "HEAD"); err != nil || head != c.Parent {
+			return nil, ErrStaleRef
+		}
+	}
+	switch c.Mode {
+	case CommitReplace:
+		err = clearClone(cloneDir)
+	case CommitManifest:
+		err = removeFromClone(cloneDir, c.Delete)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to commit zip to repository %s, could not remove files: %s", repo, err)
+	}
+	err = multipartzip.ExtractArchive(z, cloneDir)
 	if err != nil {
 		return nil, fmt.Errorf("Error when trying to commit zip to repository %s, could not extract: %s", repo, err)
 	}
@@ -745,13 +1165,505 @@ func (*GitContentRetriever) CommitZip(repo string, z *multipart.FileHeader, c Gi
 	return nil, fmt.Errorf("Error when trying to commit zip to repository %s, could not check branch: %s", repo, err)
 }
 
+type MergeStrategy int
+
+const (
+	MergeCommit MergeStrategy = iota
+	FastForwardOnly
+	Squash
+)
+
+type GitMerge struct {
+	Source    string
+	Target    string
+	Strategy  MergeStrategy
+	Message   string
+	Author    GitUser
+	Committer GitUser
+}
+
+type MergeConflict struct {
+	Paths   []string `json:"paths"`
+	Type    string   `json:"type"`
+	Message string   `json:"message"`
+}
+
+// MergeConflictError is returned by Merge when the source cannot be merged
+// into the target, either because of conflicting changes or because the
+// target cannot be fast-forwarded.
+type MergeConflictError struct {
+	Source    string
+	Target    string
+	Conflicts []MergeConflict
+}
+
+func (err *MergeConflictError) Error() string {
+	if len(err.Conflicts) == 0 {
+		return fmt.Sprintf("%s cannot be fast-forwarded to %s", err.Target, err.Source)
+	}
+	return fmt.Sprintf("%s cannot be merged into %s (%d conflicts)", err.Source, err.Target, len(err.Conflicts))
+}
+
+// resolveCommit returns the hash of the commit pointed by the given revision.
+func resolveCommit(cwd, gitPath, name string) (string, error) {
+	cmd := exec.Command(gitPath, "rev-parse", "--verify", "--quiet", name+"^{commit}")
+	cmd.Dir = cwd
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Invalid ref %s", name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func isAncestor(cwd, gitPath, ancestor, descendant string) (bool, error) {
+	cmd := exec.Command(gitPath, "merge-base", "--is-ancestor", ancestor, descendant)
+	cmd.Dir = cwd
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Merge merges the source ref into the target branch. Fast-forwards and, when
+// git supports merge-tree --write-tree, merge and squash commits are created
+// directly in the bare repository, without cloning it. The result is pushed
+// to the repository, so the usual hooks run.
+func (*GitContentRetriever) Merge(repo string, m GitMerge) (*Ref, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s).", m.Source, m.Target, repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (Repository does not exist).", m.Source, m.Target, repo)
+	}
+	source, err := resolveCommit(cwd, gitPath, m.Source)
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s).", m.Source, m.Target, repo, err)
+	}
+	target, err := resolveCommit(cwd, gitPath, "refs/heads/"+m.Target)
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (Invalid branch %s).", m.Source, m.Target, repo, m.Target)
+	}
+	upToDate, err := isAncestor(cwd, gitPath, source, target)
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s).", m.Source, m.Target, repo, err)
+	}
+	if !upToDate {
+		var commit string
+		switch m.Strategy {
+		case FastForwardOnly:
+			canFastForward, err := isAncestor(cwd, gitPath, target, source)
+			if err != nil {
+				return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s).", m.Source, m.Target, repo, err)
+			}
+			if !canFastForward {
+				return nil, &MergeConflictError{Source: m.Source, Target: m.Target}
+			}
+			commit = source
+		default:
+			if m.Message == "" {
+				m.Message = defaultMergeMessage(m)
+			}
+			var supported bool
+			commit, supported, err = mergeInBare(repo, cwd, gitPath, source, target, m)
+			if err != nil {
+				return nil, err
+			}
+			if !supported {
+				if err = mergeInClone(repo, gitPath, source, m); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if commit != "" {
+			cmd := exec.Command(gitPath, "push", ".", fmt.Sprintf("%s:refs/heads/%s", commit, m.Target))
+			cmd.Dir = cwd
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s [%s]).", m.Source, m.Target, repo, err, out)
+			}
+		}
+	}
+	ref, err := compareRef(repo, cwd, gitPath, m.Target)
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s).", m.Source, m.Target, repo, err)
+	}
+	return ref, nil
+}
+
+func defaultMergeMessage(m GitMerge) string {
+	if m.Strategy == Squash {
+		return fmt.Sprintf("Squashed commit of '%s' into %s", m.Source, m.Target)
+	}
+	return fmt.Sprintf("Merge '%s' into %s", m.Source, m.Target)
+}
+
+// mergeInBare creates the merge (or squash) commit in the bare repository
+// using git merge-tree, returning the new commit. It returns false when the
+// installed git does not support merge-tree --write-tree.
+func mergeInBare(repo, cwd, gitPath, source, target string, m GitMerge) (string, bool, error) {
+	cmd := exec.Command(gitPath, "merge-tree", "--write-tree", "-z", target, source)
+	cmd.Dir = cwd
+	out, err := cmd.Output()
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return "", false, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s).", m.Source, m.Target, repo, err)
+		}
+		switch exitErr.Sys().(syscall.WaitStatus).ExitStatus() {
+		case 1:
+			return "", true, &MergeConflictError{Source: m.Source, Target: m.Target, Conflicts: parseMergeTreeConflicts(string(out))}
+		case 129:
+			return "", false, nil
+		default:
+			return "", false, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s [%s]).", m.Source, m.Target, repo, err, exitErr.Stderr)
+		}
+	}
+	tree := strings.TrimSuffix(string(out), "\x00")
+	cmd = exec.Command(gitPath, "commit-tree", tree, "-p", target, "-m", m.Message)
+	if m.Strategy != Squash {
+		cmd.Args = append(cmd.Args, "-p", source)
+	}
+	cmd.Env = identityEnv(m.Author, m.Committer)
+	cmd.Dir = cwd
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return "", true, fmt.Errorf("Error when trying to merge %s into %s of repository %s (%s [%s]).", m.Source, m.Target, repo, err, out)
+	}
+	return strings.TrimSpace(string(out)), true, nil
+}
+
+// identityEnv returns the environment for git commands that record the
+// author and the committer of a commit.
+func identityEnv(author, committer GitUser) []string {
+	return append(os.Environ(),
+		"GIT_AUTHOR_NAME="+author.Name,
+		"GIT_AUTHOR_EMAIL="+author.Email,
+		"GIT_COMMITTER_NAME="+committer.Name,
+		"GIT_COMMITTER_EMAIL="+committer.Email,
+	)
+}
+
+// parseMergeTreeConflicts parses the informational messages of
+// git merge-tree -z, keeping only the conflicts.
+func parseMergeTreeConflicts(out string) []MergeConflict {
+	conflicts := []MergeConflict{}
+	fields := strings.Split(out, "\x00")
+	i := 1
+	for i < len(fields) && fields[i] != "" { // conflicted file info
+		i++
+	}
+	for i++; i < len(fields) && fields[i] != ""; {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil || i+n+2 >= len(fields) {
+			break
+		}
+		paths := fields[i+1 : i+1+n]
+		kind := fields[i+1+n]
+		message := strings.TrimSpace(fields[i+2+n])
+		i += n + 3
+		if conflict, ok := newMergeConflict(kind, message); ok {
+			conflict.Paths = paths
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
+
+// newMergeConflict builds a conflict out of a git message type such as
+// "CONFLICT (contents)", ignoring messages that are not conflicts.
+func newMergeConflict(kind, message string) (MergeConflict, bool) {
+	if !strings.HasPrefix(kind, "CONFLICT") {
+		return MergeConflict{}, false
+	}
+	kind = strings.TrimSpace(strings.TrimPrefix(kind, "CONFLICT"))
+	return MergeConflict{Type: strings.Trim(kind, "()"), Message: message}, true
+}
+
+// mergeInClone merges the source into the target using a temporary clone,
+// for git versions without merge-tree --write-tree.
+func mergeInClone(repo, gitPath, source string, m GitMerge) error {
+	cloneDir, cleanUp, err := TempClone(repo)
+	if cleanUp != nil {
+		defer cleanUp()
+	}
+	if err != nil {
+		return fmt.Errorf("Error when trying to merge %s into %s of repository %s, could not clone: %s", m.Source, m.Target, repo, err)
+	}
+	if err = Checkout(cloneDir, m.Target, false); err != nil {
+		return fmt.Errorf("Error when trying to merge %s into %s of repository %s, could not checkout: %s", m.Source, m.Target, repo, err)
+	}
+	cmd := exec.Command(gitPath, "merge", "--no-ff", "--no-commit", source)
+	if m.Strategy == Squash {
+		cmd = exec.Command(gitPath, "merge", "--squash", source)
+	}
+	cmd.Env = identityEnv(m.Author, m.Committer)
+	cmd.Dir = cloneDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		conflicts := []MergeConflict{}
+		cmd = exec.Command(gitPath, "diff", "--name-only", "--diff-filter=U", "-z")
+		cmd.Dir = cloneDir
+		unmerged, _ := cmd.Output()
+		for _, line := range strings.Split(string(out), "\n") {
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			conflict, ok := newMergeConflict(parts[0], line)
+			if !ok {
+				continue
+			}
+			conflict.Paths = []string{}
+			for _, p := range strings.Split(string(unmerged), "\x00") {
+				if p != "" && strings.Contains(conflict.Message, p) {
+					conflict.Paths = append(conflict.Paths, p)
+				}
+			}
+			conflicts = append(conflicts, conflict)
+		}
+		if len(conflicts) > 0 {
+			return &MergeConflictError{Source: m.Source, Target: m.Target, Conflicts: conflicts}
+		}
+		return fmt.Errorf("Error when trying to merge %s into %s of repository %s, could not merge: %s [%s]", m.Source, m.Target, repo, err, out)
+	}
+	if err = Commit(cloneDir, m.Message, m.Author, m.Committer); err != nil {
+		return fmt.Errorf("Error when trying to merge %s into %s of repository %s, could not commit: %s", m.Source, m.Target, repo, err)
+	}
+	if err = Push(cloneDir, m.Target); err != nil {
+		return fmt.Errorf("Error when trying to merge %s into %s of repository %s, could not push: %s", m.Source, m.Target, repo, err)
+	}
+	return nil
+}
+
+type FileActionType int
+
+const (
+	FileCreate FileActionType = iota
+	FileUpdate
+	FileMove
+	FileDelete
+)
+
+// FileAction describes a change to a single file. Content is ignored when
+// deleting, and may be nil when moving, to keep the content of the file.
+// When Executable is nil, the mode of the file is kept (new files are not
+// executable).
+type FileAction struct {
+	Action       FileActionType
+	Path         string
+	PreviousPath string
+	Content      []byte
+	Executable   *bool
+}
+
+// GitFileCommit describes a commit made of FileActions. When the branch does
+// not exist, it's created with Parent as the parent of the commit (or as a
+// root commit, when Parent is empty).
+type GitFileCommit struct {
+	GitCommit
+	Actions []FileAction
+}
+
+type InvalidFileActionError struct {
+	Path   string
+	Reason string
+}
+
+func (err *InvalidFileActionError) Error() string {
+	return fmt.Sprintf("invalid action on file %q: %s", err.Path, err.Reason)
+}
+
+// cleanFilePath validates a path relative to the root of the repository.
+func cleanFilePath(p string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(p, "/"))
+	if p == "" || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &InvalidFileActionError{Path: p, Reason: "invalid path"}
+	}
+	return cleaned, nil
+}
+
+// CommitFiles applies the actions to the tree of the branch, creating a
+// commit directly in the bare repository: blobs, the tree and the commit are
+// written with a temporary index, and the branch is updated with a push to
+// the repository itself, only if it still points to the parent.
+func (*GitContentRetriever) CommitFiles(repo string, c GitFileCommit) (*Ref, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to commit files to branch %s of repository %s (%s).", c.Branch, repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return nil, fmt.Errorf("Error when trying to commit files to branch %s of repository %s (Repository does not exist).", c.Branch, repo)
+	}
+	fullName := "refs/heads/" + c.Branch
+	if err = checkRefFormat(cwd, gitPath, fullName); err != nil {
+		return nil, err
+	}
+	current := refValue(cwd, gitPath, fullName)
+	parent := c.Parent
+	if current != "" {
+		if parent != "" && parent != current {
+			return nil, ErrStaleRef
+		}
+		parent = current
+	} else if parent != "" {
+		if parent, err = resolveCommit(cwd, gitPath, parent); err != nil {
+			return nil, &InvalidRefError{Name: c.Parent}
+		}
+	}
+	indexDir, err := ioutil.TempDir(tempDir, "gandalf_index")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to commit files to branch %s of repository %s (Could not create temporary directory).", c.Branch, repo)
+	}
+	defer os.RemoveAll(indexDir)
+	// git ls-files refuses to run without a work tree, even though it only
+	// reads the index, so the temporary directory is used as one.
+	env := append(identityEnv(c.Author, c.Committer),
+		"GIT_INDEX_FILE="+path.Join(indexDir, "index"),
+		"GIT_WORK_TREE="+indexDir,
+		"GIT_LITERAL_PATHSPECS=1",
+	)
+	git := func(stdin io.Reader, args ...string) (string, error) {
+		cmd := exec.Command(gitPath, args...)
+		cmd.Dir = cwd
+		cmd.Env = env
+		cmd.Stdin = stdin
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("Error when trying to commit files to branch %s of repository %s (%s [%s]).", c.Branch, repo, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	if parent != "" {
+		if _, err = git(nil, "read-tree", parent); err != nil {
+			return nil, err
+		}
+	}
+	// stat returns the mode and the blob of a file in the index, or empty
+	// strings when the file is not there.
+	stat := func(p string) (string, string, error) {
+		out, err := git(nil, "ls-files", "--stage", "-z", "--", p)
+		if err != nil {
+			return "", "", err
+		}
+		for _, entry := range strings.Split(out, "\x00") {
+			if tabbed := strings.SplitN(entry, "\t", 2); len(tabbed) == 2 && tabbed[1] == p {
+				fields := strings.Fields(tabbed[0])
+				return fields[0], fields[1], nil
+			}
+		}
+		return "", "", nil
+	}
+	for _, action := range c.Actions {
+		p, err := cleanFilePath(action.Path)
+		if err != nil {
+			return nil, err
+		}
+		mode, blob, err := stat(p)
+		if err != nil {
+			return nil, err
+		}
+		switch action.Action {
+		case FileCreate:
+			if blob != "" {
+				return nil, &InvalidFileActionError{Path: p, Reason: "file already exists"}
+			}
+			mode = "100644"
+		case FileUpdate, FileDelete:
+			if blob == "" {
+				return nil, &InvalidFileActionError{Path: p, Reason: "file does not exist"}
+			}
+		case FileMove:
+			if blob != "" {
+				return nil, &InvalidFileActionError{Path: p, Reason: "file already exists"}
+			}
+			previous, err := cleanFilePath(action.PreviousPath)
+			if err != nil {
+				return nil, err
+			}
+			if mode, blob, err = stat(previous); err != nil {
+				return nil, err
+			}
+			if blob == "" {
+				return nil, &InvalidFileActionError{Path: previous, Reason: "file does not exist"}
+			}
+			if _, err = git(nil, "update-index", "--force-remove", "--", previous); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &InvalidFileActionError{Path: p, Reason: "invalid action"}
+		}
+		if action.Action == FileDelete {
+			if _, err = git(nil, "update-index", "--force-remove", "--", p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if mode != "100644" && mode != "100755" {
+			return nil, &InvalidFileActionError{Path: p, Reason: "not a regular file"}
+		}
+		if action.Executable != nil {
+			mode = "100644"
+			if *action.Executable {
+				mode = "100755"
+			}
+		}
+		if action.Content != nil || action.Action != FileMove {
+			if blob, err = git(bytes.NewReader(action.Content), "hash-object", "-w", "--stdin"); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = git(nil, "update-index", "--add", "--cacheinfo", mode+","+blob+","+p); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := git(nil, "write-tree")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"commit-tree", tree, "-m", c.Message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err = updateRef(cwd, gitPath, commit, fullName, current); err != nil {
+		if err == ErrStaleRef {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Error when trying to commit files to branch %s of repository %s (%s).", c.Branch, repo, err)
+	}
+	branch, err := findRef(repo, "refs/heads/", c.Branch)
+	if err != nil || branch == nil {
+		return nil, fmt.Errorf("Error when trying to commit files to branch %s of repository %s (could not check branch: %v).", c.Branch, repo, err)
+	}
+	return branch, nil
+}
+
 func (*GitContentRetriever) GetLogs(repo, hash string, total int, path string) (*GitHistory, error) {
-	if hash == "" {
-		hash = "master"
+	return retriever().GetFilteredLogs(repo, LogFilter{Ref: hash, Total: total, Path: path})
+}
+
+func (*GitContentRetriever) GetFilteredLogs(repo string, filter LogFilter) (*GitHistory, error) {
+	if filter.Ref == "" {
+		filter.Ref = "master"
+	}
+	if filter.Total < 1 {
+		filter.Total = 1
 	}
-	if total < 1 {
-		total = 1
+	if err := filter.validate(); err != nil {
+		return nil, fmt.Errorf("Error when trying to obtain the log of repository %s (%s).", repo, err)
 	}
+	total := filter.Total
 	totalPagination := total + 1
 	var last string
 	gitPath, err := exec.LookPath("git")
@@ -763,8 +1675,8 @@ func (*GitContentRetriever) GetLogs(repo, hash string, total int, path string) (
 	if err != nil || !repoExists {
 		return nil, fmt.Errorf("Error when trying to obtain the log of repository %s (Repository does not exist).", repo)
 	}
-	format := "%H%x09%an%x09%ae%x09%ad%x09%cn%x09%ce%x09%cd%x09%P%x09%s"
-	cmd := exec.Command(gitPath, "--no-pager", "log", fmt.Sprintf("-n %d", totalPagination), fmt.Sprintf("--format=%s", format), hash, "--", path)
+	cmd := exec.Command(gitPath, "--no-pager", "log", fmt.Sprintf("-n %d", totalPagination), fmt.Sprintf("--format=%s", logFormat))
+	cmd.Args = append(cmd.Args, filter.args()...)
 	cmd.Dir = cwd
 	out, err := cmd.Output()
 	if err != nil {
@@ -784,56 +1696,285 @@ func (*GitContentRetriever) GetLogs(repo, hash string, total int, path string) (
 	commits := make([]GitLog, objectCount)
 	objectCount = 0
 	for _, line := range lines {
-		var parent, subject string
 		if strings.TrimSpace(line) == "" {
 			continue
 		}
-		fields := strings.Split(line, "\t")
-		if len(fields) < 7 { // let there be commits with empty subject and no parents
+		commit, ok := parseGitLog(line)
+		if !ok {
 			return nil, fmt.Errorf("Error when trying to obtain the log of repository %s (Invalid git log output [%s]).", repo, out)
 		}
-		if len(fields) > 8 {
-			parent = fields[7]
-			subject = strings.Join(fields[8:], "\t") // let there be subjects with \t
-		}
-		commit := GitLog{}
-		commit.Ref = fields[0]
-		commit.Subject = subject
-		commit.CreatedAt = fields[3]
-		commit.Committer = &GitUser{
-			Name:  fields[4],
-			Email: fields[5],
-			Date:  fields[6],
-		}
-		commit.Author = &GitUser{
-			Name:  fields[1],
-			Email: fields[2],
-			Date:  fields[3],
-		}
-		if len(parent) > 0 {
-			parents := strings.Split(parent, " ")
-			parentCount := len(parents)
-			aux := make([]string, parentCount)
-			parentCount = 0
-			for _, item := range parents {
-				aux[parentCount] = item
-				parentCount++
-			}
-			commit.Parent = aux
-		}
 		commits[objectCount] = commit
 		objectCount++
 	}
 	history.Commits = commits
 	if last != "" {
 		fields := strings.Split(last, "\t")
-		history.Next = fields[0]
+		history.Next = filter.nextRef(fields[0])
 	} else {
 		history.Next = ""
 	}
+	if filter.Count {
+		cmd = exec.Command(gitPath, "rev-list", "--count")
+		cmd.Args = append(cmd.Args, filter.args()...)
+		cmd.Dir = cwd
+		out, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("Error when trying to count the log of repository %s (%s).", repo, err)
+		}
+		history.Total, err = strconv.Atoi(strings.TrimSpace(string(out)))
+		if err != nil {
+			return nil, fmt.Errorf("Error when trying to count the log of repository %s (Invalid git rev-list output [%s]).", repo, out)
+		}
+	}
+	return &history, nil
+}
+
+// parseGitLog parses a line of git log output in logFormat.
+func parseGitLog(line string) (GitLog, bool) {
+	var parent, subject string
+	fields := strings.Split(line, "\t")
+	if len(fields) < 7 { // let there be commits with empty subject and no parents
+		return GitLog{}, false
+	}
+	if len(fields) > 8 {
+		parent = fields[7]
+		subject = strings.Join(fields[8:], "\t") // let there be subjects with \t
+	}
+	commit := GitLog{}
+	commit.Ref = fields[0]
+	commit.Subject = subject
+	commit.CreatedAt = fields[3]
+	commit.Committer = &GitUser{
+		Name:  fields[4],
+		Email: fields[5],
+		Date:  fields[6],
+	}
+	commit.Author = &GitUser{
+		Name:  fields[1],
+		Email: fields[2],
+		Date:  fields[3],
+	}
+	if len(parent) > 0 {
+		commit.Parent = strings.Split(parent, " ")
+	}
+	return commit, true
+}
+
+// SearchCommits walks the history selected by the filter, returning the
+// commits whose message contains the query (ignoring case), whose hash starts
+// with the query or whose author email contains the query. Like in
+// GetFilteredLogs, Next holds the ref for retrieving the next page.
+func (*GitContentRetriever) SearchCommits(repo, query string, filter LogFilter) (*GitHistory, error) {
+	if filter.Ref == "" {
+		filter.Ref = "master"
+	}
+	if filter.Total < 1 {
+		filter.Total = 1
+	}
+	if err := filter.validate(); err != nil {
+		return nil, fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+	}
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return nil, fmt.Errorf("Error when trying to search commits of repository %s (Repository does not exist).", repo)
+	}
+	needle := strings.ToLower(query)
+	isHash := hashPrefixRegexp.MatchString(needle)
+	cmd := exec.Command(gitPath, "--no-pager", "log", "-z", fmt.Sprintf("--format=%s%%x1f%%B", logFormat))
+	cmd.Args = append(cmd.Args, filter.args()...)
+	cmd.Dir = cwd
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+	}
+	history := GitHistory{Commits: []GitLog{}}
+	reader := bufio.NewReader(stdout)
+	stopped := false
+	for !stopped {
+		record, readErr := reader.ReadString('\x00')
+		record = strings.TrimPrefix(strings.TrimSuffix(record, "\x00"), "\n")
+		if readErr != nil && record == "" {
+			break
+		}
+		parts := strings.SplitN(record, "\x1f", 2)
+		commit, ok := parseGitLog(parts[0])
+		if !ok {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("Error when trying to search commits of repository %s (Invalid git log output [%s]).", repo, record)
+		}
+		var message string
+		if len(parts) > 1 {
+			message = parts[1]
+		}
+		if (isHash && strings.HasPrefix(commit.Ref, needle)) ||
+			strings.Contains(strings.ToLower(message), needle) ||
+			strings.Contains(strings.ToLower(commit.Author.Email), needle) {
+			history.Total++
+			if len(history.Commits) < filter.Total {
+				history.Commits = append(history.Commits, commit)
+			} else if history.Next == "" {
+				history.Next = filter.nextRef(commit.Ref)
+				stopped = !filter.Count
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if !filter.Count {
+		history.Total = 0
+	}
+	if stopped {
+		cmd.Process.Kill()
+		cmd.Wait()
+	} else if err = cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("Error when trying to search commits of repository %s (%s).", repo, err)
+	}
 	return &history, nil
 }
 
+// FileStat holds the number of lines added and removed in a file.
+type FileStat struct {
+	Path      string `json:"path"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary"`
+}
+
+// DiffStats holds the aggregate stats of a diff.
+type DiffStats struct {
+	Files     int `json:"files"`
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+}
+
+// Comparison describes how the head of a comparison diverges from its base.
+// Ahead is the number of commits in head that are not in base, and Behind is
+// the number of commits in base that are not in head. Commits lists the
+// commits ahead (newest first), Next holding the ref for retrieving the next
+// page, and Files holds the changes made in head since the merge base.
+type Comparison struct {
+	Base      *Ref       `json:"base"`
+	Head      *Ref       `json:"head"`
+	MergeBase string     `json:"mergeBase"`
+	Ahead     int        `json:"ahead"`
+	Behind    int        `json:"behind"`
+	Commits   []GitLog   `json:"commits"`
+	Next      string     `json:"next"`
+	Files     []FileStat `json:"files"`
+	Stats     DiffStats  `json:"stats"`
+}
+
+// compareRef resolves one side of a comparison. Branches and tags are
+// described just like in GetForEachRef, other revisions only have the commit
+// hash and the name.
+func compareRef(repo, cwd, gitPath, name string) (*Ref, error) {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		ref, err := findRef(repo, prefix, name)
+		if err != nil || ref != nil {
+			return ref, err
+		}
+	}
+	hash, err := resolveCommit(cwd, gitPath, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Ref{Ref: hash, Name: name}, nil
+}
+
+func (*GitContentRetriever) Compare(repo, base, head string, total int) (*Comparison, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (%s).", base, head, repo, err)
+	}
+	cwd := barePath(repo)
+	repoExists, err := exists(cwd)
+	if err != nil || !repoExists {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (Repository does not exist).", base, head, repo)
+	}
+	// base and head are given to git as arguments, so they can't look like
+	// options.
+	for _, name := range []string{base, head} {
+		if strings.HasPrefix(name, "-") {
+			return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (Invalid ref %s).", base, head, repo, name)
+		}
+	}
+	comparison := Comparison{}
+	if comparison.Base, err = compareRef(repo, cwd, gitPath, base); err != nil {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (%s).", base, head, repo, err)
+	}
+	if comparison.Head, err = compareRef(repo, cwd, gitPath, head); err != nil {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (%s).", base, head, repo, err)
+	}
+	cmd := exec.Command(gitPath, "merge-base", base, head)
+	cmd.Dir = cwd
+	out, err := cmd.Output()
+	if err != nil {
+		// git merge-base exits with status 1 when the histories are
+		// unrelated, which is not an error for a comparison.
+		if exitErr, ok := err.(*exec.ExitError); !ok || len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (%s).", base, head, repo, err)
+		}
+	}
+	comparison.MergeBase = strings.TrimSpace(string(out))
+	cmd = exec.Command(gitPath, "rev-list", "--left-right", "--count", base+"..."+head, "--")
+	cmd.Dir = cwd
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (%s).", base, head, repo, err)
+	}
+	if _, err = fmt.Sscan(string(out), &comparison.Behind, &comparison.Ahead); err != nil {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (Invalid git rev-list output [%s]).", base, head, repo, out)
+	}
+	history, err := retriever().GetFilteredLogs(repo, LogFilter{Ref: base + ".." + head, Total: total})
+	if err != nil {
+		return nil, err
+	}
+	comparison.Commits = history.Commits
+	comparison.Next = history.Next
+	from := comparison.MergeBase
+	if from == "" {
+		from = base
+	}
+	cmd = exec.Command(gitPath, "diff", "--numstat", "-z", "--no-renames", from, head, "--")
+	cmd.Dir = cwd
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (%s).", base, head, repo, err)
+	}
+	comparison.Files = []FileStat{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+		fields := strings.SplitN(entry, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Error when trying to compare %s...%s of repository %s (Invalid git diff output [%s]).", base, head, repo, entry)
+		}
+		stat := FileStat{Path: fields[2]}
+		if fields[0] == "-" && fields[1] == "-" {
+			stat.Binary = true
+		} else {
+			stat.Additions, _ = strconv.Atoi(fields[0])
+			stat.Deletions, _ = strconv.Atoi(fields[1])
+		}
+		comparison.Files = append(comparison.Files, stat)
+		comparison.Stats.Files++
+		comparison.Stats.Additions += stat.Additions
+		comparison.Stats.Deletions += stat.Deletions
+	}
+	return &comparison, nil
+}
+
 func retriever() ContentRetriever {
 	if Retriever == nil {
 		Retriever = &GitContentRetriever{}
@@ -901,6 +2042,47 @@ func GetLogs(repo, hash string, total int, path string) (*GitHistory, error) {
 	return retriever().GetLogs(repo, hash, total, path)
 }
 
+// GetFilteredLogs returns the history of the repository, restricted to the
+// commits matching the given filter. See GitHistory for what is counted in
+// Total.
+func GetFilteredLogs(repo string, filter LogFilter) (*GitHistory, error) {
+	return retriever().GetFilteredLogs(repo, filter)
+}
+
+// SearchCommits returns the commits of the repository matching the query
+// by message, hash prefix or author email.
+func SearchCommits(repo, query string, filter LogFilter) (*GitHistory, error) {
+	return retriever().SearchCommits(repo, query, filter)
+}
+
+func Compare(repo, base, head string, total int) (*Comparison, error) {
+	return retriever().Compare(repo, base, head, total)
+}
+
+func Merge(repo string, m GitMerge) (*Ref, error) {
+	return retriever().Merge(repo, m)
+}
+
+func NewBranch(repo, name, ref string) (*Ref, error) {
+	return retriever().NewBranch(repo, name, ref)
+}
+
+func RemoveBranch(repo, name, oldRef string) error {
+	return retriever().RemoveBranch(repo, name, oldRef)
+}
+
+func NewTag(repo string, t GitTag) (*Ref, error) {
+	return retriever().NewTag(repo, t)
+}
+
+func RemoveTag(repo, name, oldRef string) error {
+	return retriever().RemoveTag(repo, name, oldRef)
+}
+
+func CommitFiles(repo string, c GitFileCommit) (*Ref, error) {
+	return retriever().CommitFiles(repo, c)
+}
+
 type InvalidRepositoryError struct {
 	message string
 }
@@ -908,3 +2090,11 @@ type InvalidRepositoryError struct {
 func (err *InvalidRepositoryError) Error() string {
 	return err.message
 }
+
+type InvalidRefError struct {
+	Name string
+}
+
+func (err *InvalidRefError) Error() string {
+	return fmt.Sprintf("invalid ref %q", err.Name)
+}
@@ -8,6 +8,7 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -43,6 +44,7 @@ func (s *S) SetUpSuite(c *check.C) {
 	c.Assert(err, check.IsNil)
 	config.Set("database:url", "127.0.0.1:27017")
 	config.Set("database:name", "gandalf_repository_tests")
+	config.Set("git:remotes:allow-file", true)
 }
 
 func (s *S) TearDownSuite(c *check.C) {
@@ -2057,7 +2059,7 @@ func (s *S) TestCommitZipIntegrationWhenFileEmpty(c *check.C) {
 		},
 		Branch: "doge_barks",
 	}
-	expectedErr := fmt.Sprintf("Error when trying to commit zip to repository %s, could not extract: zip: not a valid zip file", repo)
+	expectedErr := fmt.Sprintf("Error when trying to commit zip to repository %s, could not extract: %s", repo, multipartzip.ErrUnknownArchive)
 	_, err = CommitZip(repo, file, commit)
 	c.Assert(err.Error(), check.Equals, expectedErr)
 }
@@ -2296,3 +2298,861 @@ func (s *S) TestGetLogsWhenRepoInvalid(c *check.C) {
 	_, err := GetLogs("invalid-repo", "master", 1, "README")
 	c.Assert(err.Error(), check.Equals, expectedErr)
 }
+
+func (s *S) TestGetFilteredLogsWithGrepAndCount(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	content := "will bark"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, content)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	errCreateCommit := CreateCommit(bare, repo, file, "You should read this README")
+	c.Assert(errCreateCommit, check.IsNil)
+	errCreateCommit = CreateCommit(bare, repo, file, "Seriously, read this file!")
+	c.Assert(errCreateCommit, check.IsNil)
+	filter := LogFilter{Ref: "master", Total: 1, Grep: "read", Count: true}
+	history, err := GetFilteredLogs(repo, filter)
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Subject, check.Equals, "Seriously, read this file!")
+	c.Assert(history.Total, check.Equals, 2)
+	c.Assert(history.Next, check.Matches, "[a-f0-9]{40}")
+	filter.Ref = history.Next
+	history, err = GetFilteredLogs(repo, filter)
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Subject, check.Equals, "You should read this README")
+	c.Assert(history.Total, check.Equals, 1)
+	c.Assert(history.Next, check.Equals, "")
+}
+
+func (s *S) TestGetFilteredLogsWithAuthor(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	content := "will bark"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, content)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	testPath := path.Join(bare, repo+".git")
+	err := CreateFile(testPath, file, "much WOW")
+	c.Assert(err, check.IsNil)
+	err = AddAllMock(testPath)
+	c.Assert(err, check.IsNil)
+	cmd := exec.Command("git", "commit", "-m", "cat commit", "--author", "cat <cat@email.com>")
+	cmd.Dir = testPath
+	err = cmd.Run()
+	c.Assert(err, check.IsNil)
+	history, err := GetFilteredLogs(repo, LogFilter{Ref: "master", Total: 10, Author: "cat@email.com", Count: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Author.Name, check.Equals, "cat")
+	c.Assert(history.Commits[0].Committer.Name, check.Equals, "doge")
+	c.Assert(history.Commits[0].Subject, check.Equals, "cat commit")
+	c.Assert(history.Total, check.Equals, 1)
+	history, err = GetFilteredLogs(repo, LogFilter{Ref: "master", Total: 10, Committer: "doge", Until: "1970-01-02"})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 0)
+	c.Assert(history.Total, check.Equals, 0)
+}
+
+func (s *S) TestGetFilteredLogsWithRange(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	content := "will bark"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, content)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	first, err := GetLastHashCommit(bare, repo)
+	c.Assert(err, check.IsNil)
+	for _, subject := range []string{"second", "third", "fourth"} {
+		errCreateCommit := CreateCommit(bare, repo, file, subject)
+		c.Assert(errCreateCommit, check.IsNil)
+	}
+	rangeRef := string(first) + "..master"
+	history, err := GetFilteredLogs(repo, LogFilter{Ref: rangeRef, Total: 2, Count: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 2)
+	c.Assert(history.Commits[0].Subject, check.Equals, "fourth")
+	c.Assert(history.Commits[1].Subject, check.Equals, "third")
+	c.Assert(history.Total, check.Equals, 3)
+	c.Assert(history.Next, check.Matches, string(first)+`\.\.[a-f0-9]{40}`)
+	history, err = GetFilteredLogs(repo, LogFilter{Ref: history.Next, Total: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Subject, check.Equals, "second")
+	c.Assert(history.Next, check.Equals, "")
+}
+
+func (s *S) TestGetFilteredLogsRejectsInvalidRefs(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, "README", "will bark")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	for _, ref := range []string{"--output=/tmp/doge", "-n1", "master...master"} {
+		_, err := GetFilteredLogs(repo, LogFilter{Ref: ref, Total: 1, Count: true})
+		c.Check(err, check.ErrorMatches, `Error when trying to obtain the log of repository gandalf-test-repo \(invalid ref .*`)
+		_, err = SearchCommits(repo, "bark", LogFilter{Ref: ref, Total: 1})
+		c.Check(err, check.ErrorMatches, `Error when trying to search commits of repository gandalf-test-repo \(invalid ref .*`)
+	}
+	_, err := os.Stat("/tmp/doge")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestLogFilterArgs(c *check.C) {
+	filter := LogFilter{
+		Ref:         "v1..master",
+		Path:        "README",
+		Author:      "doge",
+		Committer:   "cat",
+		Since:       "2015-01-01",
+		Until:       "2016-01-01",
+		Grep:        "bark",
+		FirstParent: true,
+	}
+	c.Assert(filter.args(), check.DeepEquals, []string{
+		"--author=doge", "--committer=cat", "--since=2015-01-01", "--until=2016-01-01",
+		"--grep=bark", "--first-parent", "v1..master", "--", "README",
+	})
+	filter = LogFilter{Ref: "master"}
+	c.Assert(filter.args(), check.DeepEquals, []string{"master", "--"})
+}
+
+func (s *S) TestSearchCommits(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	content := "will bark"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, content)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	testPath := path.Join(bare, repo+".git")
+	err := CreateFile(testPath, file, "much WOW")
+	c.Assert(err, check.IsNil)
+	err = AddAllMock(testPath)
+	c.Assert(err, check.IsNil)
+	cmd := exec.Command("git", "commit", "-m", "Fix the barking\n\nThe dog BARKED way too much.", "--author", "cat <cat@email.com>")
+	cmd.Dir = testPath
+	err = cmd.Run()
+	c.Assert(err, check.IsNil)
+	errCreateCommit := CreateCommit(bare, repo, file, "Seriously, bark!")
+	c.Assert(errCreateCommit, check.IsNil)
+	history, err := SearchCommits(repo, "barked", LogFilter{Total: 10})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Subject, check.Equals, "Fix the barking")
+	c.Assert(history.Commits[0].Author.Email, check.Equals, "cat@email.com")
+	c.Assert(history.Next, check.Equals, "")
+	history, err = SearchCommits(repo, "CAT@email", LogFilter{Total: 10})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Subject, check.Equals, "Fix the barking")
+	hash := history.Commits[0].Ref
+	history, err = SearchCommits(repo, hash[:7], LogFilter{Total: 10})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Ref, check.Equals, hash)
+	history, err = SearchCommits(repo, "meow", LogFilter{Total: 10})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 0)
+}
+
+func (s *S) TestSearchCommitsPagination(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	content := "will bark"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, content)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	for _, subject := range []string{"will meow", "will bark again", "will bark once more"} {
+		errCreateCommit := CreateCommit(bare, repo, file, subject)
+		c.Assert(errCreateCommit, check.IsNil)
+	}
+	history, err := SearchCommits(repo, "bark", LogFilter{Ref: "master", Total: 2, Count: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 2)
+	c.Assert(history.Commits[0].Subject, check.Equals, "will bark once more")
+	c.Assert(history.Commits[1].Subject, check.Equals, "will bark again")
+	c.Assert(history.Total, check.Equals, 3)
+	c.Assert(history.Next, check.Matches, "[a-f0-9]{40}")
+	history, err = SearchCommits(repo, "bark", LogFilter{Ref: history.Next, Total: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits, check.HasLen, 1)
+	c.Assert(history.Commits[0].Subject, check.Equals, "will bark")
+	c.Assert(history.Next, check.Equals, "")
+	c.Assert(history.Total, check.Equals, 0)
+}
+
+func (s *S) TestSearchCommitsWhenRepoInvalid(c *check.C) {
+	_, err := SearchCommits("invalid-repo", "bark", LogFilter{})
+	c.Assert(err.Error(), check.Equals, "Error when trying to search commits of repository invalid-repo (Repository does not exist).")
+}
+
+func (s *S) TestSearchCommitsWhenGitError(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, "README", "much WOW")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	tmpdir, err := commandmocker.Error("git", "much error", 1)
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	_, err = SearchCommits(repo, "bark", LogFilter{})
+	c.Assert(err.Error(), check.Equals, "Error when trying to search commits of repository gandalf-test-repo (exit status 1).")
+}
+
+func (s *S) TestCompare(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	content := "will bark"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, content)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	mergeBase, err := GetLastHashCommit(bare, repo)
+	c.Assert(err, check.IsNil)
+	testPath := path.Join(bare, repo+".git")
+	err = CheckoutInNewBranch(testPath, "release/1.0")
+	c.Assert(err, check.IsNil)
+	err = CreateCommit(bare, repo, "CHANGELOG", "fixed the barking")
+	c.Assert(err, check.IsNil)
+	cmd := exec.Command("git", "checkout", "master")
+	cmd.Dir = testPath
+	err = cmd.Run()
+	c.Assert(err, check.IsNil)
+	err = CreateCommit(bare, repo, file, "will bark loudly")
+	c.Assert(err, check.IsNil)
+	err = CreateCommit(bare, repo, "app.py", "print('bark')")
+	c.Assert(err, check.IsNil)
+	head, err := GetLastHashCommit(bare, repo)
+	c.Assert(err, check.IsNil)
+	comparison, err := Compare(repo, "release/1.0", "master", 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(comparison.Base.Name, check.Equals, "release/1.0")
+	c.Assert(comparison.Base.Subject, check.Equals, "fixed the barking")
+	c.Assert(comparison.Head.Name, check.Equals, "master")
+	c.Assert(comparison.Head.Ref, check.Equals, string(head))
+	c.Assert(comparison.MergeBase, check.Equals, string(mergeBase))
+	c.Assert(comparison.Ahead, check.Equals, 2)
+	c.Assert(comparison.Behind, check.Equals, 1)
+	c.Assert(comparison.Commits, check.HasLen, 2)
+	c.Assert(comparison.Commits[0].Subject, check.Equals, "print('bark')")
+	c.Assert(comparison.Commits[1].Subject, check.Equals, "will bark loudly")
+	c.Assert(comparison.Next, check.Equals, "")
+	c.Assert(comparison.Files, check.DeepEquals, []FileStat{
+		{Path: "README", Additions: 1, Deletions: 1},
+		{Path: "app.py", Additions: 1},
+	})
+	c.Assert(comparison.Stats, check.DeepEquals, DiffStats{Files: 2, Additions: 2, Deletions: 1})
+	comparison, err = Compare(repo, string(mergeBase), "master", 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(comparison.Base.Ref, check.Equals, string(mergeBase))
+	c.Assert(comparison.Base.Name, check.Equals, string(mergeBase))
+	c.Assert(comparison.Ahead, check.Equals, 2)
+	c.Assert(comparison.Behind, check.Equals, 0)
+	c.Assert(comparison.Commits, check.HasLen, 1)
+	c.Assert(comparison.Next, check.Equals, string(mergeBase)+".."+comparison.Commits[0].Parent[0])
+}
+
+func (s *S) TestCompareInvalidRef(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, "README", "will bark")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	_, err := Compare(repo, "master", "much-wow", 10)
+	c.Assert(err.Error(), check.Equals, "Error when trying to compare master...much-wow of repository gandalf-test-repo (Invalid ref much-wow).")
+}
+
+func (s *S) TestCompareRefLookingLikeOption(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, "README", "will bark")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	_, err := Compare(repo, "--all", "master", 10)
+	c.Assert(err.Error(), check.Equals, "Error when trying to compare --all...master of repository gandalf-test-repo (Invalid ref --all).")
+	_, err = Compare(repo, "master", "--output=/tmp/gandalf-compare", 10)
+	c.Assert(err.Error(), check.Equals, "Error when trying to compare master...--output=/tmp/gandalf-compare of repository gandalf-test-repo (Invalid ref --output=/tmp/gandalf-compare).")
+	_, err = os.Stat("/tmp/gandalf-compare")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestCompareWhenRepoInvalid(c *check.C) {
+	_, err := Compare("invalid-repo", "master", "release", 10)
+	c.Assert(err.Error(), check.Equals, "Error when trying to compare master...release of repository invalid-repo (Repository does not exist).")
+}
+
+// createMergeTestRepository creates the bare repository gandalf-test-merge,
+// with the branch feature diverging from master. feature changes the file
+// README, while master adds the given file.
+func createMergeTestRepository(c *check.C, masterFile, masterContent string) (string, func()) {
+	work := "gandalf-test-merge-work"
+	cleanUpWork, err := CreateTestRepository(bare, work, "README", "will bark")
+	c.Assert(err, check.IsNil)
+	defer cleanUpWork()
+	testPath := path.Join(bare, work+".git")
+	err = CheckoutInNewBranch(testPath, "feature")
+	c.Assert(err, check.IsNil)
+	err = CreateCommit(bare, work, "README", "will bark loudly")
+	c.Assert(err, check.IsNil)
+	cmd := exec.Command("git", "checkout", "master")
+	cmd.Dir = testPath
+	err = cmd.Run()
+	c.Assert(err, check.IsNil)
+	if masterFile != "" {
+		err = CreateCommit(bare, work, masterFile, masterContent)
+		c.Assert(err, check.IsNil)
+	}
+	repo := "gandalf-test-merge"
+	cleanUp, err := CreateBareClone(bare, work, repo)
+	c.Assert(err, check.IsNil)
+	return repo, cleanUp
+}
+
+func (s *S) TestMergeFastForward(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	ref, err := Merge(repo, GitMerge{Source: "feature", Target: "master", Strategy: FastForwardOnly})
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Name, check.Equals, "master")
+	c.Assert(ref.Ref, check.Equals, feature)
+	ref, err = Merge(repo, GitMerge{Source: "feature", Target: "master", Strategy: FastForwardOnly})
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Ref, check.Equals, feature)
+}
+
+func (s *S) TestMergeFastForwardWhenDiverged(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "Procfile", "web: bark")
+	defer cleanUp()
+	_, err := Merge(repo, GitMerge{Source: "feature", Target: "master", Strategy: FastForwardOnly})
+	c.Assert(err, check.DeepEquals, &MergeConflictError{Source: "feature", Target: "master"})
+	c.Assert(err.Error(), check.Equals, "master cannot be fast-forwarded to feature")
+}
+
+func (s *S) TestMergeCommit(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "Procfile", "web: bark")
+	defer cleanUp()
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	ref, err := Merge(repo, GitMerge{Source: "feature", Target: "master", Author: doge, Committer: doge})
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Name, check.Equals, "master")
+	c.Assert(ref.Subject, check.Equals, "Merge 'feature' into master")
+	c.Assert(ref.Author.Email, check.Equals, "<doge@much.com>")
+	history, err := GetLogs(repo, "master", 1, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits[0].Parent, check.HasLen, 2)
+	contents, err := GetFileContents(repo, "master", "README")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "will bark loudly")
+	contents, err = GetFileContents(repo, "master", "Procfile")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "web: bark")
+}
+
+func (s *S) TestMergeSquash(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "Procfile", "web: bark")
+	defer cleanUp()
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	ref, err := Merge(repo, GitMerge{Source: "feature", Target: "master", Strategy: Squash, Message: "Bark loudly", Author: doge, Committer: doge})
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Subject, check.Equals, "Bark loudly")
+	history, err := GetLogs(repo, "master", 1, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits[0].Parent, check.HasLen, 1)
+	contents, err := GetFileContents(repo, "master", "README")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "will bark loudly")
+}
+
+func (s *S) TestMergeConflict(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "README", "will meow")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	_, err = Merge(repo, GitMerge{Source: "feature", Target: "master", Author: doge, Committer: doge})
+	c.Assert(err, check.DeepEquals, &MergeConflictError{
+		Source: "feature",
+		Target: "master",
+		Conflicts: []MergeConflict{
+			{Paths: []string{"README"}, Type: "contents", Message: "CONFLICT (content): Merge conflict in README"},
+		},
+	})
+	current, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	c.Assert(current, check.Equals, master)
+}
+
+func (s *S) TestMergeInClone(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "Procfile", "web: bark")
+	defer cleanUp()
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	err = mergeInClone(repo, "git", feature, GitMerge{Source: "feature", Target: "master", Message: "Merge", Author: doge, Committer: doge})
+	c.Assert(err, check.IsNil)
+	history, err := GetLogs(repo, "master", 1, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits[0].Subject, check.Equals, "Merge")
+	c.Assert(history.Commits[0].Parent, check.HasLen, 2)
+}
+
+func (s *S) TestMergeInCloneConflict(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "README", "will meow")
+	defer cleanUp()
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	err = mergeInClone(repo, "git", feature, GitMerge{Source: "feature", Target: "master", Strategy: Squash, Author: doge, Committer: doge})
+	c.Assert(err, check.DeepEquals, &MergeConflictError{
+		Source: "feature",
+		Target: "master",
+		Conflicts: []MergeConflict{
+			{Paths: []string{"README"}, Type: "content", Message: "CONFLICT (content): Merge conflict in README"},
+		},
+	})
+}
+
+func (s *S) TestMergeInvalidTarget(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	_, err := Merge(repo, GitMerge{Source: "feature", Target: "release"})
+	c.Assert(err.Error(), check.Equals, "Error when trying to merge feature into release of repository gandalf-test-merge (Invalid branch release).")
+}
+
+func (s *S) TestNewBranch(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	branch, err := NewBranch(repo, "release/1.0", "master")
+	c.Assert(err, check.IsNil)
+	c.Assert(branch.Name, check.Equals, "release/1.0")
+	c.Assert(branch.Ref, check.Equals, master)
+	_, err = NewBranch(repo, "release/1.0", "feature")
+	c.Assert(err, check.Equals, ErrRefAlreadyExists)
+	_, err = NewBranch(repo, "much..wow", "master")
+	c.Assert(err, check.DeepEquals, &InvalidRefError{Name: "much..wow"})
+	_, err = NewBranch(repo, "wow", "much-invalid")
+	c.Assert(err, check.DeepEquals, &InvalidRefError{Name: "much-invalid"})
+}
+
+func (s *S) TestRemoveBranch(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	err = RemoveBranch(repo, "feature", master)
+	c.Assert(err, check.Equals, ErrStaleRef)
+	err = RemoveBranch(repo, "feature", feature)
+	c.Assert(err, check.IsNil)
+	branches, err := GetBranches(repo)
+	c.Assert(err, check.IsNil)
+	c.Assert(branches, check.HasLen, 1)
+	c.Assert(branches[0].Name, check.Equals, "master")
+	err = RemoveBranch(repo, "feature", "")
+	c.Assert(err, check.Equals, ErrRefNotFound)
+}
+
+func (s *S) TestRemoveBranchRejectedByHook(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	hook := path.Join(barePath(repo), "hooks", "pre-receive")
+	err := ioutil.WriteFile(hook, []byte("#!/bin/sh\necho much protected >&2\nexit 1\n"), 0755)
+	c.Assert(err, check.IsNil)
+	err = RemoveBranch(repo, "feature", "")
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Matches, "(?s)Error when trying to remove branch feature of repository gandalf-test-merge .*much protected.*")
+	branches, err := GetBranches(repo)
+	c.Assert(err, check.IsNil)
+	c.Assert(branches, check.HasLen, 2)
+}
+
+func (s *S) TestNewTag(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	tag, err := NewTag(repo, GitTag{Name: "v1.0", Ref: "master"})
+	c.Assert(err, check.IsNil)
+	c.Assert(tag.Name, check.Equals, "v1.0")
+	c.Assert(tag.Ref, check.Equals, master)
+	_, err = NewTag(repo, GitTag{Name: "v1.0", Ref: "feature"})
+	c.Assert(err, check.Equals, ErrRefAlreadyExists)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	tag, err = NewTag(repo, GitTag{Name: "v1.1", Ref: "feature", Message: "much release\n\nvery tag", Tagger: doge})
+	c.Assert(err, check.IsNil)
+	c.Assert(tag.Name, check.Equals, "v1.1")
+	c.Assert(tag.Subject, check.Equals, "much release")
+	c.Assert(tag.Tagger.Name, check.Equals, "doge")
+	c.Assert(tag.Tagger.Email, check.Equals, "<doge@much.com>")
+	feature, err := resolveCommit(barePath(repo), "git", "v1.1")
+	c.Assert(err, check.IsNil)
+	featureBranch, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	c.Assert(feature, check.Equals, featureBranch)
+	c.Assert(tag.Ref, check.Not(check.Equals), feature)
+}
+
+func (s *S) TestRemoveTag(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	tag, err := NewTag(repo, GitTag{Name: "v1.0", Ref: "master"})
+	c.Assert(err, check.IsNil)
+	err = RemoveTag(repo, "v1.0", "a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9")
+	c.Assert(err, check.Equals, ErrStaleRef)
+	err = RemoveTag(repo, "v1.0", tag.Ref)
+	c.Assert(err, check.IsNil)
+	tags, err := GetTags(repo)
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.HasLen, 0)
+	err = RemoveTag(repo, "v1.0", "")
+	c.Assert(err, check.Equals, ErrRefNotFound)
+}
+
+func (s *S) TestCommitFiles(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "app.py", "print('bark')")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	commit := GitFileCommit{
+		GitCommit: GitCommit{Branch: "master", Message: "much files", Author: doge, Committer: doge, Parent: master},
+		Actions: []FileAction{
+			{Action: FileCreate, Path: "/bin/run", Content: []byte("#!/bin/sh\n"), Executable: &[]bool{true}[0]},
+			{Action: FileUpdate, Path: "README", Content: []byte("will bark loudly")},
+			{Action: FileDelete, Path: "app.py"},
+		},
+	}
+	ref, err := CommitFiles(repo, commit)
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Name, check.Equals, "master")
+	c.Assert(ref.Subject, check.Equals, "much files")
+	c.Assert(ref.Author.Email, check.Equals, "<doge@much.com>")
+	history, err := GetLogs(repo, "master", 1, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits[0].Parent, check.DeepEquals, []string{master})
+	contents, err := GetFileContents(repo, "master", "README")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "will bark loudly")
+	contents, err = GetFileContents(repo, "master", "bin/run")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "#!/bin/sh\n")
+	_, err = GetFileContents(repo, "master", "app.py")
+	c.Assert(err, check.NotNil)
+	cmd := exec.Command("git", "ls-tree", "master", "bin/run")
+	cmd.Dir = barePath(repo)
+	out, err := cmd.Output()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(out), check.Matches, "100755 blob .*\tbin/run\n")
+	_, err = CommitFiles(repo, commit)
+	c.Assert(err, check.Equals, ErrStaleRef)
+}
+
+func (s *S) TestCommitFilesMove(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	_, err := CommitFiles(repo, GitFileCommit{
+		GitCommit: GitCommit{Branch: "feature", Message: "move", Author: doge, Committer: doge},
+		Actions: []FileAction{
+			{Action: FileMove, Path: "docs/README", PreviousPath: "README"},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	contents, err := GetFileContents(repo, "feature", "docs/README")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "will bark loudly")
+	_, err = GetFileContents(repo, "feature", "README")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestCommitFilesNewBranch(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	ref, err := CommitFiles(repo, GitFileCommit{
+		GitCommit: GitCommit{Branch: "release/1.0", Message: "release", Author: doge, Committer: doge, Parent: "feature"},
+		Actions:   []FileAction{{Action: FileCreate, Path: "VERSION", Content: []byte("1.0")}},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Name, check.Equals, "release/1.0")
+	history, err := GetLogs(repo, "release/1.0", 1, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(history.Commits[0].Parent, check.DeepEquals, []string{feature})
+}
+
+func (s *S) TestCommitFilesEmptyRepository(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo-empty"
+	cleanUp, errCreate := CreateEmptyTestBareRepository(bare, repo)
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	_, err := CommitFiles(repo, GitFileCommit{
+		GitCommit: GitCommit{Branch: "master", Message: "first", Author: doge, Committer: doge},
+		Actions:   []FileAction{{Action: FileCreate, Path: "README", Content: []byte("much WOW")}},
+	})
+	c.Assert(err, check.IsNil)
+	contents, err := GetFileContents(repo, "master", "README")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(contents), check.Equals, "much WOW")
+}
+
+func (s *S) TestCommitFilesInvalidActions(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	tests := []struct {
+		action FileAction
+		err    error
+	}{
+		{FileAction{Action: FileCreate, Path: "README"}, &InvalidFileActionError{Path: "README", Reason: "file already exists"}},
+		{FileAction{Action: FileUpdate, Path: "*.md"}, &InvalidFileActionError{Path: "*.md", Reason: "file does not exist"}},
+		{FileAction{Action: FileDelete, Path: "../README"}, &InvalidFileActionError{Path: "../README", Reason: "invalid path"}},
+		{FileAction{Action: FileMove, Path: "README.md", PreviousPath: "LICENSE"}, &InvalidFileActionError{Path: "LICENSE", Reason: "file does not exist"}},
+	}
+	for _, t := range tests {
+		_, err = CommitFiles(repo, GitFileCommit{
+			GitCommit: GitCommit{Branch: "master", Message: "much fail", Author: doge, Committer: doge},
+			Actions:   []FileAction{t.action},
+		})
+		c.Assert(err, check.DeepEquals, t.err)
+	}
+	current, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	c.Assert(current, check.Equals, master)
+}
+
+func zipFileHeader(c *check.C, files []multipartzip.File) *multipart.FileHeader {
+	boundary := "muchBOUNDARY"
+	buf, err := multipartzip.CreateZipBuffer(files)
+	c.Assert(err, check.IsNil)
+	reader, writer := io.Pipe()
+	go multipartzip.StreamWriteMultipartForm(map[string]string{}, "muchfile", "muchfile.zip", boundary, writer, buf)
+	form, err := multipart.NewReader(reader, boundary).ReadForm(0)
+	c.Assert(err, check.IsNil)
+	file, err := multipartzip.FileField(form, "muchfile")
+	c.Assert(err, check.IsNil)
+	return file
+}
+
+func listFiles(c *check.C, repo, ref string) []string {
+	cmd := exec.Command("git", "ls-tree", "-r", "--name-only", ref)
+	cmd.Dir = barePath(repo)
+	out, err := cmd.Output()
+	c.Assert(err, check.IsNil)
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func (s *S) TestCommitZipModes(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	tests := []struct {
+		mode     CommitMode
+		delete   []string
+		expected []string
+	}{
+		{CommitOverlay, nil, []string{"Procfile", "README", "much/WOW.txt"}},
+		{CommitReplace, nil, []string{"much/WOW.txt"}},
+		{CommitManifest, []string{"Procfile"}, []string{"README", "much/WOW.txt"}},
+	}
+	for _, t := range tests {
+		repo, cleanUp := createMergeTestRepository(c, "Procfile", "web: bark")
+		file := zipFileHeader(c, []multipartzip.File{{Name: "much/WOW.txt", Body: "Much WOW"}})
+		commit := GitCommit{Message: "will bark", Author: doge, Committer: doge, Branch: "master", Mode: t.mode, Delete: t.delete}
+		_, err := CommitZip(repo, file, commit)
+		c.Check(err, check.IsNil)
+		c.Check(listFiles(c, repo, "master"), check.DeepEquals, t.expected)
+		cleanUp()
+	}
+}
+
+func (s *S) TestCommitZipManifestInvalidPath(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	file := zipFileHeader(c, []multipartzip.File{{Name: "much/WOW.txt", Body: "Much WOW"}})
+	commit := GitCommit{Message: "will bark", Author: doge, Committer: doge, Branch: "master", Mode: CommitManifest, Delete: []string{"LICENSE"}}
+	_, err := CommitZip(repo, file, commit)
+	c.Assert(err, check.ErrorMatches, "Error when trying to commit zip to repository gandalf-test-merge, could not remove files: .*did not match any files.*")
+	c.Assert(listFiles(c, repo, "master"), check.DeepEquals, []string{"README"})
+}
+
+func (s *S) TestCommitZipWithParent(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	master, err := resolveCommit(barePath(repo), "git", "master")
+	c.Assert(err, check.IsNil)
+	feature, err := resolveCommit(barePath(repo), "git", "feature")
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	file := zipFileHeader(c, []multipartzip.File{{Name: "much/WOW.txt", Body: "Much WOW"}})
+	commit := GitCommit{Message: "will bark", Author: doge, Committer: doge, Branch: "master", Parent: feature}
+	_, err = CommitZip(repo, file, commit)
+	c.Assert(err, check.Equals, ErrStaleRef)
+	commit.Parent = master
+	ref, err := CommitZip(repo, file, commit)
+	c.Assert(err, check.IsNil)
+	c.Assert(ref.Ref, check.Not(check.Equals), master)
+}
+
+func (s *S) TestCommitZipTarGz(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	repo, cleanUp := createMergeTestRepository(c, "", "")
+	defer cleanUp()
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "bin/bark", Mode: 0755, Size: 10, Typeflag: tar.TypeReg}), check.IsNil)
+	_, err := tw.Write([]byte("#!/bin/sh\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "bark", Linkname: "bin/bark", Typeflag: tar.TypeSymlink}), check.IsNil)
+	c.Assert(tw.Close(), check.IsNil)
+	c.Assert(gz.Close(), check.IsNil)
+	reader, writer := io.Pipe()
+	go multipartzip.StreamWriteMultipartForm(map[string]string{}, "muchfile", "muchfile", "muchBOUNDARY", writer, buf)
+	form, err := multipart.NewReader(reader, "muchBOUNDARY").ReadForm(0)
+	c.Assert(err, check.IsNil)
+	doge := GitUser{Name: "doge", Email: "doge@much.com"}
+	commit := GitCommit{Message: "will bark", Author: doge, Committer: doge, Branch: "master"}
+	_, err = CommitZip(repo, form.File["muchfile"][0], commit)
+	c.Assert(err, check.IsNil)
+	cmd := exec.Command("git", "ls-tree", "-r", "master")
+	cmd.Dir = barePath(repo)
+	out, err := cmd.Output()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(out), check.Matches, "(?s)100644 blob [0-9a-f]+\tREADME\n120000 blob [0-9a-f]+\tbark\n100755 blob [0-9a-f]+\tbin/bark\n")
+}
+
+func (s *S) TestReadableByAndWritableBy(c *check.C) {
+	r := Repository{Name: "wow", Users: []string{"doge"}, ReadOnlyUsers: []string{"cate"}}
+	c.Assert(r.WritableBy("doge"), check.Equals, true)
+	c.Assert(r.ReadableBy("doge"), check.Equals, true)
+	c.Assert(r.WritableBy("cate"), check.Equals, false)
+	c.Assert(r.ReadableBy("cate"), check.Equals, true)
+	c.Assert(r.ReadableBy("nobody"), check.Equals, false)
+	c.Assert(r.ReadableBy(""), check.Equals, false)
+	r.IsPublic = true
+	c.Assert(r.ReadableBy(""), check.Equals, true)
+	c.Assert(r.WritableBy(""), check.Equals, false)
+	c.Assert(r.WritableBy("nobody"), check.Equals, false)
+}
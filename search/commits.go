@@ -0,0 +1,42 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/tsuru/log"
+)
+
+// CommitResult holds the commits of a repository that match a query.
+type CommitResult struct {
+	Repository string `json:"repository"`
+	repository.GitHistory
+}
+
+// Commits searches the query in the default branch of all the repositories
+// that the given user is allowed to read, returning at most total commits per
+// repository. Only repositories with at least one matching commit are
+// included, and each result can be paginated with repository.SearchCommits,
+// using its Next field as the ref.
+//
+// Unlike Code, commit search doesn't depend on the index.
+func Commits(user, query string, total int) ([]CommitResult, error) {
+	repos, err := repository.GetReadableBy(user)
+	if err != nil {
+		return nil, err
+	}
+	results := []CommitResult{}
+	for _, r := range repos {
+		history, err := repository.SearchCommits(r.Name, query, repository.LogFilter{Ref: "HEAD", Total: total})
+		if err != nil {
+			log.Errorf("search.Commits: could not search commits of repository %q: %s", r.Name, err)
+			continue
+		}
+		if len(history.Commits) > 0 {
+			results = append(results, CommitResult{Repository: r.Name, GitHistory: *history})
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/config"
+)
+
+func bareDir(repo string) (string, error) {
+	location, err := config.GetString("git:bare:location")
+	if err != nil {
+		return "", err
+	}
+	return path.Join(location, repo+".git"), nil
+}
+
+// headCommit returns the commit pointed by the HEAD of the bare repository,
+// or an empty string when the repository has no commits yet.
+func headCommit(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD^{commit}")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", nil
+		}
+		return "", fmt.Errorf("Error when trying to obtain the HEAD of %s (%s).", dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// listTree returns the blob hash of every regular file in the given commit,
+// indexed by path.
+func listTree(dir, commit string) (map[string]string, error) {
+	cmd := exec.Command("git", "ls-tree", "-r", "-z", commit)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error when trying to obtain the tree of %s on %s (%s).", dir, commit, err)
+	}
+	tree := map[string]string{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+		tabbed := strings.SplitN(entry, "\t", 2)
+		if len(tabbed) != 2 {
+			return nil, fmt.Errorf("Error when trying to obtain the tree of %s on %s (Invalid git ls-tree output [%s]).", dir, commit, entry)
+		}
+		meta := strings.Split(tabbed[0], " ")
+		if len(meta) != 3 || meta[1] != "blob" || (meta[0] != "100644" && meta[0] != "100755") {
+			continue
+		}
+		tree[tabbed[1]] = meta[2]
+	}
+	return tree, nil
+}
+
+// readBlobs streams the contents of the given blobs through a single
+// git cat-file process, calling fn for each blob found. On errors, the
+// process is killed, since it may be blocked writing the rest of the blobs.
+func readBlobs(dir string, blobs []string, fn func(blob string, content []byte)) error {
+	if len(blobs) == 0 {
+		return nil
+	}
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(stdout)
+	for range blobs {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("Error when trying to read blobs of %s (%s).", dir, err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("Error when trying to read blobs of %s (Invalid git cat-file output [%s]).", dir, header)
+		}
+		var content bytes.Buffer
+		if _, err = io.CopyN(&content, reader, int64(size)+1); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("Error when trying to read blobs of %s (%s).", dir, err)
+		}
+		if fields[1] == "blob" {
+			fn(fields[0], content.Bytes()[:size])
+		}
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/log"
+)
+
+const (
+	// pendingSuffix is the suffix of the files that mark repositories
+	// waiting to be indexed.
+	pendingSuffix = ".pending"
+
+	pollInterval = 5 * time.Second
+)
+
+// pendingPath returns the path of the file that marks the repository as
+// waiting to be indexed.
+func pendingPath(repo string) (string, error) {
+	location, err := indexLocation()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(location, repo+pendingSuffix), nil
+}
+
+// Queue marks the given repository to be indexed by the worker started by
+// Run. It's used by processes that can't afford to wait for the index to be
+// updated, like the one serving a git push.
+func Queue(repo string) error {
+	p, err := pendingPath(repo)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Pending returns the names of the repositories waiting to be indexed.
+func Pending() ([]string, error) {
+	location, err := indexLocation()
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	err = filepath.Walk(location, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(p, pendingSuffix) {
+			rel, err := filepath.Rel(location, p)
+			if err != nil {
+				return err
+			}
+			repos = append(repos, filepath.ToSlash(strings.TrimSuffix(rel, pendingSuffix)))
+		}
+		return nil
+	})
+	return repos, err
+}
+
+// UpdatePending updates the index of the repositories marked by Queue. The
+// mark is removed before the update, so changes queued while the repository
+// is being indexed are not lost.
+func UpdatePending() error {
+	repos, err := Pending()
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		p, err := pendingPath(repo)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = Update(repo); err != nil {
+			log.Errorf("search.UpdatePending: could not index repository %q: %s", repo, err)
+		}
+	}
+	return nil
+}
+
+// Run updates the index of the queued repositories periodically, until the
+// stop channel is closed.
+func Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := UpdatePending(); err != nil {
+			log.Errorf("search.Run: could not list pending repositories: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
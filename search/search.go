@@ -0,0 +1,404 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package search provides a full-text index of the default branch of the
+// repositories managed by gandalf.
+//
+// The index is stored in the directory defined by the "search:location"
+// setting, with one file per repository. Each file keeps the indexed commit
+// and, for every regular file in its tree, the blob hash and the sorted list
+// of tokens found in the file. Updates are incremental: only blobs that
+// changed since the last indexed commit are read and tokenized again.
+package search
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// maxFileSize is the size of the largest file that will be indexed.
+	maxFileSize = 1 << 20
+
+	maxMatchesPerFile = 10
+	maxSnippetLength  = 200
+	defaultLimit      = 100
+)
+
+var (
+	ErrSearchDisabled = errors.New("code search is disabled, please configure search:location")
+	ErrInvalidQuery   = errors.New("the query must contain at least one word with two or more characters")
+)
+
+// Match represents a line of a file that matches the query.
+type Match struct {
+	Line    int    `json:"line"`
+	Snippet string `json:"snippet"`
+}
+
+// Result represents a file that matches the query.
+type Result struct {
+	Repository string  `json:"repository"`
+	Path       string  `json:"path"`
+	Ref        string  `json:"ref"`
+	Matches    []Match `json:"matches"`
+}
+
+type indexedFile struct {
+	Blob   string
+	Tokens []string
+}
+
+type repositoryIndex struct {
+	Commit string
+	Files  map[string]indexedFile
+}
+
+func indexLocation() (string, error) {
+	location, err := config.GetString("search:location")
+	if err != nil || location == "" {
+		return "", ErrSearchDisabled
+	}
+	return location, nil
+}
+
+// Enabled returns whether code search is configured.
+func Enabled() bool {
+	_, err := indexLocation()
+	return err == nil
+}
+
+func indexPath(repo string) (string, error) {
+	location, err := indexLocation()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(location, repo+".idx"), nil
+}
+
+func loadIndex(repo string) (*repositoryIndex, error) {
+	p, err := indexPath(repo)
+	if err != nil {
+		return nil, err
+	}
+	idx := repositoryIndex{Files: map[string]indexedFile{}}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &idx, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&idx); err != nil {
+		return nil, err
+	}
+	if idx.Files == nil {
+		idx.Files = map[string]indexedFile{}
+	}
+	return &idx, nil
+}
+
+// saveIndex writes the index of the repository atomically, so concurrent
+// searches never see a partially written file.
+func saveIndex(repo string, idx *repositoryIndex) error {
+	p, err := indexPath(repo)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(p), path.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = gob.NewEncoder(tmp).Encode(idx); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Update brings the index of the given repository up to date with its
+// default branch, reading only the blobs that changed since the last update.
+func Update(repo string) error {
+	idx, err := loadIndex(repo)
+	if err != nil {
+		return err
+	}
+	dir, err := bareDir(repo)
+	if err != nil {
+		return err
+	}
+	commit, err := headCommit(dir)
+	if err != nil {
+		return err
+	}
+	if commit == idx.Commit {
+		return nil
+	}
+	tree := map[string]string{}
+	if commit != "" {
+		if tree, err = listTree(dir, commit); err != nil {
+			return err
+		}
+	}
+	files := make(map[string]indexedFile, len(tree))
+	pending := map[string][]string{}
+	for p, blob := range tree {
+		if old, ok := idx.Files[p]; ok && old.Blob == blob {
+			files[p] = old
+			continue
+		}
+		pending[blob] = append(pending[blob], p)
+	}
+	blobs := make([]string, 0, len(pending))
+	for blob := range pending {
+		blobs = append(blobs, blob)
+	}
+	err = readBlobs(dir, blobs, func(blob string, content []byte) {
+		tokens := tokenize(content)
+		for _, p := range pending[blob] {
+			files[p] = indexedFile{Blob: blob, Tokens: tokens}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Indexed %d files of repository %q at %s", len(blobs), repo, commit)
+	return saveIndex(repo, &repositoryIndex{Commit: commit, Files: files})
+}
+
+// Remove removes the index of the given repository.
+func Remove(repo string) error {
+	p, err := indexPath(repo)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	repository.OnRemove(removeRepository)
+	repository.OnRename(renameRepository)
+}
+
+// removeRepository removes the index of a repository that is being removed,
+// along with its mark in the queue, when the search is enabled.
+func removeRepository(repo string) error {
+	if !Enabled() {
+		return nil
+	}
+	if err := Remove(repo); err != nil {
+		return err
+	}
+	p, err := pendingPath(repo)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// renameRepository removes the index of a repository that was renamed and
+// queues the indexing of its new name, when the search is enabled.
+func renameRepository(oldName, newName string) error {
+	if !Enabled() {
+		return nil
+	}
+	if err := removeRepository(oldName); err != nil {
+		return err
+	}
+	return Queue(newName)
+}
+
+// IndexAll updates the index of every repository in the database.
+func IndexAll() error {
+	if !Enabled() {
+		return ErrSearchDisabled
+	}
+	var repos []repository.Repository
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.Repository().Find(nil).Select(bson.M{"_id": 1}).All(&repos); err != nil {
+		return err
+	}
+	for _, r := range repos {
+		if err := Update(r.Name); err != nil {
+			log.Errorf("search.IndexAll: could not index repository %q: %s", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// Code searches the query in all the repositories that the given user is
+// allowed to read, returning at most limit results.
+func Code(user, query string, limit int) ([]Result, error) {
+	if !Enabled() {
+		return nil, ErrSearchDisabled
+	}
+	repos, err := repository.GetReadableBy(user)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(repos))
+	for i, r := range repos {
+		names[i] = r.Name
+	}
+	return search(names, query, limit)
+}
+
+func search(repos []string, query string, limit int) ([]Result, error) {
+	terms := tokenize([]byte(query))
+	if len(terms) == 0 {
+		return nil, ErrInvalidQuery
+	}
+	if limit < 1 {
+		limit = defaultLimit
+	}
+	needle := strings.ToLower(query)
+	results := []Result{}
+	for _, repo := range repos {
+		idx, err := loadIndex(repo)
+		if err != nil {
+			log.Errorf("search: could not load index of repository %q: %s", repo, err)
+			continue
+		}
+		candidates := map[string][]string{}
+		var blobs []string
+		for p, file := range idx.Files {
+			if !containsAll(file.Tokens, terms) {
+				continue
+			}
+			if _, ok := candidates[file.Blob]; !ok {
+				blobs = append(blobs, file.Blob)
+			}
+			candidates[file.Blob] = append(candidates[file.Blob], p)
+		}
+		if len(blobs) == 0 {
+			continue
+		}
+		dir, err := bareDir(repo)
+		if err != nil {
+			return nil, err
+		}
+		var repoResults []Result
+		err = readBlobs(dir, blobs, func(blob string, content []byte) {
+			matches := matchLines(content, needle)
+			if len(matches) == 0 {
+				return
+			}
+			for _, p := range candidates[blob] {
+				repoResults = append(repoResults, Result{
+					Repository: repo,
+					Path:       p,
+					Ref:        idx.Commit,
+					Matches:    matches,
+				})
+			}
+		})
+		if err != nil {
+			log.Errorf("search: could not read blobs of repository %q: %s", repo, err)
+			continue
+		}
+		sort.Sort(byPath(repoResults))
+		results = append(results, repoResults...)
+		if len(results) >= limit {
+			return results[:limit], nil
+		}
+	}
+	return results, nil
+}
+
+// tokenize returns the sorted list of distinct lowercase words in the
+// content. Words are sequences of letters, digits and underscores with at
+// least two characters. Binary and very large files have no tokens.
+func tokenize(content []byte) []string {
+	if len(content) > maxFileSize || isBinary(content) {
+		return nil
+	}
+	seen := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(string(content)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) > -1
+}
+
+// containsAll checks whether every term is a prefix of at least one of the
+// sorted tokens.
+func containsAll(tokens, terms []string) bool {
+	for _, term := range terms {
+		i := sort.SearchStrings(tokens, term)
+		if i == len(tokens) || !strings.HasPrefix(tokens[i], term) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchLines(content []byte, needle string) []Match {
+	var matches []Match
+	for i, line := range strings.Split(string(content), "\n") {
+		if !strings.Contains(strings.ToLower(line), needle) {
+			continue
+		}
+		snippet := strings.TrimSpace(line)
+		if len(snippet) > maxSnippetLength {
+			snippet = snippet[:maxSnippetLength]
+		}
+		matches = append(matches, Match{Line: i + 1, Snippet: snippet})
+		if len(matches) == maxMatchesPerFile {
+			break
+		}
+	}
+	return matches
+}
+
+type byPath []Result
+
+func (r byPath) Len() int           { return len(r) }
+func (r byPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
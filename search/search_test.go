@@ -0,0 +1,212 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/repository"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	bareDir  string
+	indexDir string
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "gandalf_search_tests")
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	var err error
+	s.bareDir, err = ioutil.TempDir("", "gandalf_search_bare")
+	c.Assert(err, check.IsNil)
+	s.indexDir, err = ioutil.TempDir("", "gandalf_search_index")
+	c.Assert(err, check.IsNil)
+	config.Set("git:bare:location", s.bareDir)
+	config.Set("search:location", s.indexDir)
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.RemoveAll(s.bareDir)
+	os.RemoveAll(s.indexDir)
+	config.Unset("search:location")
+}
+
+func (s *S) TestTokenize(c *check.C) {
+	tokens := tokenize([]byte("database:url: 127.0.0.1\nDatabase:name = gandalf_db; x"))
+	c.Assert(tokens, check.DeepEquals, []string{"127", "database", "gandalf_db", "name", "url"})
+}
+
+func (s *S) TestTokenizeBinary(c *check.C) {
+	c.Assert(tokenize([]byte{'a', 'b', 0, 'c', 'd'}), check.IsNil)
+}
+
+func (s *S) TestContainsAll(c *check.C) {
+	tokens := []string{"database", "name", "url"}
+	c.Assert(containsAll(tokens, []string{"database", "url"}), check.Equals, true)
+	c.Assert(containsAll(tokens, []string{"data", "na"}), check.Equals, true)
+	c.Assert(containsAll(tokens, []string{"database", "port"}), check.Equals, false)
+	c.Assert(containsAll(nil, []string{"database"}), check.Equals, false)
+}
+
+func (s *S) TestEnabled(c *check.C) {
+	c.Assert(Enabled(), check.Equals, true)
+	config.Unset("search:location")
+	c.Assert(Enabled(), check.Equals, false)
+}
+
+func (s *S) TestCodeWhenDisabled(c *check.C) {
+	config.Unset("search:location")
+	_, err := Code("user", "database", 0)
+	c.Assert(err, check.Equals, ErrSearchDisabled)
+}
+
+func (s *S) TestSearchInvalidQuery(c *check.C) {
+	_, err := search([]string{"repo"}, "a ?", 0)
+	c.Assert(err, check.Equals, ErrInvalidQuery)
+}
+
+func (s *S) TestUpdateAndSearch(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "myapp", "app.conf", "host: localhost\ndatabase:url: 127.0.0.1", "etc")
+	defer cleanUp()
+	c.Assert(err, check.IsNil)
+	err = Update("myapp")
+	c.Assert(err, check.IsNil)
+	hash, err := repository.GetLastHashCommit(s.bareDir, "myapp")
+	c.Assert(err, check.IsNil)
+	results, err := search([]string{"myapp"}, "Database:URL", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.DeepEquals, []Result{
+		{Repository: "myapp", Path: "app.conf", Ref: string(hash), Matches: []Match{{Line: 2, Snippet: "database:url: 127.0.0.1"}}},
+		{Repository: "myapp", Path: "etc/app.conf", Ref: string(hash), Matches: []Match{{Line: 2, Snippet: "database:url: 127.0.0.1"}}},
+	})
+	results, err = search([]string{"myapp"}, "database:url", 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	results, err = search([]string{"myapp"}, "database:port", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 0)
+}
+
+func (s *S) TestQueueAndUpdatePending(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "myapp", "app.conf", "database:url: 127.0.0.1")
+	defer cleanUp()
+	c.Assert(err, check.IsNil)
+	err = Queue("myapp")
+	c.Assert(err, check.IsNil)
+	err = Queue("team/otherapp")
+	c.Assert(err, check.IsNil)
+	pending, err := Pending()
+	c.Assert(err, check.IsNil)
+	c.Assert(pending, check.DeepEquals, []string{"myapp", "team/otherapp"})
+	err = UpdatePending()
+	c.Assert(err, check.IsNil)
+	pending, err = Pending()
+	c.Assert(err, check.IsNil)
+	c.Assert(pending, check.HasLen, 0)
+	results, err := search([]string{"myapp"}, "database", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+}
+
+func (s *S) TestQueueWhenDisabled(c *check.C) {
+	config.Unset("search:location")
+	c.Assert(Queue("myapp"), check.Equals, ErrSearchDisabled)
+}
+
+func (s *S) TestUpdateIsIncremental(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "myapp", "app.conf", "database:url: 127.0.0.1")
+	defer cleanUp()
+	c.Assert(err, check.IsNil)
+	err = Update("myapp")
+	c.Assert(err, check.IsNil)
+	before, err := loadIndex("myapp")
+	c.Assert(err, check.IsNil)
+	testPath := path.Join(s.bareDir, "myapp.git")
+	err = repository.CreateFile(testPath, "Procfile", "web: ./myapp --database-url=$DATABASE_URL")
+	c.Assert(err, check.IsNil)
+	err = os.Remove(path.Join(testPath, "app.conf"))
+	c.Assert(err, check.IsNil)
+	err = repository.MakeCommit(testPath, "use env")
+	c.Assert(err, check.IsNil)
+	err = Update("myapp")
+	c.Assert(err, check.IsNil)
+	after, err := loadIndex("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(after.Commit, check.Not(check.Equals), before.Commit)
+	c.Assert(after.Files, check.HasLen, 1)
+	results, err := search([]string{"myapp"}, "database:url", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 0)
+	results, err = search([]string{"myapp"}, "database_url", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	c.Assert(results[0].Path, check.Equals, "Procfile")
+	c.Assert(results[0].Ref, check.Equals, after.Commit)
+}
+
+func (s *S) TestUpdateEmptyRepository(c *check.C) {
+	cleanUp, err := repository.CreateEmptyTestBareRepository(s.bareDir, "empty")
+	defer cleanUp()
+	c.Assert(err, check.IsNil)
+	err = Update("empty")
+	c.Assert(err, check.IsNil)
+	idx, err := loadIndex("empty")
+	c.Assert(err, check.IsNil)
+	c.Assert(idx.Commit, check.Equals, "")
+	c.Assert(idx.Files, check.HasLen, 0)
+}
+
+func (s *S) TestRemove(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "ns/myapp", "app.conf", "database:url: 127.0.0.1")
+	defer cleanUp()
+	c.Assert(err, check.IsNil)
+	err = Update("ns/myapp")
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(path.Join(s.indexDir, "ns", "myapp.idx"))
+	c.Assert(err, check.IsNil)
+	err = Remove("ns/myapp")
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(path.Join(s.indexDir, "ns", "myapp.idx"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	err = Remove("ns/myapp")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestRepositoryListeners(c *check.C) {
+	cleanUp, err := repository.CreateTestRepository(s.bareDir, "myapp", "app.conf", "database:url: 127.0.0.1")
+	defer cleanUp()
+	c.Assert(err, check.IsNil)
+	err = Update("myapp")
+	c.Assert(err, check.IsNil)
+	err = renameRepository("myapp", "newapp")
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(path.Join(s.indexDir, "myapp.idx"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	pending, err := Pending()
+	c.Assert(err, check.IsNil)
+	c.Assert(pending, check.DeepEquals, []string{"newapp"})
+	err = removeRepository("newapp")
+	c.Assert(err, check.IsNil)
+	pending, err = Pending()
+	c.Assert(err, check.IsNil)
+	c.Assert(pending, check.HasLen, 0)
+	config.Unset("search:location")
+	c.Assert(removeRepository("newapp"), check.IsNil)
+	c.Assert(renameRepository("newapp", "myapp"), check.IsNil)
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/lfs"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/search"
+	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/log"
+	"golang.org/x/crypto/ssh"
+)
+
+func denied(msg string) error {
+	return fmt.Errorf("Permission denied.\n%s", msg)
+}
+
+// gitProtocolRegexp validates the GIT_PROTOCOL variable sent by clients,
+// like "version=2".
+var gitProtocolRegexp = regexp.MustCompile(`^[\w.:=-]*$`)
+
+// handleSession runs the command of the first exec request of the session,
+// sending its exit status to the client. The GIT_PROTOCOL variable, which
+// enables the version 2 of the git protocol, is passed to the command. Other
+// requests, like shells, terminals and other variables, are refused.
+func handleSession(ext map[string]string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	s := &session{ext: ext, stdin: ch, stdout: ch, stderr: ch.Stderr()}
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var payload struct{ Name, Value string }
+			ok := ssh.Unmarshal(req.Payload, &payload) == nil &&
+				payload.Name == "GIT_PROTOCOL" && gitProtocolRegexp.MatchString(payload.Value)
+			if ok {
+				s.protocol = payload.Value
+			}
+			req.Reply(ok, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			status := struct{ Status uint32 }{s.run(payload.Command)}
+			ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// session runs a command for the user or deploy key identified by the
+// extensions of the permissions of the connection.
+type session struct {
+	ext map[string]string
+	// protocol is the GIT_PROTOCOL variable sent by the client.
+	protocol string
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+}
+
+// run runs the command, returning its exit status. Errors that don't come
+// from git are written to stderr.
+func (s *session) run(cmd string) uint32 {
+	err := s.execute(cmd)
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitStatus(exitErr.Sys().(syscall.WaitStatus))
+	}
+	log.Errorf("sshd: %q: %s", cmd, err)
+	fmt.Fprintln(s.stderr, err)
+	return 1
+}
+
+// exitStatus returns the exit status sent to the client for a command that
+// failed. Commands killed by a signal get 128 plus the signal number, like
+// in shells.
+func exitStatus(status syscall.WaitStatus) uint32 {
+	if status.Signaled() {
+		return 128 + uint32(status.Signal())
+	}
+	return uint32(status.ExitStatus())
+}
+
+func (s *session) execute(cmd string) error {
+	if fp := s.ext[deployKeyExtension]; fp != "" {
+		return s.executeDeployKey(fp, cmd)
+	}
+	username := s.ext[userExtension]
+	if fp := s.ext[fingerprintExtension]; fp != "" {
+		if err := user.UseKey(username, fp); err != nil {
+			return denied(err.Error())
+		}
+	}
+	if strings.HasPrefix(cmd, "git-lfs-authenticate ") {
+		return s.lfsAuthenticate(username, cmd)
+	}
+	command, name, err := repository.ParseGitCommand(cmd)
+	if err != nil {
+		return err
+	}
+	repo, err := repository.Get(name)
+	if err != nil {
+		return err
+	}
+	if err = user.CheckAccess(username, command, &repo); err != nil {
+		return err
+	}
+	env := "TSURU_USER=" + username
+	if command == "git-receive-pack" {
+		return s.push(repo.Name, env)
+	}
+	return s.git(command, repo.Name, env)
+}
+
+// executeDeployKey runs the command for the deploy key with the given
+// fingerprint. See user.Key.CheckAccess for what deploy keys can do.
+func (s *session) executeDeployKey(fp, cmd string) error {
+	key, err := user.UseDeployKey(fp)
+	if err != nil {
+		return denied(err.Error())
+	}
+	if strings.HasPrefix(cmd, "git-lfs-authenticate ") {
+		_, err = key.CheckAccess("git-lfs-authenticate", "")
+		return err
+	}
+	command, name, err := repository.ParseGitCommand(cmd)
+	if err != nil {
+		return err
+	}
+	repo, err := key.CheckAccess(command, name)
+	if err != nil {
+		return err
+	}
+	env := "GANDALF_DEPLOY_KEY=" + key.Name
+	if command == "git-receive-pack" {
+		return s.push(repo.Name, env)
+	}
+	return s.git(command, repo.Name, env)
+}
+
+// lfsAuthenticate answers the git-lfs-authenticate command, writing the LFS
+// endpoint of the repository and a token that identifies the user in it.
+func (s *session) lfsAuthenticate(username, cmd string) error {
+	name, operation, err := repository.ParseLFSCommand(cmd)
+	if err != nil {
+		return err
+	}
+	repo, err := repository.Get(name)
+	if err != nil {
+		return err
+	}
+	if err = user.CheckLFSAccess(username, operation, &repo); err != nil {
+		return err
+	}
+	auth, err := lfs.Authenticate(username, repo.Name, operation)
+	if err != nil {
+		return fmt.Errorf("Could not authenticate to git lfs: %s", err)
+	}
+	return json.NewEncoder(s.stdout).Encode(auth)
+}
+
+// git runs the git command in the bare repository, adding env to its
+// environment.
+func (s *session) git(command, name, env string) error {
+	location, err := config.GetString("git:bare:location")
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(command, path.Join(location, name+".git"))
+	cmd.Env = append(os.Environ(), env)
+	if s.protocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+s.protocol)
+	}
+	cmd.Stdout = s.stdout
+	cmd.Stderr = s.stderr
+	// Clients don't always close their side of the channel when git
+	// finishes, so stdin is copied without waiting for it.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	log.Debugf("sshd: executing %s %s", command, name)
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, s.stdin)
+		stdin.Close()
+	}()
+	return cmd.Wait()
+}
+
+// push runs git-receive-pack in the repository, then queues the update of
+// its code search index and its push mirrors, which are pushed by the mirror
+// worker.
+func (s *session) push(name, env string) error {
+	if err := s.git("git-receive-pack", name, env); err != nil {
+		return err
+	}
+	if search.Enabled() {
+		if err := search.Queue(name); err != nil {
+			log.Errorf("sshd: could not queue search index update of %q: %s", name, err)
+		}
+	}
+	if err := repository.QueuePushMirrors(name); err != nil {
+		log.Errorf("sshd: could not queue push mirrors of %q: %s", name, err)
+	}
+	return nil
+}
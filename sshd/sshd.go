@@ -0,0 +1,202 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sshd is an SSH server that serves git repositories, as an
+// alternative to the system OpenSSH with the authorized_keys file and the
+// git wrapper.
+//
+// Clients authenticate with the keys and deploy keys stored in the database,
+// or with certificates signed by the trusted certificate authorities, and can
+// only run git-upload-pack, git-receive-pack, git-upload-archive and
+// git-lfs-authenticate, with the same permissions enforced by the git wrapper.
+package sshd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions of the permissions of connections, identifying who connected.
+const (
+	userExtension        = "user"
+	fingerprintExtension = "fingerprint"
+	deployKeyExtension   = "deploy-key"
+)
+
+// Enabled returns whether the embedded SSH server is enabled, by setting the
+// address it listens on in ssh:listen.
+func Enabled() bool {
+	listen, _ := config.GetString("ssh:listen")
+	return listen != ""
+}
+
+// hostKey loads the host key of the server from the PEM file in
+// ssh:host-key, generating an ECDSA key in it when the file doesn't exist.
+func hostKey() (ssh.Signer, error) {
+	path, err := config.GetString("ssh:host-key")
+	if err != nil {
+		return nil, errors.New("You should configure a ssh:host-key for the SSH server.")
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = generateHostKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func generateHostKey(path string) ([]byte, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return data, ioutil.WriteFile(path, data, 0600)
+}
+
+// authenticate identifies the user or deploy key of the public key offered
+// by the client, storing it in the extensions of the permissions of the
+// connection.
+func authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		username, _, err := user.CertificateUser(cert)
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Permissions{
+			CriticalOptions: cert.CriticalOptions,
+			Extensions:      map[string]string{userExtension: username},
+		}, nil
+	}
+	k, err := user.KeyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.Repository != "" {
+		return &ssh.Permissions{Extensions: map[string]string{deployKeyExtension: k.Fingerprint}}, nil
+	}
+	return &ssh.Permissions{Extensions: map[string]string{
+		userExtension:        k.UserName,
+		fingerprintExtension: k.Fingerprint,
+	}}, nil
+}
+
+// defaultHandshakeTimeout is the time clients have to authenticate when
+// ssh:handshake-timeout isn't set.
+const defaultHandshakeTimeout = 30 * time.Second
+
+// Server is the embedded SSH server.
+type Server struct {
+	config           *ssh.ServerConfig
+	handshakeTimeout time.Duration
+	// conns limits the number of connections handled at the same time,
+	// when it's not nil.
+	conns chan struct{}
+}
+
+// NewServer returns a server with the configured host key, handshake timeout
+// and connection limit.
+func NewServer() (*Server, error) {
+	key, err := hostKey()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ServerConfig{PublicKeyCallback: authenticate}
+	cfg.AddHostKey(key)
+	server := &Server{config: cfg, handshakeTimeout: defaultHandshakeTimeout}
+	if timeout, err := config.GetInt("ssh:handshake-timeout"); err == nil && timeout > 0 {
+		server.handshakeTimeout = time.Duration(timeout) * time.Second
+	}
+	if max, err := config.GetInt("ssh:max-connections"); err == nil && max > 0 {
+		server.conns = make(chan struct{}, max)
+	}
+	return server, nil
+}
+
+// Serve handles the connections accepted by the listener, until it's closed.
+// Connections above the limit are closed right away.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if s.conns != nil {
+			select {
+			case s.conns <- struct{}{}:
+			default:
+				log.Errorf("sshd: refusing connection from %s: too many connections", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(nConn net.Conn) {
+	defer nConn.Close()
+	if s.conns != nil {
+		defer func() { <-s.conns }()
+	}
+	// Clients that don't finish the handshake would keep the connection
+	// open forever.
+	nConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		log.Debugf("sshd: handshake with %s failed: %s", nConn.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	nConn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			log.Errorf("sshd: could not accept channel: %s", err)
+			continue
+		}
+		go handleSession(conn.Permissions.Extensions, ch, requests)
+	}
+}
+
+// ListenAndServe starts the server on the address in ssh:listen.
+func ListenAndServe() error {
+	addr, err := config.GetString("ssh:listen")
+	if err != nil {
+		return err
+	}
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(l)
+}
@@ -0,0 +1,330 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	tmpdir   string
+	listener net.Listener
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "gandalf_sshd_tests")
+	s.tmpdir, err = ioutil.TempDir("", "gandalf_sshd")
+	c.Assert(err, check.IsNil)
+	config.Set("git:bare:location", s.tmpdir)
+	config.Set("ssh:listen", "127.0.0.1:0")
+	config.Set("ssh:host-key", path.Join(s.tmpdir, "host_key"))
+	server, err := NewServer()
+	c.Assert(err, check.IsNil)
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	go server.Serve(s.listener)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	s.listener.Close()
+	os.RemoveAll(s.tmpdir)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.User().Database.DropDatabase()
+}
+
+// newSigner generates a key, returning its signer and its authorized_keys
+// line.
+func newSigner(c *check.C) (ssh.Signer, string) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	signer, err := ssh.NewSignerFromKey(private)
+	c.Assert(err, check.IsNil)
+	return signer, string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+// dial connects to the test server with the given key.
+func (s *S) dial(signer ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.listener.Addr().String(), &ssh.ClientConfig{
+		User: "git",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	})
+}
+
+// runCommand runs the command in a new session of the client, returning its
+// stdout and stderr.
+func runCommand(c *check.C, client *ssh.Client, cmd string) (string, string, error) {
+	session, err := client.NewSession()
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(cmd)
+	return stdout.String(), stderr.String(), err
+}
+
+func (s *S) TestEnabled(c *check.C) {
+	c.Assert(Enabled(), check.Equals, true)
+	config.Set("ssh:listen", "")
+	defer config.Set("ssh:listen", "127.0.0.1:0")
+	c.Assert(Enabled(), check.Equals, false)
+}
+
+func (s *S) TestHostKeyIsGeneratedOnce(c *check.C) {
+	keyPath := path.Join(s.tmpdir, "other_host_key")
+	config.Set("ssh:host-key", keyPath)
+	defer config.Set("ssh:host-key", path.Join(s.tmpdir, "host_key"))
+	key, err := hostKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(key.PublicKey().Type(), check.Equals, "ecdsa-sha2-nistp256")
+	info, err := os.Stat(keyPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+	other, err := hostKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(other.PublicKey().Marshal(), check.DeepEquals, key.PublicKey().Marshal())
+}
+
+func (s *S) TestHostKeyNotConfigured(c *check.C) {
+	config.Unset("ssh:host-key")
+	defer config.Set("ssh:host-key", path.Join(s.tmpdir, "host_key"))
+	_, err := hostKey()
+	c.Assert(err, check.ErrorMatches, "You should configure a ssh:host-key for the SSH server.")
+}
+
+// serve starts a server with the current settings, returning its address
+// and a function that stops it.
+func serve(c *check.C) (string, func()) {
+	server, err := NewServer()
+	c.Assert(err, check.IsNil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	go server.Serve(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func (s *S) TestHandshakeTimeout(c *check.C) {
+	config.Set("ssh:handshake-timeout", 1)
+	defer config.Unset("ssh:handshake-timeout")
+	addr, stop := serve(c)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	c.Assert(err, check.IsNil)
+	c.Assert(time.Since(start) < 5*time.Second, check.Equals, true)
+}
+
+func (s *S) TestMaxConnections(c *check.C) {
+	config.Set("ssh:max-connections", 1)
+	defer config.Unset("ssh:max-connections")
+	addr, stop := serve(c)
+	defer stop()
+	first, err := net.Dial("tcp", addr)
+	c.Assert(err, check.IsNil)
+	defer first.Close()
+	banner := make([]byte, 4)
+	_, err = io.ReadFull(first, banner)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(banner), check.Equals, "SSH-")
+	second, err := net.Dial("tcp", addr)
+	c.Assert(err, check.IsNil)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := ioutil.ReadAll(second)
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.HasLen, 0)
+	first.Close()
+	var third net.Conn
+	for i := 0; i < 50; i++ {
+		third, err = net.Dial("tcp", addr)
+		c.Assert(err, check.IsNil)
+		third.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err = io.ReadFull(third, banner); err == nil {
+			break
+		}
+		third.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(err, check.IsNil)
+	third.Close()
+}
+
+func (s *S) TestSessionRefusesInvalidCommands(c *check.C) {
+	var stderr bytes.Buffer
+	session := &session{ext: map[string]string{userExtension: "gopher"}, stderr: &stderr}
+	c.Assert(session.run("rm -rf /"), check.Equals, uint32(1))
+	c.Assert(stderr.String(), check.Equals, repository.ErrInvalidCommand.Error()+"\n")
+}
+
+func (s *S) TestExitStatus(c *check.C) {
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	c.Assert(err, check.FitsTypeOf, &exec.ExitError{})
+	c.Assert(exitStatus(err.(*exec.ExitError).Sys().(syscall.WaitStatus)), check.Equals, uint32(3))
+	err = exec.Command("sh", "-c", "kill -9 $$").Run()
+	c.Assert(err, check.FitsTypeOf, &exec.ExitError{})
+	c.Assert(exitStatus(err.(*exec.ExitError).Sys().(syscall.WaitStatus)), check.Equals, uint32(137))
+}
+
+func (s *S) TestSessionRunsGit(c *check.C) {
+	bare := path.Join(s.tmpdir, "bare.git")
+	err := exec.Command("git", "init", "--bare", bare).Run()
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(bare)
+	var stdout, stderr bytes.Buffer
+	session := &session{stdin: strings.NewReader("0000"), stdout: &stdout, stderr: &stderr}
+	err = session.git("git-upload-pack", "bare", "TSURU_USER=gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "0000")
+}
+
+func (s *S) TestSessionPassesGitProtocol(c *check.C) {
+	bare := path.Join(s.tmpdir, "bare.git")
+	err := exec.Command("git", "init", "--bare", bare).Run()
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(bare)
+	var stdout bytes.Buffer
+	session := &session{protocol: "version=2", stdin: strings.NewReader("0000"), stdout: &stdout, stderr: &bytes.Buffer{}}
+	err = session.git("git-upload-pack", "bare", "TSURU_USER=gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, "(?s)000eversion 2\n.*")
+}
+
+func (s *S) TestUnknownKeyIsRefused(c *check.C) {
+	signer, _ := newSigner(c)
+	_, err := s.dial(signer)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestUploadPack(c *check.C) {
+	signer, key := newSigner(c)
+	_, err := user.New("gopher", map[string]string{"my-key": key})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("gopher")
+	_, err = repository.New("myrepo", []string{"gopher"}, nil, false)
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("myrepo")
+	client, err := s.dial(signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	stdout, _, err := runCommand(c, client, "git-upload-pack 'myrepo.git'")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "0000")
+	keys, err := user.ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys[0].LastUsedAt.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestPermissionDenied(c *check.C) {
+	signer, key := newSigner(c)
+	_, err := user.New("gopher", map[string]string{"my-key": key})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("gopher")
+	_, err = repository.New("myrepo", []string{"glenda"}, []string{"gopher"}, false)
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("myrepo")
+	client, err := s.dial(signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	_, stderr, err := runCommand(c, client, "git-receive-pack 'myrepo.git'")
+	c.Assert(err, check.FitsTypeOf, &ssh.ExitError{})
+	c.Assert(err.(*ssh.ExitError).ExitStatus(), check.Equals, 1)
+	c.Assert(stderr, check.Equals, "Permission denied.\nYou don't have access to write in this repository, or it is a mirror or being imported.\n")
+	_, stderr, err = runCommand(c, client, "git-upload-pack 'otherrepo.git'")
+	c.Assert(err, check.NotNil)
+	c.Assert(stderr, check.Equals, "repository not found\n")
+}
+
+func (s *S) TestCertificate(c *check.C) {
+	ca, _ := newSigner(c)
+	config.Set("ssh-ca:keys", []interface{}{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))})
+	defer config.Unset("ssh-ca")
+	_, err := user.New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("gopher")
+	_, err = repository.New("myrepo", []string{"gopher"}, nil, false)
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("myrepo")
+	signer, _ := newSigner(c)
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"gopher"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	c.Assert(err, check.IsNil)
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	c.Assert(err, check.IsNil)
+	client, err := s.dial(certSigner)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	stdout, _, err := runCommand(c, client, "git-upload-pack 'myrepo.git'")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "0000")
+	other, _ := newSigner(c)
+	err = cert.SignCert(rand.Reader, other)
+	c.Assert(err, check.IsNil)
+	certSigner, err = ssh.NewCertSigner(cert, signer)
+	c.Assert(err, check.IsNil)
+	_, err = s.dial(certSigner)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestDeployKey(c *check.C) {
+	signer, key := newSigner(c)
+	_, err := repository.New("myrepo", []string{"gopher"}, nil, false)
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("myrepo")
+	_, err = repository.New("otherrepo", []string{"gopher"}, nil, false)
+	c.Assert(err, check.IsNil)
+	defer repository.Remove("otherrepo")
+	_, err = user.AddDeployKey("myrepo", "ci", key, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	defer user.RemoveDeployKeys("myrepo")
+	client, err := s.dial(signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	_, _, err = runCommand(c, client, "git-upload-pack 'myrepo.git'")
+	c.Assert(err, check.IsNil)
+	_, stderr, err := runCommand(c, client, "git-receive-pack 'myrepo.git'")
+	c.Assert(err, check.NotNil)
+	c.Assert(stderr, check.Equals, "Permission denied.\nThis deploy key is read-only.\n")
+	_, stderr, err = runCommand(c, client, "git-upload-pack 'otherrepo.git'")
+	c.Assert(err, check.NotNil)
+	c.Assert(stderr, check.Equals, "Permission denied.\nThis deploy key doesn't have access to this repository.\n")
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"fmt"
+
+	"github.com/tsuru/gandalf/lfs"
+	"github.com/tsuru/gandalf/repository"
+)
+
+// PermissionError is returned when a user or a deploy key can't run a
+// command in a repository. Reason is the message shown to the client.
+type PermissionError struct {
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return "Permission denied.\n" + e.Reason
+}
+
+var (
+	ErrReadDenied           = &PermissionError{Reason: "You don't have access to read this repository."}
+	ErrPushDenied           = &PermissionError{Reason: "You don't have access to write in this repository, or it is a mirror or being imported."}
+	ErrDeployKeyDenied      = &PermissionError{Reason: "This deploy key doesn't have access to this repository."}
+	ErrDeployKeyReadOnly    = &PermissionError{Reason: "This deploy key is read-only."}
+	ErrDeployKeyPushDenied  = &PermissionError{Reason: "This repository is a mirror or is being imported."}
+	ErrDeployKeyLFSDisabled = &PermissionError{Reason: "Deploy keys can't be used with Git LFS."}
+)
+
+// CheckAccess checks whether the user can run the git command in the
+// repository. It's used by the git wrapper and by the SSH server, so both
+// enforce the same permissions.
+//
+// Mirrors only change when synchronized with their upstream, and
+// repositories being imported only change when the import finishes, so
+// nobody can push to them.
+func CheckAccess(username, command string, repo *repository.Repository) error {
+	switch command {
+	case "git-upload-pack", "git-upload-archive":
+		if !repo.ReadableBy(username) {
+			return ErrReadDenied
+		}
+	case "git-receive-pack":
+		if repo.Mirror != nil || repo.Importing() || !repo.WritableBy(username) {
+			return ErrPushDenied
+		}
+	default:
+		return &repository.UnsupportedCommandError{Command: command}
+	}
+	return nil
+}
+
+// CheckLFSAccess checks whether the user can download or upload, depending
+// on operation, the LFS objects of the repository.
+func CheckLFSAccess(username, operation string, repo *repository.Repository) error {
+	allowed := repo.ReadableBy(username)
+	if operation == lfs.Upload {
+		allowed = repo.WritableBy(username)
+	}
+	if !allowed {
+		return &PermissionError{Reason: fmt.Sprintf("You don't have access to %s LFS objects of this repository.", operation)}
+	}
+	return nil
+}
+
+// CheckAccess checks whether the deploy key can run the command in the
+// repository with the given name, returning the repository. Deploy keys can
+// only read their repository and, unless they're read-only, push to it. The
+// repository is only read when the key belongs to it, so deploy keys can't
+// tell which other repositories exist. They can't be used with Git LFS, so
+// name is ignored for git-lfs-authenticate.
+func (k *Key) CheckAccess(command, name string) (*repository.Repository, error) {
+	if command == "git-lfs-authenticate" {
+		return nil, ErrDeployKeyLFSDisabled
+	}
+	if name != k.Repository {
+		return nil, ErrDeployKeyDenied
+	}
+	repo, err := repository.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	switch command {
+	case "git-upload-pack", "git-upload-archive":
+	case "git-receive-pack":
+		if k.ReadOnly {
+			return nil, ErrDeployKeyReadOnly
+		}
+		if repo.Mirror != nil || repo.Importing() {
+			return nil, ErrDeployKeyPushDenied
+		}
+	default:
+		return nil, &repository.UnsupportedCommandError{Command: command}
+	}
+	return &repo, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"time"
+
+	"github.com/tsuru/gandalf/repository"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestCheckAccess(c *check.C) {
+	repo := &repository.Repository{Name: "myrepo", Users: []string{"gopher"}, ReadOnlyUsers: []string{"glenda"}}
+	mirror := &repository.Repository{Name: "mirror", Users: []string{"gopher"}, Mirror: &repository.Mirror{URL: "https://example.com/repo.git"}}
+	importing := &repository.Repository{Name: "imported", Users: []string{"gopher"}, Import: &repository.Import{Status: repository.ImportRunning}}
+	var tests = []struct {
+		username string
+		command  string
+		repo     *repository.Repository
+		expected error
+	}{
+		{"gopher", "git-upload-pack", repo, nil},
+		{"gopher", "git-upload-archive", repo, nil},
+		{"gopher", "git-receive-pack", repo, nil},
+		{"glenda", "git-upload-pack", repo, nil},
+		{"glenda", "git-receive-pack", repo, ErrPushDenied},
+		{"rob", "git-upload-pack", repo, ErrReadDenied},
+		{"rob", "git-receive-pack", repo, ErrPushDenied},
+		{"gopher", "git-upload-pack", mirror, nil},
+		{"gopher", "git-receive-pack", mirror, ErrPushDenied},
+		{"gopher", "git-receive-pack", importing, ErrPushDenied},
+	}
+	for _, t := range tests {
+		err := CheckAccess(t.username, t.command, t.repo)
+		c.Check(err, check.Equals, t.expected, check.Commentf("%s %s %s", t.username, t.command, t.repo.Name))
+	}
+	err := CheckAccess("gopher", "git-shell", repo)
+	c.Assert(err, check.DeepEquals, &repository.UnsupportedCommandError{Command: "git-shell"})
+}
+
+func (s *S) TestCheckLFSAccess(c *check.C) {
+	repo := &repository.Repository{Name: "myrepo", Users: []string{"gopher"}, ReadOnlyUsers: []string{"glenda"}}
+	c.Assert(CheckLFSAccess("gopher", "upload", repo), check.IsNil)
+	c.Assert(CheckLFSAccess("glenda", "download", repo), check.IsNil)
+	err := CheckLFSAccess("glenda", "upload", repo)
+	c.Assert(err, check.ErrorMatches, "Permission denied.\nYou don't have access to upload LFS objects of this repository.")
+	err = CheckLFSAccess("rob", "download", repo)
+	c.Assert(err, check.ErrorMatches, "Permission denied.\nYou don't have access to download LFS objects of this repository.")
+}
+
+func (s *S) TestDeployKeyCheckAccess(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	defer repository.Remove(r.Name)
+	key, err := AddDeployKey(r.Name, "ci", rawKey, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	repo, err := key.CheckAccess("git-upload-pack", "myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Name, check.Equals, "myrepo")
+	_, err = key.CheckAccess("git-receive-pack", "myrepo")
+	c.Assert(err, check.Equals, ErrDeployKeyReadOnly)
+	_, err = key.CheckAccess("git-upload-pack", "otherrepo")
+	c.Assert(err, check.Equals, ErrDeployKeyDenied)
+	_, err = key.CheckAccess("git-lfs-authenticate", "")
+	c.Assert(err, check.Equals, ErrDeployKeyLFSDisabled)
+	key.ReadOnly = false
+	_, err = key.CheckAccess("git-receive-pack", "myrepo")
+	c.Assert(err, check.IsNil)
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrInvalidCertificate   = errors.New("Invalid certificate")
+	ErrUntrustedCertificate = errors.New("Certificate not signed by a trusted certificate authority")
+)
+
+// certPrefix marks the argument of the git wrapper that identifies the
+// certificate authority of the certificate used to connect, instead of the
+// fingerprint of a key.
+const certPrefix = "cert:"
+
+// trustedCAs returns the SSH user certificate authorities in the ssh-ca:keys
+// setting. Users can connect with certificates signed by them, with their
+// names as principals.
+func trustedCAs() ([]ssh.PublicKey, error) {
+	lines, err := config.GetList("ssh-ca:keys")
+	if err != nil {
+		return nil, nil
+	}
+	cas := make([]ssh.PublicKey, len(lines))
+	for i, line := range lines {
+		cas[i], _, _, _, err = ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate authority in ssh-ca:keys: %q", line)
+		}
+	}
+	return cas, nil
+}
+
+// formatCertAuthority returns the authorized_keys line that accepts
+// certificates signed by ca with username as principal, restricted to the
+// git wrapper.
+func formatCertAuthority(ca ssh.PublicKey, username string) string {
+	binPath, err := config.GetString("bin-path")
+	if err != nil {
+		panic(err)
+	}
+	keyFmt := `cert-authority,principals="%s",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s %s %s%s" %s`
+	return fmt.Sprintf(keyFmt, username, binPath, username, certPrefix, fingerprint(ca), ssh.MarshalAuthorizedKey(ca))
+}
+
+// certAuthorityLines returns the authorized_keys lines of the user for all the
+// trusted certificate authorities.
+func certAuthorityLines(username string) ([]string, error) {
+	cas, err := trustedCAs()
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(cas))
+	for i, ca := range cas {
+		lines[i] = formatCertAuthority(ca, username)
+	}
+	return lines, nil
+}
+
+// writeCertAuthorities adds the certificate authority lines of the user to
+// the authorized_keys file.
+func writeCertAuthorities(username string) error {
+	if keysInDatabase() {
+		return nil
+	}
+	lines, err := certAuthorityLines(username)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	return addLines(lines...)
+}
+
+// removeCertAuthorities removes the certificate authority lines of the user
+// from the authorized_keys file.
+func removeCertAuthorities(username string) error {
+	if keysInDatabase() {
+		return nil
+	}
+	lines, err := certAuthorityLines(username)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	return removeLines(lines...)
+}
+
+// trustedCA returns the trusted certificate authority with the given
+// fingerprint.
+func trustedCA(fp string) (ssh.PublicKey, error) {
+	cas, err := trustedCAs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range cas {
+		if fingerprint(ca) == fp {
+			return ca, nil
+		}
+	}
+	return nil, ErrUntrustedCertificate
+}
+
+// AuthorizedCertificate returns the authorized_keys line that accepts the
+// given user certificate, of type certType and encoded in base64 as sshd's
+// AuthorizedKeysCommand receives it. See CertificateUser for the checks.
+func AuthorizedCertificate(certType, data string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", ErrInvalidCertificate
+	}
+	key, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return "", ErrInvalidCertificate
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.Type() != certType {
+		return "", ErrInvalidCertificate
+	}
+	username, ca, err := CertificateUser(cert)
+	if err != nil {
+		return "", err
+	}
+	return formatCertAuthority(ca, username), nil
+}
+
+// CertificateUser returns the name of the user identified by the user
+// certificate, and its certificate authority. The certificate must be valid,
+// signed by a trusted certificate authority and have the name of a user as
+// principal. The first principal that is a user is used.
+func CertificateUser(cert *ssh.Certificate) (string, ssh.PublicKey, error) {
+	if cert.CertType != ssh.UserCert {
+		return "", nil, ErrInvalidCertificate
+	}
+	ca, err := trustedCA(fingerprint(cert.SignatureKey))
+	if err != nil {
+		return "", nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	checker := ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return fingerprint(auth) == fingerprint(ca)
+		},
+		SupportedCriticalOptions: []string{"source-address"},
+	}
+	for _, principal := range cert.ValidPrincipals {
+		if n, err := conn.User().FindId(principal).Count(); err != nil || n == 0 {
+			continue
+		}
+		if err = checker.CheckCert(principal, cert); err != nil {
+			return "", nil, err
+		}
+		return principal, ca, nil
+	}
+	return "", nil, ErrUserNotFound
+}
+
+// UseCertificate checks whether the user can connect with a certificate
+// signed by the certificate authority with the given fingerprint, prefixed by
+// "cert:", as the git wrapper receives it. The authority must still be
+// trusted, and the user must exist.
+func UseCertificate(username, arg string) error {
+	if !strings.HasPrefix(arg, certPrefix) {
+		return ErrInvalidCertificate
+	}
+	if _, err := trustedCA(strings.TrimPrefix(arg, certPrefix)); err != nil {
+		return err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if n, err := conn.User().FindId(username).Count(); err != nil || n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tsuru/config"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+// newCA generates a certificate authority and trusts it, returning its
+// signer and a function that stops trusting it.
+func newCA(c *check.C) (ssh.Signer, func()) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	signer, err := ssh.NewSignerFromKey(private)
+	c.Assert(err, check.IsNil)
+	config.Set("ssh-ca:keys", []interface{}{string(ssh.MarshalAuthorizedKey(signer.PublicKey()))})
+	return signer, func() { config.Unset("ssh-ca") }
+}
+
+// signCert signs a user certificate for a new key, with the given principals,
+// returning its type and base64 encoding.
+func signCert(c *check.C, ca ssh.Signer, certType uint32, principals ...string) (string, string) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(generateKey(c)))
+	c.Assert(err, check.IsNil)
+	cert := ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "gopher@laptop",
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	c.Assert(err, check.IsNil)
+	return cert.Type(), base64.StdEncoding.EncodeToString(cert.Marshal())
+}
+
+func (s *S) TestTrustedCAs(c *check.C) {
+	cas, err := trustedCAs()
+	c.Assert(err, check.IsNil)
+	c.Assert(cas, check.HasLen, 0)
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	cas, err = trustedCAs()
+	c.Assert(err, check.IsNil)
+	c.Assert(cas, check.HasLen, 1)
+	c.Assert(fingerprint(cas[0]), check.Equals, fingerprint(ca.PublicKey()))
+	config.Set("ssh-ca:keys", []interface{}{"ssh-rsa invalid"})
+	_, err = trustedCAs()
+	c.Assert(err, check.ErrorMatches, `invalid certificate authority in ssh-ca:keys: "ssh-rsa invalid"`)
+}
+
+func (s *S) TestFormatCertAuthority(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	p, err := config.GetString("bin-path")
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf(`cert-authority,principals="gopher",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s gopher cert:%s" %s`,
+		p, fingerprint(ca.PublicKey()), ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	c.Assert(formatCertAuthority(ca.PublicKey(), "gopher"), check.Equals, expected)
+}
+
+func (s *S) TestWriteAndRemoveCertAuthorities(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	err := writeKeys([]string{"ssh-rsa unmanaged"})
+	c.Assert(err, check.IsNil)
+	err = writeCertAuthorities("gopher")
+	c.Assert(err, check.IsNil)
+	err = writeCertAuthorities("gopher")
+	c.Assert(err, check.IsNil)
+	lines, err := readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	line := strings.TrimSuffix(formatCertAuthority(ca.PublicKey(), "gopher"), "\n")
+	c.Assert(lines, check.DeepEquals, []string{"ssh-rsa unmanaged", line})
+	err = removeCertAuthorities("gopher")
+	c.Assert(err, check.IsNil)
+	lines, err = readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.DeepEquals, []string{"ssh-rsa unmanaged"})
+}
+
+func (s *S) TestAuthorizedCertificateInvalid(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	_, err := AuthorizedCertificate("ssh-rsa-cert-v01@openssh.com", "not base64")
+	c.Assert(err, check.Equals, ErrInvalidCertificate)
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(otherKey))
+	c.Assert(err, check.IsNil)
+	_, err = AuthorizedCertificate(key.Type(), base64.StdEncoding.EncodeToString(key.Marshal()))
+	c.Assert(err, check.Equals, ErrInvalidCertificate)
+	certType, cert := signCert(c, ca, ssh.HostCert, "gopher")
+	_, err = AuthorizedCertificate(certType, cert)
+	c.Assert(err, check.Equals, ErrInvalidCertificate)
+	certType, cert = signCert(c, ca, ssh.UserCert, "gopher")
+	_, err = AuthorizedCertificate("ssh-rsa-cert-v01@openssh.com", cert)
+	c.Assert(err, check.Equals, ErrInvalidCertificate)
+}
+
+func (s *S) TestAuthorizedCertificateUntrusted(c *check.C) {
+	ca, cleanup := newCA(c)
+	certType, cert := signCert(c, ca, ssh.UserCert, "gopher")
+	cleanup()
+	_, err := AuthorizedCertificate(certType, cert)
+	c.Assert(err, check.Equals, ErrUntrustedCertificate)
+	_, cleanup = newCA(c)
+	defer cleanup()
+	_, err = AuthorizedCertificate(certType, cert)
+	c.Assert(err, check.Equals, ErrUntrustedCertificate)
+}
+
+func (s *S) TestAuthorizedCertificate(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	_, err := New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	certType, cert := signCert(c, ca, ssh.UserCert, "root", "gopher")
+	line, err := AuthorizedCertificate(certType, cert)
+	c.Assert(err, check.IsNil)
+	c.Assert(line, check.Equals, formatCertAuthority(ca.PublicKey(), "gopher"))
+	certType, cert = signCert(c, ca, ssh.UserCert, "glenda")
+	_, err = AuthorizedCertificate(certType, cert)
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
+
+func (s *S) TestAuthorizedCertificateExpired(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	_, err := New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(generateKey(c)))
+	c.Assert(err, check.IsNil)
+	cert := ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"gopher"},
+		ValidBefore:     uint64(time.Now().Add(-time.Hour).Unix()),
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	c.Assert(err, check.IsNil)
+	_, err = AuthorizedCertificate(cert.Type(), base64.StdEncoding.EncodeToString(cert.Marshal()))
+	c.Assert(err, check.ErrorMatches, "ssh: cert has expired")
+}
+
+func (s *S) TestCertificateUser(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	_, err := New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	_, data := signCert(c, ca, ssh.UserCert, "root", "gopher")
+	raw, err := base64.StdEncoding.DecodeString(data)
+	c.Assert(err, check.IsNil)
+	key, err := ssh.ParsePublicKey(raw)
+	c.Assert(err, check.IsNil)
+	username, authority, err := CertificateUser(key.(*ssh.Certificate))
+	c.Assert(err, check.IsNil)
+	c.Assert(username, check.Equals, "gopher")
+	c.Assert(fingerprint(authority), check.Equals, fingerprint(ca.PublicKey()))
+}
+
+func (s *S) TestNewAndRemoveUserWriteCertAuthorities(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	_, err := New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	lines, err := readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	line := strings.TrimSuffix(formatCertAuthority(ca.PublicKey(), "gopher"), "\n")
+	c.Assert(lines, check.DeepEquals, []string{line})
+	err = Remove("gopher")
+	c.Assert(err, check.IsNil)
+	lines, err = readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.HasLen, 0)
+}
+
+func (s *S) TestUseCertificate(c *check.C) {
+	ca, cleanup := newCA(c)
+	defer cleanup()
+	arg := "cert:" + fingerprint(ca.PublicKey())
+	err := UseCertificate("gopher", "SHA256:something")
+	c.Assert(err, check.Equals, ErrInvalidCertificate)
+	err = UseCertificate("gopher", "cert:SHA256:something")
+	c.Assert(err, check.Equals, ErrUntrustedCertificate)
+	_, err = New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	err = UseCertificate("gopher", arg)
+	c.Assert(err, check.IsNil)
+	err = UseCertificate("glenda", arg)
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
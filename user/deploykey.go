@@ -0,0 +1,169 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DeployKeyFlag is the first argument of the git wrapper in the
+// authorized_keys lines of deploy keys, followed by the fingerprint of the
+// key.
+const DeployKeyFlag = "--deploy-key"
+
+var ErrDeployKeyNotFound = errors.New("Deploy key not found")
+
+func init() {
+	repository.OnRemove(RemoveDeployKeys)
+	repository.OnRename(RenameDeployKeys)
+}
+
+// deployKeysQuery selects the deploy keys of the repository, or all deploy
+// keys when repo is empty.
+func deployKeysQuery(repo string) bson.M {
+	if repo == "" {
+		return bson.M{"repository": bson.M{"$nin": []interface{}{nil, ""}}}
+	}
+	return bson.M{"repository": repo, "username": ""}
+}
+
+func deployKeyQuery(repo, name string) bson.M {
+	q := deployKeysQuery(repo)
+	q["name"] = name
+	return q
+}
+
+// AddDeployKey adds a deploy key to the repository, which gives access only
+// to it, for reading or, unless readOnly is true, for writing too. The key is
+// refused after expiresAt, unless it's zero. Deploy keys follow the key
+// policy, except for the number of keys per user.
+func AddDeployKey(repo, name, body string, readOnly bool, expiresAt time.Time) (*Key, error) {
+	if _, err := repository.Get(repo); err != nil {
+		return nil, err
+	}
+	key, err := newKey(name, "", body)
+	if err != nil {
+		return nil, err
+	}
+	key.Repository = repo
+	key.ReadOnly = readOnly
+	key.ExpiresAt = expiresAt
+	policy := CurrentKeyPolicy()
+	policy.MaxKeysPerUser = 0
+	if err = policy.check([]*Key{key}, 1); err != nil {
+		return nil, err
+	}
+	return key, insertKey(key)
+}
+
+// ListDeployKeys returns the deploy keys of the repository, sorted by name.
+func ListDeployKeys(repo string) ([]Key, error) {
+	if _, err := repository.Get(repo); err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	keys := []Key{}
+	err = conn.Key().Find(deployKeysQuery(repo)).Sort("name").All(&keys)
+	return keys, err
+}
+
+// RemoveDeployKey removes the deploy key from the database and from the
+// authorized_keys file.
+func RemoveDeployKey(repo, name string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	q := deployKeyQuery(repo, name)
+	var k Key
+	err = conn.Key().Find(q).One(&k)
+	if err == mgo.ErrNotFound {
+		return ErrDeployKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err = conn.Key().Remove(q); err != nil {
+		return err
+	}
+	return remove(&k)
+}
+
+// RemoveDeployKeys removes all the deploy keys of the repository. It's called
+// by repository.Remove.
+func RemoveDeployKeys(repo string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var keys []Key
+	q := deployKeysQuery(repo)
+	if err = conn.Key().Find(q).All(&keys); err != nil {
+		return err
+	}
+	if _, err = conn.Key().RemoveAll(q); err != nil {
+		return err
+	}
+	for i := range keys {
+		if err = remove(&keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameDeployKeys moves the deploy keys of a repository that was renamed.
+// It's called by repository.Update. Their authorized_keys lines identify
+// them by fingerprint, so they don't change.
+func RenameDeployKeys(oldName, newName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Key().UpdateAll(deployKeysQuery(oldName), bson.M{"$set": bson.M{"repository": newName}})
+	return err
+}
+
+// UseDeployKey returns the deploy key with the given fingerprint, used to
+// connect to the git wrapper, and records its use. It returns ErrKeyExpired
+// when the key expired.
+func UseDeployKey(fp string) (*Key, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	q := deployKeysQuery("")
+	q["fingerprint"] = fp
+	var k Key
+	err = conn.Key().Find(q).One(&k)
+	if err == mgo.ErrNotFound {
+		return nil, ErrDeployKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.Expired() {
+		return nil, ErrKeyExpired
+	}
+	update := bson.M{"$set": bson.M{"lastusedat": time.Now()}}
+	if err = conn.Key().Update(deployKeyQuery(k.Repository, k.Name), update); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/tsuru/fs/fstest"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestFormatDeployKey(c *check.C) {
+	k, err := newKey("ci", "", rawKey)
+	c.Assert(err, check.IsNil)
+	k.Repository = "myrepo"
+	p, err := config.GetString("bin-path")
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf(`no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s --deploy-key %s" %s`+"\n", p, k.Fingerprint, k)
+	c.Assert(k.format(), check.Equals, expected)
+	c.Assert(k.formats(), check.DeepEquals, []string{expected})
+}
+
+func (s *S) TestDeployKeyMarshalJSON(c *check.C) {
+	k, err := newKey("ci", "", rawKey)
+	c.Assert(err, check.IsNil)
+	k.Repository = "myrepo"
+	k.ReadOnly = true
+	b, err := json.Marshal(k)
+	c.Assert(err, check.IsNil)
+	var data map[string]interface{}
+	err = json.Unmarshal(b, &data)
+	c.Assert(err, check.IsNil)
+	c.Assert(data["repository"], check.Equals, "myrepo")
+	c.Assert(data["readOnly"], check.Equals, true)
+}
+
+func (s *S) TestAddDeployKey(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	defer RemoveDeployKeys(r.Name)
+	k, err := AddDeployKey(r.Name, "ci", rawKey, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Repository, check.Equals, "myrepo")
+	c.Assert(k.ReadOnly, check.Equals, true)
+	c.Assert(s.authKeysContent(c), check.Equals, k.format())
+	keys, err := ListDeployKeys(r.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].Name, check.Equals, "ci")
+	c.Assert(keys[0].UserName, check.Equals, "")
+	_, err = AddDeployKey(r.Name, "ci", otherKey, false, time.Time{})
+	c.Assert(err, check.Equals, ErrDuplicateKey)
+}
+
+func (s *S) TestAddDeployKeysWithTheSameNameToDifferentRepositories(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	r2 := s.createRepo("otherrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	defer conn.Repository().RemoveId(r2.Name)
+	defer RemoveDeployKeys(r.Name)
+	defer RemoveDeployKeys(r2.Name)
+	_, err = AddDeployKey(r.Name, "ci", rawKey, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	_, err = AddDeployKey(r2.Name, "ci", otherKey, true, time.Time{})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestAddDeployKeyRepositoryNotFound(c *check.C) {
+	_, err := AddDeployKey("unknown", "ci", rawKey, true, time.Time{})
+	c.Assert(err, check.Equals, repository.ErrRepositoryNotFound)
+}
+
+func (s *S) TestAddDeployKeyRefusedByKeyPolicy(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	defer setKeyPolicy(map[interface{}]interface{}{"require-expiry": true, "max-keys-per-user": 1})()
+	_, err = AddDeployKey(r.Name, "ci", rawKey, true, time.Time{})
+	c.Assert(err, check.DeepEquals, &KeyPolicyError{Violations: []string{"ci: key has no expiry date"}})
+	_, err = AddDeployKey(r.Name, "ci", rawKey, true, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	_, err = AddDeployKey(r.Name, "ci2", otherKey, true, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	RemoveDeployKeys(r.Name)
+}
+
+func (s *S) TestRemoveDeployKey(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	_, err = AddDeployKey(r.Name, "ci", rawKey, false, time.Time{})
+	c.Assert(err, check.IsNil)
+	err = RemoveDeployKey(r.Name, "ci")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authKeysContent(c), check.Equals, "")
+	err = RemoveDeployKey(r.Name, "ci")
+	c.Assert(err, check.Equals, ErrDeployKeyNotFound)
+}
+
+func (s *S) TestRemoveDeployKeys(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	_, err = AddDeployKey(r.Name, "ci", rawKey, false, time.Time{})
+	c.Assert(err, check.IsNil)
+	_, err = AddDeployKey(r.Name, "deploy", otherKey, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	err = RemoveDeployKeys(r.Name)
+	c.Assert(err, check.IsNil)
+	n, err := conn.Key().Find(bson.M{"repository": r.Name}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+	c.Assert(s.authKeysContent(c), check.Equals, "")
+}
+
+func (s *S) TestRenameDeployKeys(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	_, err = AddDeployKey(r.Name, "ci", rawKey, false, time.Time{})
+	c.Assert(err, check.IsNil)
+	defer RemoveDeployKeys("newname")
+	err = RenameDeployKeys(r.Name, "newname")
+	c.Assert(err, check.IsNil)
+	k, err := UseDeployKey("SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Repository, check.Equals, "newname")
+}
+
+func (s *S) TestRepositoryRemoveAndRenameUpdateDeployKeys(c *check.C) {
+	rfs := &fstest.RecordingFs{}
+	fs.Fsystem = rfs
+	defer func() { fs.Fsystem = nil }()
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	_, err := AddDeployKey(r.Name, "ci", rawKey, false, time.Time{})
+	c.Assert(err, check.IsNil)
+	err = repository.Update(r.Name, repository.Repository{Name: "newname", Users: r.Users})
+	c.Assert(err, check.IsNil)
+	keys, err := ListDeployKeys("newname")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	err = repository.Remove("newname")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	n, err := conn.Key().Find(bson.M{"repository": bson.M{"$in": []string{"myrepo", "newname"}}}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+	c.Assert(s.authKeysContent(c), check.Equals, "")
+}
+
+func (s *S) TestUseDeployKey(c *check.C) {
+	r := s.createRepo("myrepo", []string{"gopher"}, c)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	defer RemoveDeployKeys(r.Name)
+	_, err = AddDeployKey(r.Name, "ci", rawKey, true, time.Time{})
+	c.Assert(err, check.IsNil)
+	k, err := UseDeployKey("SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "ci")
+	c.Assert(k.ReadOnly, check.Equals, true)
+	keys, err := ListDeployKeys(r.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(time.Since(keys[0].LastUsedAt) < time.Minute, check.Equals, true)
+	_, err = UseDeployKey("SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw")
+	c.Assert(err, check.Equals, ErrDeployKeyNotFound)
+}
+
+func (s *S) TestUseDeployKeyDoesNotAcceptUserKeys(c *check.C) {
+	_, err := New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	_, err = UseDeployKey("SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.Equals, ErrDeployKeyNotFound)
+}
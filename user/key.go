@@ -6,14 +6,22 @@ package user
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"os"
 	"os/user"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/tsuru/config"
@@ -29,14 +37,89 @@ var (
 	ErrDuplicateKey = errors.New("Duplicate key")
 	ErrInvalidKey   = errors.New("Invalid key")
 	ErrKeyNotFound  = errors.New("Key not found")
+	ErrKeyExpired   = errors.New("Key expired")
 )
 
 type Key struct {
-	Name      string
-	Body      string
-	Comment   string
-	UserName  string
-	CreatedAt time.Time
+	Name        string
+	Body        string
+	Comment     string
+	UserName    string
+	Fingerprint string
+	Type        string
+	Bits        int
+	CreatedAt   time.Time
+	// ExpiresAt is the time after which the key is refused, if not zero.
+	ExpiresAt time.Time
+	// LastUsedAt is the last time the key was used to access a
+	// repository, updated by the git wrapper.
+	LastUsedAt time.Time
+	// Repository is the repository of deploy keys, which belong to no user
+	// and only give access to it.
+	Repository string
+	// ReadOnly tells whether the deploy key can only read the repository.
+	ReadOnly bool
+}
+
+// fingerprint returns the SHA256 fingerprint of the key, in the format used
+// by OpenSSH (for example, "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8").
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// readMPInt reads a multiple precision integer in the SSH wire format.
+func readMPInt(in []byte) (*big.Int, []byte, bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+	length := binary.BigEndian.Uint32(in)
+	in = in[4:]
+	if uint32(len(in)) < length {
+		return nil, nil, false
+	}
+	return new(big.Int).SetBytes(in[:length]), in[length:], true
+}
+
+// keyBits returns the size of the key, in bits: the size of the modulus of
+// RSA keys, of the prime of DSA keys and of the curve of ECDSA keys.
+func keyBits(key ssh.PublicKey) int {
+	switch key.Type() {
+	case ssh.KeyAlgoECDSA256:
+		return 256
+	case ssh.KeyAlgoECDSA384:
+		return 384
+	case ssh.KeyAlgoECDSA521:
+		return 521
+	}
+	// RSA keys have the exponent before the modulus, while DSA keys start
+	// with the prime.
+	in := key.Marshal()
+	if len(in) < 4 || uint32(len(in)-4) < binary.BigEndian.Uint32(in) {
+		return 0
+	}
+	in = in[4+binary.BigEndian.Uint32(in):]
+	n, in, ok := readMPInt(in)
+	if ok && key.Type() == ssh.KeyAlgoRSA {
+		n, _, ok = readMPInt(in)
+	}
+	if !ok {
+		return 0
+	}
+	return n.BitLen()
+}
+
+// setMetadata sets the fingerprint, the type and the size of the key, parsed
+// from its body.
+func (k *Key) setMetadata() error {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Body))
+	if err != nil {
+		return ErrInvalidKey
+	}
+	k.Fingerprint = fingerprint(key)
+	k.Type = key.Type()
+	k.Bits = keyBits(key)
+	return nil
 }
 
 func newKey(name, user, raw string) (*Key, error) {
@@ -46,15 +129,47 @@ func newKey(name, user, raw string) (*Key, error) {
 	}
 	body := ssh.MarshalAuthorizedKey(key.(ssh.PublicKey))
 	k := Key{
-		Name:      name,
-		Body:      string(body),
-		Comment:   comment,
-		UserName:  user,
-		CreatedAt: time.Now(),
+		Name:        name,
+		Body:        string(body),
+		Comment:     comment,
+		UserName:    user,
+		Fingerprint: fingerprint(key),
+		Type:        key.Type(),
+		Bits:        keyBits(key),
+		CreatedAt:   time.Now(),
 	}
 	return &k, nil
 }
 
+// Expired returns whether the key has an expiry date that has passed.
+func (k *Key) Expired() bool {
+	return !k.ExpiresAt.IsZero() && !time.Now().Before(k.ExpiresAt)
+}
+
+// MarshalJSON marshals the key with its metadata. Times that are not set
+// are omitted, and so are the repository and the scope of user keys.
+func (k *Key) MarshalJSON() ([]byte, error) {
+	data := map[string]interface{}{
+		"name":        k.Name,
+		"key":         k.String(),
+		"fingerprint": k.Fingerprint,
+		"type":        k.Type,
+		"bits":        k.Bits,
+		"expired":     k.Expired(),
+	}
+	if k.Repository != "" {
+		data["repository"] = k.Repository
+		data["readOnly"] = k.ReadOnly
+	}
+	times := map[string]time.Time{"createdAt": k.CreatedAt, "expiresAt": k.ExpiresAt, "lastUsedAt": k.LastUsedAt}
+	for name, t := range times {
+		if !t.IsZero() {
+			data[name] = t
+		}
+	}
+	return json.Marshal(data)
+}
+
 func (k *Key) String() string {
 	parts := make([]string, 1, 2)
 	parts[0] = strings.TrimSpace(k.Body)
@@ -70,7 +185,25 @@ func (k *Key) format() string {
 		panic(err)
 	}
 	keyFmt := `no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s %s" %s` + "\n"
-	return fmt.Sprintf(keyFmt, binPath, k.UserName, k)
+	args := k.UserName
+	if k.Repository != "" {
+		args = DeployKeyFlag + " " + k.Fingerprint
+	} else if k.Fingerprint != "" {
+		args += " " + k.Fingerprint
+	}
+	return fmt.Sprintf(keyFmt, binPath, args, k)
+}
+
+// formats returns the lines of the key that may be in the authorized_keys
+// file: the current one and, for keys with a fingerprint, the one written
+// before fingerprints were passed to the git wrapper.
+func (k *Key) formats() []string {
+	if k.Fingerprint == "" || k.Repository != "" {
+		return []string{k.format()}
+	}
+	legacy := *k
+	legacy.Fingerprint = ""
+	return []string{k.format(), legacy.format()}
 }
 
 func (k *Key) dump(w io.Writer) error {
@@ -85,6 +218,18 @@ func (k *Key) dump(w io.Writer) error {
 	return nil
 }
 
+// keysInDatabase returns whether keys are looked up in the database, either
+// by sshd's AuthorizedKeysCommand, through AuthorizedKey, or by the embedded
+// SSH server, in which case the authorized_keys file is not updated when keys
+// change.
+func keysInDatabase() bool {
+	if listen, _ := config.GetString("ssh:listen"); listen != "" {
+		return true
+	}
+	enabled, _ := config.GetBool("authorized-keys-command")
+	return enabled
+}
+
 func authKey() string {
 	if path, _ := config.GetString("authorized-keys-path"); path != "" {
 		return path
@@ -98,6 +243,39 @@ func authKey() string {
 	return path.Join(home, ".ssh", "authorized_keys")
 }
 
+// keysMutex serializes the changes of the authorized_keys file made by this
+// process, while the lock file serializes them among processes.
+var keysMutex sync.Mutex
+
+// lockAuthorizedKeys locks the authorized_keys file for changes, returning
+// the function that unlocks it.
+func lockAuthorizedKeys() (func(), error) {
+	keysMutex.Lock()
+	f, err := fs.Filesystem().OpenFile(authKey()+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		keysMutex.Unlock()
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		keysMutex.Unlock()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		keysMutex.Unlock()
+	}, nil
+}
+
+// tempPath returns a unique path for a temporary copy of the authorized_keys
+// file, in the same directory, so it can be renamed over the original.
+func tempPath() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%s.%x.tmp", authKey(), b)
+}
+
 // creates a copy of the authorized_keys and returns it, with the file cursor
 // pointing at the first byte of the file.
 func copyFile() (tsurufs.File, error) {
@@ -106,7 +284,7 @@ func copyFile() (tsurufs.File, error) {
 	if statErr != nil && !os.IsNotExist(statErr) {
 		return nil, statErr
 	}
-	dstPath := path + ".tmp"
+	dstPath := tempPath()
 	dst, err := fs.Filesystem().OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
@@ -114,18 +292,20 @@ func copyFile() (tsurufs.File, error) {
 	if !os.IsNotExist(statErr) {
 		original, err := fs.Filesystem().Open(path)
 		if err != nil {
+			dst.Close()
+			fs.Filesystem().Remove(dstPath)
 			return nil, err
 		}
 		defer original.Close()
 		n, err := io.Copy(dst, original)
+		if err == nil && n != fi.Size() {
+			err = io.ErrShortWrite
+		}
 		if err != nil {
 			dst.Close()
+			fs.Filesystem().Remove(dstPath)
 			return nil, err
 		}
-		if n != fi.Size() {
-			dst.Close()
-			return nil, io.ErrShortWrite
-		}
 		dst.Seek(0, 0)
 	}
 	return dst, nil
@@ -136,25 +316,126 @@ func moveFile(fromPath string) error {
 	return fs.Filesystem().Rename(fromPath, authKey())
 }
 
-func writeKey(k *Key) error {
+// updateAuthorizedKeys locks the authorized_keys file and replaces it with a
+// copy changed by update, unless update reports that nothing changed.
+func updateAuthorizedKeys(update func(tsurufs.File) (bool, error)) error {
+	unlock, err := lockAuthorizedKeys()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	file, err := copyFile()
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	file.Seek(0, 2)
-	err = k.dump(file)
-	if err != nil {
+	changed, err := update(file)
+	if err != nil || !changed {
+		fs.Filesystem().Remove(file.Name())
 		return err
 	}
 	return moveFile(file.Name())
 }
 
+// addLines appends the lines that are not in the authorized_keys file yet.
+// Lines end with a newline.
+func addLines(lines ...string) error {
+	return updateAuthorizedKeys(func(file tsurufs.File) (bool, error) {
+		missing := make(map[string]bool, len(lines))
+		for _, line := range lines {
+			missing[line] = true
+		}
+		reader := bufio.NewReader(file)
+		for line, _ := reader.ReadString('\n'); line != ""; line, _ = reader.ReadString('\n') {
+			delete(missing, line)
+		}
+		if len(missing) == 0 {
+			return false, nil
+		}
+		var content bytes.Buffer
+		for _, line := range lines {
+			if missing[line] {
+				delete(missing, line)
+				content.WriteString(line)
+			}
+		}
+		file.Seek(0, 2)
+		n, err := file.Write(content.Bytes())
+		if err != nil {
+			return false, err
+		}
+		if n != content.Len() {
+			return false, io.ErrShortWrite
+		}
+		return true, nil
+	})
+}
+
+// removeLines removes the lines from the authorized_keys file. Lines end with
+// a newline.
+func removeLines(lines ...string) error {
+	return updateAuthorizedKeys(func(file tsurufs.File) (bool, error) {
+		kept := make([]string, 0, 10)
+		found := false
+		reader := bufio.NewReader(file)
+		line, _ := reader.ReadString('\n')
+		for line != "" {
+			matches := false
+			for _, l := range lines {
+				matches = matches || line == l
+			}
+			if matches {
+				found = true
+			} else {
+				kept = append(kept, line)
+			}
+			line, _ = reader.ReadString('\n')
+		}
+		if !found {
+			return false, nil
+		}
+		file.Truncate(0)
+		file.Seek(0, 0)
+		content := strings.Join(kept, "")
+		n, err := file.WriteString(content)
+		if err != nil {
+			return false, err
+		}
+		if n != len(content) {
+			return false, io.ErrShortWrite
+		}
+		return true, nil
+	})
+}
+
+// writeKey adds the key to the authorized_keys file, unless it's already
+// there, as when the file was rebuilt after the key was saved.
+func writeKey(k *Key) error {
+	if keysInDatabase() {
+		return nil
+	}
+	formatted := k.format()
+	return updateAuthorizedKeys(func(file tsurufs.File) (bool, error) {
+		reader := bufio.NewReader(file)
+		for line, _ := reader.ReadString('\n'); line != ""; line, _ = reader.ReadString('\n') {
+			if line == formatted {
+				return false, nil
+			}
+		}
+		file.Seek(0, 2)
+		return true, k.dump(file)
+	})
+}
+
 func addKey(name, body, username string) error {
 	key, err := newKey(name, username, body)
 	if err != nil {
 		return err
 	}
+	return insertKey(key)
+}
+
+func insertKey(key *Key) error {
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -170,11 +451,16 @@ func addKey(name, body, username string) error {
 	return writeKey(key)
 }
 
-func updateKey(name, body, username string) error {
+func updateKey(name, body, username string, expiresAt time.Time) error {
 	newK, err := newKey(name, username, body)
 	if err != nil {
 		return err
 	}
+	newK.ExpiresAt = expiresAt
+	policy := CurrentKeyPolicy()
+	if err = policy.check([]*Key{newK}, 0); err != nil {
+		return err
+	}
 	var oldK Key
 	conn, err := db.Conn()
 	if err != nil {
@@ -194,46 +480,64 @@ func updateKey(name, body, username string) error {
 		writeKey(&oldK)
 		return err
 	}
+	newK.CreatedAt = oldK.CreatedAt
+	newK.LastUsedAt = oldK.LastUsedAt
 	return conn.Key().Update(bson.M{"name": name, "username": username}, newK)
 }
 
-func addKeys(keys map[string]string, username string) error {
-	for name, k := range keys {
-		err := addKey(name, k, username)
+// prepareKeys parses the keys of the user, checking them against the key
+// policy. existing is the number of keys the user already has.
+func prepareKeys(keys map[string]string, username string, expiresAt time.Time, existing int) ([]*Key, error) {
+	parsed := make([]*Key, 0, len(keys))
+	for name, body := range keys {
+		key, err := newKey(name, username, body)
 		if err != nil {
+			return nil, err
+		}
+		key.ExpiresAt = expiresAt
+		parsed = append(parsed, key)
+	}
+	policy := CurrentKeyPolicy()
+	if err := policy.check(parsed, existing+len(parsed)); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func insertKeys(keys []*Key) error {
+	for _, key := range keys {
+		if err := insertKey(key); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func remove(k *Key) error {
-	formatted := k.format()
-	file, err := copyFile()
+// addKeys adds the keys to the user. The maximum number of keys of the key
+// policy is checked against the keys the user has before the new ones are
+// inserted, so concurrent calls for the same user may exceed it.
+func addKeys(keys map[string]string, username string, expiresAt time.Time) error {
+	conn, err := db.Conn()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	lines := make([]string, 0, 10)
-	reader := bufio.NewReader(file)
-	line, _ := reader.ReadString('\n')
-	for line != "" {
-		if line != formatted {
-			lines = append(lines, line)
-		}
-		line, _ = reader.ReadString('\n')
+	existing, err := conn.Key().Find(bson.M{"username": username}).Count()
+	conn.Close()
+	if err != nil {
+		return err
 	}
-	file.Truncate(0)
-	file.Seek(0, 0)
-	content := strings.Join(lines, "")
-	n, err := file.WriteString(content)
+	parsed, err := prepareKeys(keys, username, expiresAt, existing)
 	if err != nil {
 		return err
 	}
-	if n != len(content) {
-		return io.ErrShortWrite
+	return insertKeys(parsed)
+}
+
+func remove(k *Key) error {
+	if keysInDatabase() {
+		return nil
 	}
-	return moveFile(file.Name())
+	return removeLines(k.formats()...)
 }
 
 func removeUserKeys(username string) error {
@@ -295,6 +599,299 @@ func ListKeys(uName string) (KeyList, error) {
 		return nil, ErrUserNotFound
 	}
 	var keys []Key
-	err = conn.Key().Find(bson.M{"username": uName}).All(&keys)
+	err = conn.Key().Find(bson.M{"username": uName}).Sort("name").All(&keys)
+	for i := range keys {
+		if keys[i].Fingerprint == "" {
+			keys[i].setMetadata()
+		}
+	}
 	return KeyList(keys), err
 }
+
+// Lines of authorized_keys between UnmanagedBegin and UnmanagedEnd are not
+// managed by gandalf, and may be preserved when the file is rebuilt.
+const (
+	UnmanagedBegin = "# BEGIN gandalf unmanaged keys"
+	UnmanagedEnd   = "# END gandalf unmanaged keys"
+)
+
+// AuthorizedKeysDiff lists the lines added to and removed from the
+// authorized_keys file by a rebuild.
+type AuthorizedKeysDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// readAuthorizedKeys returns the lines of the authorized_keys file, or nil
+// when it doesn't exist.
+func readAuthorizedKeys() ([]string, error) {
+	f, err := fs.Filesystem().Open(authKey())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// unmanagedLines returns the blocks of unmanaged lines, including their
+// markers. A block without an end marker goes until the end of the file.
+func unmanagedLines(lines []string) []string {
+	var unmanaged []string
+	inBlock := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == UnmanagedBegin {
+			inBlock = true
+		}
+		if inBlock {
+			unmanaged = append(unmanaged, line)
+		}
+		if strings.TrimSpace(line) == UnmanagedEnd && inBlock {
+			inBlock = false
+		}
+	}
+	if inBlock {
+		unmanaged = append(unmanaged, UnmanagedEnd)
+	}
+	return unmanaged
+}
+
+func diffLines(old, new []string) *AuthorizedKeysDiff {
+	diff := AuthorizedKeysDiff{Added: []string{}, Removed: []string{}}
+	count := make(map[string]int, len(old))
+	for _, line := range old {
+		count[line]++
+	}
+	for _, line := range new {
+		if count[line] > 0 {
+			count[line]--
+		} else {
+			diff.Added = append(diff.Added, line)
+		}
+	}
+	for _, line := range old {
+		if count[line] > 0 {
+			count[line]--
+			diff.Removed = append(diff.Removed, line)
+		}
+	}
+	return &diff
+}
+
+// writeKeys atomically replaces the authorized_keys file with the given
+// lines.
+func writeKeys(lines []string) error {
+	var content bytes.Buffer
+	for _, line := range lines {
+		content.WriteString(line + "\n")
+	}
+	dst, err := fs.Filesystem().OpenFile(tempPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	n, err := dst.Write(content.Bytes())
+	if err == nil && n != content.Len() {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		fs.Filesystem().Remove(dst.Name())
+		return err
+	}
+	return moveFile(dst.Name())
+}
+
+// RebuildAuthorizedKeys rewrites the authorized_keys file with all the keys
+// in the database, returning the lines that were added and removed. When
+// preserveUnmanaged is true, the blocks of unmanaged lines of the current
+// file are kept at its beginning. When dryRun is true, the file is not
+// changed.
+func RebuildAuthorizedKeys(dryRun, preserveUnmanaged bool) (*AuthorizedKeysDiff, error) {
+	unlock, err := lockAuthorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = backfillMetadata(conn); err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if err = conn.Key().Find(nil).Sort("username", "name").All(&keys); err != nil {
+		return nil, err
+	}
+	current, err := readAuthorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	if preserveUnmanaged {
+		lines = unmanagedLines(current)
+	}
+	for i := range keys {
+		lines = append(lines, strings.TrimSuffix(keys[i].format(), "\n"))
+	}
+	cas, err := trustedCAs()
+	if err != nil {
+		return nil, err
+	}
+	if len(cas) > 0 {
+		var users []User
+		if err = conn.User().Find(nil).Sort("_id").All(&users); err != nil {
+			return nil, err
+		}
+		for _, ca := range cas {
+			for _, u := range users {
+				lines = append(lines, strings.TrimSuffix(formatCertAuthority(ca, u.Name), "\n"))
+			}
+		}
+	}
+	diff := diffLines(current, lines)
+	if dryRun {
+		return diff, nil
+	}
+	return diff, writeKeys(lines)
+}
+
+// backfillMetadata stores the metadata of the keys added before it was
+// stored, returning the updated keys.
+func backfillMetadata(conn *db.Storage) ([]Key, error) {
+	var keys []Key
+	err := conn.Key().Find(bson.M{"fingerprint": bson.M{"$in": []interface{}{nil, ""}}}).All(&keys)
+	if err != nil {
+		return nil, err
+	}
+	updated := keys[:0]
+	for _, k := range keys {
+		if k.setMetadata() != nil {
+			continue
+		}
+		q := bson.M{"name": k.Name, "username": k.UserName}
+		set := bson.M{"fingerprint": k.Fingerprint, "type": k.Type, "bits": k.Bits}
+		if err = conn.Key().Update(q, bson.M{"$set": set}); err != nil {
+			return nil, err
+		}
+		updated = append(updated, k)
+	}
+	return updated, nil
+}
+
+// findKeyByFingerprint finds the key with the given fingerprint. Keys added
+// before fingerprints were stored get their metadata on the first lookup
+// that doesn't find the key.
+func findKeyByFingerprint(fp string) (*Key, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var k Key
+	err = conn.Key().Find(bson.M{"fingerprint": fp}).One(&k)
+	if err == nil {
+		return &k, nil
+	}
+	if err != mgo.ErrNotFound {
+		return nil, err
+	}
+	keys, err := backfillMetadata(conn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].Fingerprint == fp {
+			return &keys[i], nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// AuthorizedKey returns the authorized_keys line of the key with the given
+// SHA256 fingerprint, which restricts the key to the git wrapper. It's meant
+// to be used by sshd's AuthorizedKeysCommand, so changes in keys take effect
+// without rewriting the authorized_keys file.
+func AuthorizedKey(fp string) (string, error) {
+	if !strings.HasPrefix(fp, "SHA256:") {
+		return "", ErrInvalidKey
+	}
+	k, err := findKeyByFingerprint(fp)
+	if err != nil {
+		return "", err
+	}
+	if k.Expired() {
+		return "", ErrKeyExpired
+	}
+	return k.format(), nil
+}
+
+// KeyOf returns the stored key matching the public key, either a user key or
+// a deploy key. It returns ErrKeyExpired when the key expired.
+func KeyOf(key ssh.PublicKey) (*Key, error) {
+	k, err := findKeyByFingerprint(fingerprint(key))
+	if err != nil {
+		return nil, err
+	}
+	if k.Expired() {
+		return nil, ErrKeyExpired
+	}
+	return k, nil
+}
+
+// CheckUserKeys checks whether the user may connect with a key that can't be
+// identified, like the ones in authorized_keys lines written before
+// fingerprints were passed to the git wrapper. It returns ErrKeyExpired when
+// the user has keys and all of them expired.
+func CheckUserKeys(username string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var keys []Key
+	err = conn.Key().Find(bson.M{"username": username}).Select(bson.M{"expiresat": 1}).All(&keys)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !k.Expired() {
+			return nil
+		}
+	}
+	if len(keys) > 0 {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// UseKey checks whether the key of the user with the given fingerprint can
+// be used, returning ErrKeyExpired when it expired, and records its use.
+func UseKey(username, fp string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var k Key
+	err = conn.Key().Find(bson.M{"username": username, "fingerprint": fp}).One(&k)
+	if err == mgo.ErrNotFound {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if k.Expired() {
+		return ErrKeyExpired
+	}
+	q := bson.M{"name": k.Name, "username": k.UserName}
+	return conn.Key().Update(q, bson.M{"$set": bson.M{"lastusedat": time.Now()}})
+}
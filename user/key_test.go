@@ -6,6 +6,9 @@ package user
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,10 +16,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -45,6 +53,77 @@ func (s *S) TestNewKey(c *check.C) {
 	c.Assert(k.Body, check.Equals, body)
 	c.Assert(k.Comment, check.Equals, comment)
 	c.Assert(k.UserName, check.Equals, "me@tsuru.io")
+	c.Assert(k.Fingerprint, check.Equals, "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(k.Type, check.Equals, "ssh-dss")
+	c.Assert(k.Bits, check.Equals, 1024)
+}
+
+func (s *S) TestNewKeyBits(c *check.C) {
+	k, err := newKey("key1", "me@tsuru.io", otherKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Type, check.Equals, "ssh-rsa")
+	c.Assert(k.Bits, check.Equals, 2048)
+	c.Assert(k.Fingerprint, check.Equals, "SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw")
+	k, err = newKey("key1", "me@tsuru.io", generateKey(c))
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Type, check.Equals, "ecdsa-sha2-nistp256")
+	c.Assert(k.Bits, check.Equals, 256)
+}
+
+func (s *S) TestKeyExpired(c *check.C) {
+	k := Key{}
+	c.Assert(k.Expired(), check.Equals, false)
+	k.ExpiresAt = time.Now().Add(time.Hour)
+	c.Assert(k.Expired(), check.Equals, false)
+	k.ExpiresAt = time.Now().Add(-time.Hour)
+	c.Assert(k.Expired(), check.Equals, true)
+}
+
+func (s *S) TestKeyMarshalJSON(c *check.C) {
+	k, err := newKey("key1", "me@tsuru.io", rawKey)
+	c.Assert(err, check.IsNil)
+	k.CreatedAt = time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	k.ExpiresAt = time.Date(2015, 7, 1, 10, 0, 0, 0, time.UTC)
+	b, err := json.Marshal(k)
+	c.Assert(err, check.IsNil)
+	var data map[string]interface{}
+	err = json.Unmarshal(b, &data)
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.DeepEquals, map[string]interface{}{
+		"name":        "key1",
+		"key":         k.String(),
+		"fingerprint": "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM",
+		"type":        "ssh-dss",
+		"bits":        float64(1024),
+		"expired":     true,
+		"createdAt":   "2015-06-01T10:00:00Z",
+		"expiresAt":   "2015-07-01T10:00:00Z",
+	})
+}
+
+func (s *S) TestFormatKeyWithFingerprint(c *check.C) {
+	k, err := newKey("key1", "brain", rawKey)
+	c.Assert(err, check.IsNil)
+	p, err := config.GetString("bin-path")
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf(`no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s brain %s" %s`+"\n", p, k.Fingerprint, k)
+	c.Assert(k.format(), check.Equals, expected)
+}
+
+func (s *S) TestRemoveKeyWrittenWithoutFingerprint(c *check.C) {
+	k, err := newKey("key1", "brain", rawKey)
+	c.Assert(err, check.IsNil)
+	legacy := *k
+	legacy.Fingerprint = ""
+	err = writeKeys([]string{"ssh-rsa unmanaged", strings.TrimSuffix(legacy.format(), "\n")})
+	c.Assert(err, check.IsNil)
+	err = writeKey(k)
+	c.Assert(err, check.IsNil)
+	err = remove(k)
+	c.Assert(err, check.IsNil)
+	lines, err := readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.DeepEquals, []string{"ssh-rsa unmanaged"})
 }
 
 func (s *S) TestNewKeyInvalidKey(c *check.C) {
@@ -198,6 +277,322 @@ func (s *S) TestWriteKey(c *check.C) {
 	c.Assert(got, check.Equals, key.format())
 }
 
+func (s *S) TestWriteKeysReplacesAuthorizedKeys(c *check.C) {
+	old, err := newKey("old-key", "me@tsuru.io", rawKey)
+	c.Assert(err, check.IsNil)
+	err = writeKey(old)
+	c.Assert(err, check.IsNil)
+	err = writeKeys([]string{"ssh-dss mykeys-not-secret me@machine", "ssh-dss yourkeys-not-secret"})
+	c.Assert(err, check.IsNil)
+	f, err := s.rfs.Open(authKey())
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, "ssh-dss mykeys-not-secret me@machine\nssh-dss yourkeys-not-secret\n")
+}
+
+func (s *S) TestUnmanagedLines(c *check.C) {
+	lines := []string{
+		"managed-1",
+		UnmanagedBegin,
+		"ssh-rsa admin-key",
+		UnmanagedEnd,
+		"managed-2",
+		"  " + UnmanagedBegin,
+		"ssh-rsa backup-key",
+	}
+	expected := []string{
+		UnmanagedBegin,
+		"ssh-rsa admin-key",
+		UnmanagedEnd,
+		"  " + UnmanagedBegin,
+		"ssh-rsa backup-key",
+		UnmanagedEnd,
+	}
+	c.Assert(unmanagedLines(lines), check.DeepEquals, expected)
+	c.Assert(unmanagedLines([]string{"managed-1", UnmanagedEnd}), check.IsNil)
+}
+
+func (s *S) TestDiffLines(c *check.C) {
+	diff := diffLines([]string{"a", "b", "b", "c"}, []string{"b", "d", "a"})
+	c.Assert(diff.Added, check.DeepEquals, []string{"d"})
+	c.Assert(diff.Removed, check.DeepEquals, []string{"b", "c"})
+	diff = diffLines(nil, nil)
+	c.Assert(diff.Added, check.DeepEquals, []string{})
+	c.Assert(diff.Removed, check.DeepEquals, []string{})
+}
+
+func (s *S) TestRebuildAuthorizedKeys(c *check.C) {
+	_, err := New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	keys, err := ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	managed := strings.TrimSuffix(keys[0].format(), "\n")
+	err = writeKeys([]string{"ssh-rsa stale-key", UnmanagedBegin, "ssh-rsa admin-key", UnmanagedEnd})
+	c.Assert(err, check.IsNil)
+	diff, err := RebuildAuthorizedKeys(true, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Added, check.DeepEquals, []string{managed})
+	c.Assert(diff.Removed, check.DeepEquals, []string{"ssh-rsa stale-key"})
+	lines, err := readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.DeepEquals, []string{"ssh-rsa stale-key", UnmanagedBegin, "ssh-rsa admin-key", UnmanagedEnd})
+	_, err = RebuildAuthorizedKeys(false, true)
+	c.Assert(err, check.IsNil)
+	lines, err = readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.DeepEquals, []string{UnmanagedBegin, "ssh-rsa admin-key", UnmanagedEnd, managed})
+	diff, err = RebuildAuthorizedKeys(false, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Added, check.DeepEquals, []string{})
+	c.Assert(diff.Removed, check.DeepEquals, []string{UnmanagedBegin, "ssh-rsa admin-key", UnmanagedEnd})
+	lines, err = readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.DeepEquals, []string{managed})
+}
+
+func (s *S) TestWriteKeyWithAuthorizedKeysCommand(c *check.C) {
+	config.Set("authorized-keys-command", true)
+	defer config.Unset("authorized-keys-command")
+	k, err := newKey("my-key", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	err = writeKey(k)
+	c.Assert(err, check.IsNil)
+	err = remove(k)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.rfs.HasAction("openfile "+authKey()+".lock with mode 0600"), check.Equals, false)
+}
+
+func (s *S) TestWriteKeyWithEmbeddedSSHServer(c *check.C) {
+	config.Set("ssh:listen", "127.0.0.1:2222")
+	defer config.Unset("ssh")
+	k, err := newKey("my-key", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	err = writeKey(k)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.rfs.HasAction("openfile "+authKey()+".lock with mode 0600"), check.Equals, false)
+}
+
+func (s *S) TestAuthorizedKey(c *check.C) {
+	_, err := New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	keys, err := ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	line, err := AuthorizedKey("SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.IsNil)
+	c.Assert(line, check.Equals, keys[0].format())
+	_, err = AuthorizedKey("SHA256:AAAAcsIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.Equals, ErrKeyNotFound)
+}
+
+func (s *S) TestAuthorizedKeyWithoutStoredFingerprint(c *check.C) {
+	k, err := newKey("my-key", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	k.Fingerprint = ""
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Insert(k)
+	c.Assert(err, check.IsNil)
+	defer conn.Key().Remove(bson.M{"name": "my-key", "username": "gopher"})
+	line, err := AuthorizedKey("SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.IsNil)
+	c.Assert(line, check.Equals, k.format())
+	var stored Key
+	err = conn.Key().Find(bson.M{"name": "my-key", "username": "gopher"}).One(&stored)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Fingerprint, check.Equals, "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+}
+
+func (s *S) TestAuthorizedKeyExpired(c *check.C) {
+	_, err := New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	err = AddKeyWithExpiry("gopher", map[string]string{"my-key": rawKey}, time.Now().Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	_, err = AuthorizedKey("SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.Equals, ErrKeyExpired)
+}
+
+func (s *S) TestUseKey(c *check.C) {
+	_, err := New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	err = UseKey("gopher", "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.IsNil)
+	keys, err := ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(time.Since(keys[0].LastUsedAt) < time.Minute, check.Equals, true)
+	err = UseKey("glenda", "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(err, check.Equals, ErrKeyNotFound)
+}
+
+func (s *S) TestCheckUserKeys(c *check.C) {
+	c.Assert(CheckUserKeys("gopher"), check.IsNil)
+	err := addKeys(map[string]string{"expired": rawKey}, "gopher", time.Now().Add(-time.Hour))
+	c.Assert(err, check.IsNil)
+	defer removeUserKeys("gopher")
+	c.Assert(CheckUserKeys("gopher"), check.Equals, ErrKeyExpired)
+	err = addKeys(map[string]string{"valid": otherKey}, "gopher", time.Time{})
+	c.Assert(err, check.IsNil)
+	c.Assert(CheckUserKeys("gopher"), check.IsNil)
+}
+
+func (s *S) TestKeyOf(c *check.C) {
+	_, err := New("gopher", map[string]string{"my-key": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	public, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rawKey))
+	c.Assert(err, check.IsNil)
+	k, err := KeyOf(public)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "my-key")
+	c.Assert(k.UserName, check.Equals, "gopher")
+	public, _, _, _, err = ssh.ParseAuthorizedKey([]byte(otherKey))
+	c.Assert(err, check.IsNil)
+	_, err = KeyOf(public)
+	c.Assert(err, check.Equals, ErrKeyNotFound)
+}
+
+func (s *S) TestListKeysFillsMetadataOfOldKeys(c *check.C) {
+	_, err := New("gopher", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer Remove("gopher")
+	k, err := newKey("my-key", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	k.Fingerprint, k.Type, k.Bits = "", "", 0
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Insert(k)
+	c.Assert(err, check.IsNil)
+	keys, err := ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].Fingerprint, check.Equals, "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM")
+	c.Assert(keys[0].Bits, check.Equals, 1024)
+}
+
+func (s *S) TestAuthorizedKeyInvalidFingerprint(c *check.C) {
+	_, err := AuthorizedKey("MD5:d6:b8:0e:0b:c5:2e:e7:1c:a0:1c:ed:53:f7:be:1d:5e")
+	c.Assert(err, check.Equals, ErrInvalidKey)
+}
+
+func generateKey(c *check.C) string {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	public, err := ssh.NewPublicKey(&private.PublicKey)
+	c.Assert(err, check.IsNil)
+	return string(ssh.MarshalAuthorizedKey(public))
+}
+
+// useRealAuthorizedKeys makes the tests use a real authorized_keys file, in a
+// temporary directory, so file locks work.
+func useRealAuthorizedKeys(c *check.C) func() {
+	dir, err := ioutil.TempDir("", "gandalf-keys")
+	c.Assert(err, check.IsNil)
+	config.Set("authorized-keys-path", path.Join(dir, "authorized_keys"))
+	fs.Fsystem = nil
+	return func() {
+		fs.Fsystem = nil
+		config.Unset("authorized-keys-path")
+		os.RemoveAll(dir)
+	}
+}
+
+func readLines(c *check.C) []string {
+	lines, err := readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	sort.Strings(lines)
+	return lines
+}
+
+func (s *S) TestWriteKeyDoesNotDuplicateKeys(c *check.C) {
+	k, err := newKey("my-key", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	err = writeKey(k)
+	c.Assert(err, check.IsNil)
+	err = writeKey(k)
+	c.Assert(err, check.IsNil)
+	lines, err := readAuthorizedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(lines, check.DeepEquals, []string{strings.TrimSuffix(k.format(), "\n")})
+}
+
+func (s *S) TestConcurrentWritesAndRemovals(c *check.C) {
+	defer useRealAuthorizedKeys(c)()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		expected []string
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				k, err := newKey(fmt.Sprintf("key-%d", j), fmt.Sprintf("user-%d", i), generateKey(c))
+				c.Check(err, check.IsNil)
+				c.Check(writeKey(k), check.IsNil)
+				if j%2 == 0 {
+					c.Check(remove(k), check.IsNil)
+					continue
+				}
+				mu.Lock()
+				expected = append(expected, strings.TrimSuffix(k.format(), "\n"))
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	sort.Strings(expected)
+	c.Assert(readLines(c), check.DeepEquals, expected)
+	files, err := ioutil.ReadDir(path.Dir(authKey()))
+	c.Assert(err, check.IsNil)
+	for _, f := range files {
+		c.Check(strings.HasSuffix(f.Name(), ".tmp"), check.Equals, false)
+	}
+}
+
+func (s *S) TestAddKeyAndRemoveKeyConcurrently(c *check.C) {
+	defer useRealAuthorizedKeys(c)()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("hammer-%d", i)
+		_, err := New(name, map[string]string{})
+		c.Assert(err, check.IsNil)
+		defer Remove(name)
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				keyName := fmt.Sprintf("key-%d", j)
+				c.Check(AddKey(name, map[string]string{keyName: generateKey(c)}), check.IsNil)
+				if j%3 == 0 {
+					c.Check(RemoveKey(name, keyName), check.IsNil)
+				}
+			}
+		}(name)
+	}
+	wg.Wait()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	var keys []Key
+	err = conn.Key().Find(bson.M{"username": bson.M{"$regex": "^hammer-"}}).All(&keys)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 24)
+	expected := make([]string, len(keys))
+	for i := range keys {
+		expected[i] = strings.TrimSuffix(keys[i].format(), "\n")
+	}
+	sort.Strings(expected)
+	c.Assert(readLines(c), check.DeepEquals, expected)
+}
+
 func (s *S) TestWriteTwoKeys(c *check.C) {
 	key1 := Key{
 		Name:     "my-key",
@@ -282,12 +677,21 @@ func (s *S) TestUpdateKey(c *check.C) {
 	c.Assert(err, check.IsNil)
 	defer conn.Close()
 	defer conn.Key().Remove(bson.M{"name": "key1"})
-	err = updateKey("key1", otherKey, "gopher")
+	var old Key
+	err = conn.Key().Find(bson.M{"name": "key1"}).One(&old)
+	c.Assert(err, check.IsNil)
+	err = UseKey("gopher", old.Fingerprint)
+	c.Assert(err, check.IsNil)
+	err = conn.Key().Find(bson.M{"name": "key1"}).One(&old)
+	c.Assert(err, check.IsNil)
+	err = updateKey("key1", otherKey, "gopher", time.Time{})
 	c.Assert(err, check.IsNil)
 	var k Key
 	err = conn.Key().Find(bson.M{"name": "key1"}).One(&k)
 	c.Assert(err, check.IsNil)
 	c.Assert(k.Body, check.Equals, otherKey+"\n")
+	c.Assert(k.CreatedAt.Equal(old.CreatedAt), check.Equals, true)
+	c.Assert(k.LastUsedAt.Equal(old.LastUsedAt), check.Equals, true)
 	f, err := s.rfs.Open(authKey())
 	c.Assert(err, check.IsNil)
 	defer f.Close()
@@ -297,12 +701,12 @@ func (s *S) TestUpdateKey(c *check.C) {
 }
 
 func (s *S) TestUpdateKeyNotFound(c *check.C) {
-	err := updateKey("key1", otherKey, "gopher")
+	err := updateKey("key1", otherKey, "gopher", time.Time{})
 	c.Assert(err, check.Equals, ErrKeyNotFound)
 }
 
 func (s *S) TestUpdateKeyInvalidKey(c *check.C) {
-	err := updateKey("key1", "something-invalid", "gopher")
+	err := updateKey("key1", "something-invalid", "gopher", time.Time{})
 	c.Assert(err, check.Equals, ErrInvalidKey)
 }
 
@@ -0,0 +1,143 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+)
+
+// KeyPolicy restricts the keys that users can add, as configured in the
+// key-policy section of the configuration file. The zero value accepts any
+// key.
+type KeyPolicy struct {
+	// Algorithms are the key types accepted, like
+	// "ecdsa-sha2-nistp256" or "ssh-rsa". Any type is accepted when empty.
+	Algorithms []string
+	// MinRSABits is the minimum size of RSA keys.
+	MinRSABits int
+	// MaxKeysPerUser is the maximum number of keys of each user, unlimited
+	// when zero.
+	MaxKeysPerUser int
+	// RequireExpiry tells whether keys must have an expiry date.
+	RequireExpiry bool
+}
+
+// KeyPolicyError is returned when keys don't comply with the key policy.
+type KeyPolicyError struct {
+	Violations []string
+}
+
+func (err *KeyPolicyError) Error() string {
+	return "Key refused by the key policy: " + strings.Join(err.Violations, "; ")
+}
+
+// CurrentKeyPolicy returns the key policy in the configuration file.
+func CurrentKeyPolicy() KeyPolicy {
+	var p KeyPolicy
+	p.Algorithms, _ = config.GetList("key-policy:algorithms")
+	p.MinRSABits, _ = config.GetInt("key-policy:min-rsa-bits")
+	p.MaxKeysPerUser, _ = config.GetInt("key-policy:max-keys-per-user")
+	p.RequireExpiry, _ = config.GetBool("key-policy:require-expiry")
+	return p
+}
+
+// Violations returns the rules of the policy violated by the key, ignoring
+// the number of keys of the user.
+func (p *KeyPolicy) Violations(k *Key) []string {
+	var violations []string
+	if len(p.Algorithms) > 0 {
+		allowed := false
+		for _, algorithm := range p.Algorithms {
+			allowed = allowed || algorithm == k.Type
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("algorithm %s is not allowed (allowed: %s)", k.Type, strings.Join(p.Algorithms, ", ")))
+		}
+	}
+	if k.Type == "ssh-rsa" && k.Bits < p.MinRSABits {
+		violations = append(violations, fmt.Sprintf("RSA key has %d bits, the minimum is %d", k.Bits, p.MinRSABits))
+	}
+	if p.RequireExpiry && k.ExpiresAt.IsZero() {
+		violations = append(violations, "key has no expiry date")
+	}
+	return violations
+}
+
+func (p *KeyPolicy) tooManyKeys() string {
+	return fmt.Sprintf("user has more than %d keys", p.MaxKeysPerUser)
+}
+
+// check checks the keys of a user against the policy, given the number of
+// keys the user will have.
+func (p *KeyPolicy) check(keys []*Key, count int) error {
+	var violations []string
+	for _, k := range keys {
+		for _, v := range p.Violations(k) {
+			violations = append(violations, fmt.Sprintf("%s: %s", k.Name, v))
+		}
+	}
+	if p.MaxKeysPerUser > 0 && count > p.MaxKeysPerUser {
+		violations = append(violations, p.tooManyKeys())
+	}
+	if len(violations) > 0 {
+		return &KeyPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// KeyViolation describes a stored key that doesn't comply with the key
+// policy. Deploy keys have a repository instead of a user.
+type KeyViolation struct {
+	UserName    string   `json:"user,omitempty"`
+	Repository  string   `json:"repository,omitempty"`
+	Name        string   `json:"name"`
+	Fingerprint string   `json:"fingerprint"`
+	Violations  []string `json:"violations"`
+}
+
+// KeyPolicyViolations lists the stored keys that violate the current key
+// policy, sorted by user and creation date. When a user has more keys than
+// allowed, the most recent ones are reported as exceeding the limit.
+func KeyPolicyViolations() ([]KeyViolation, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = backfillMetadata(conn); err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if err = conn.Key().Find(nil).Sort("username", "createdat").All(&keys); err != nil {
+		return nil, err
+	}
+	policy := CurrentKeyPolicy()
+	counts := map[string]int{}
+	violations := []KeyViolation{}
+	for i := range keys {
+		k := &keys[i]
+		v := policy.Violations(k)
+		if k.Repository == "" {
+			counts[k.UserName]++
+		}
+		if k.Repository == "" && policy.MaxKeysPerUser > 0 && counts[k.UserName] > policy.MaxKeysPerUser {
+			v = append(v, policy.tooManyKeys())
+		}
+		if len(v) > 0 {
+			violations = append(violations, KeyViolation{
+				UserName:    k.UserName,
+				Repository:  k.Repository,
+				Name:        k.Name,
+				Fingerprint: k.Fingerprint,
+				Violations:  v,
+			})
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"time"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+// setKeyPolicy configures the key policy, returning a function that removes
+// it.
+func setKeyPolicy(policy map[interface{}]interface{}) func() {
+	config.Set("key-policy", policy)
+	return func() { config.Unset("key-policy") }
+}
+
+func (s *S) TestCurrentKeyPolicy(c *check.C) {
+	defer setKeyPolicy(map[interface{}]interface{}{
+		"algorithms":        []interface{}{"ecdsa-sha2-nistp256", "ssh-rsa"},
+		"min-rsa-bits":      2048,
+		"max-keys-per-user": 5,
+		"require-expiry":    true,
+	})()
+	c.Assert(CurrentKeyPolicy(), check.DeepEquals, KeyPolicy{
+		Algorithms:     []string{"ecdsa-sha2-nistp256", "ssh-rsa"},
+		MinRSABits:     2048,
+		MaxKeysPerUser: 5,
+		RequireExpiry:  true,
+	})
+}
+
+func (s *S) TestCurrentKeyPolicyNotConfigured(c *check.C) {
+	c.Assert(CurrentKeyPolicy(), check.DeepEquals, KeyPolicy{})
+}
+
+func (s *S) TestKeyPolicyViolations(c *check.C) {
+	dsa, err := newKey("dsa", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	rsa, err := newKey("rsa", "gopher", otherKey)
+	c.Assert(err, check.IsNil)
+	policy := KeyPolicy{Algorithms: []string{"ssh-rsa"}, MinRSABits: 4096, RequireExpiry: true}
+	c.Assert(policy.Violations(dsa), check.DeepEquals, []string{
+		"algorithm ssh-dss is not allowed (allowed: ssh-rsa)",
+		"key has no expiry date",
+	})
+	rsa.ExpiresAt = time.Now().Add(time.Hour)
+	c.Assert(policy.Violations(rsa), check.DeepEquals, []string{"RSA key has 2048 bits, the minimum is 4096"})
+	policy.MinRSABits = 2048
+	c.Assert(policy.Violations(rsa), check.IsNil)
+	var empty KeyPolicy
+	c.Assert(empty.Violations(dsa), check.IsNil)
+}
+
+func (s *S) TestKeyPolicyCheck(c *check.C) {
+	dsa, err := newKey("dsa", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	rsa, err := newKey("rsa", "gopher", otherKey)
+	c.Assert(err, check.IsNil)
+	policy := KeyPolicy{Algorithms: []string{"ssh-rsa"}, MaxKeysPerUser: 2}
+	c.Assert(policy.check([]*Key{rsa}, 2), check.IsNil)
+	err = policy.check([]*Key{dsa, rsa}, 3)
+	c.Assert(err, check.DeepEquals, &KeyPolicyError{Violations: []string{
+		"dsa: algorithm ssh-dss is not allowed (allowed: ssh-rsa)",
+		"user has more than 2 keys",
+	}})
+	c.Assert(err, check.ErrorMatches, "Key refused by the key policy: dsa: algorithm ssh-dss is not allowed .*; user has more than 2 keys")
+}
+
+func (s *S) TestAddKeyRefusedByKeyPolicy(c *check.C) {
+	defer setKeyPolicy(map[interface{}]interface{}{"max-keys-per-user": 1, "min-rsa-bits": 2048})()
+	u, err := New("gopher", map[string]string{"rsa": otherKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddKey("gopher", map[string]string{"ecdsa": generateKey(c)})
+	c.Assert(err, check.DeepEquals, &KeyPolicyError{Violations: []string{"user has more than 1 keys"}})
+	keys, err := ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+}
+
+func (s *S) TestNewUserRefusedByKeyPolicy(c *check.C) {
+	defer setKeyPolicy(map[interface{}]interface{}{"algorithms": []interface{}{"ssh-rsa"}})()
+	_, err := New("gopher", map[string]string{"dsa": rawKey})
+	c.Assert(err, check.FitsTypeOf, &KeyPolicyError{})
+	_, err = ListKeys("gopher")
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
+
+func (s *S) TestNewWithExpiryRequiredByKeyPolicy(c *check.C) {
+	defer setKeyPolicy(map[interface{}]interface{}{"require-expiry": true})()
+	_, err := New("gopher", map[string]string{"rsa": otherKey})
+	c.Assert(err, check.DeepEquals, &KeyPolicyError{Violations: []string{"rsa: key has no expiry date"}})
+	expiresAt := time.Now().Add(time.Hour)
+	u, err := NewWithExpiry("gopher", map[string]string{"rsa": otherKey}, expiresAt)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	keys, err := ListKeys("gopher")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].ExpiresAt.Sub(expiresAt) < time.Second, check.Equals, true)
+}
+
+func (s *S) TestUpdateKeyRefusedByKeyPolicy(c *check.C) {
+	u, err := New("gopher", map[string]string{"my-key": otherKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	defer setKeyPolicy(map[interface{}]interface{}{"require-expiry": true})()
+	err = UpdateKey("gopher", Key{Name: "my-key", Body: otherKey})
+	c.Assert(err, check.DeepEquals, &KeyPolicyError{Violations: []string{"my-key: key has no expiry date"}})
+	err = UpdateKey("gopher", Key{Name: "my-key", Body: otherKey, ExpiresAt: time.Now().Add(time.Hour)})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestKeyPolicyViolationsReport(c *check.C) {
+	u, err := New("gopher", map[string]string{"dsa": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddKey("gopher", map[string]string{"rsa": otherKey})
+	c.Assert(err, check.IsNil)
+	violations, err := KeyPolicyViolations()
+	c.Assert(err, check.IsNil)
+	c.Assert(violations, check.HasLen, 0)
+	defer setKeyPolicy(map[interface{}]interface{}{"max-keys-per-user": 1, "min-rsa-bits": 4096})()
+	violations, err = KeyPolicyViolations()
+	c.Assert(err, check.IsNil)
+	c.Assert(violations, check.DeepEquals, []KeyViolation{{
+		UserName:    "gopher",
+		Name:        "rsa",
+		Fingerprint: "SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw",
+		Violations:  []string{"RSA key has 2048 bits, the minimum is 4096", "user has more than 1 keys"},
+	}})
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/repository"
@@ -20,7 +21,10 @@ var (
 	ErrUserAlreadyExists = errors.New("user already exists")
 	ErrUserNotFound      = errors.New("user not found")
 
-	userNameRegexp = regexp.MustCompile(`\s|[^aA-zZ0-9-+.@]|(^$)`)
+	// userNameRegexp matches invalid user names. Names can't start with a
+	// dash, so the git wrapper never takes them for options, like
+	// DeployKeyFlag.
+	userNameRegexp = regexp.MustCompile(`\s|[^aA-zZ0-9-+.@]|(^$)|^-`)
 )
 
 type User struct {
@@ -31,6 +35,12 @@ type User struct {
 //
 // The authorized_keys file belongs to the user running the process.
 func New(name string, keys map[string]string) (*User, error) {
+	return NewWithExpiry(name, keys, time.Time{})
+}
+
+// NewWithExpiry creates a new user whose keys are refused after expiresAt,
+// unless it's zero.
+func NewWithExpiry(name string, keys map[string]string, expiresAt time.Time) (*User, error) {
 	log.Debugf(`Creating user "%s"`, name)
 	u := &User{Name: name}
 	if v, err := u.isValid(); !v {
@@ -43,6 +53,10 @@ func New(name string, keys map[string]string) (*User, error) {
 		return nil, errors.New(fmt.Sprintf("Failed to connect to MongoDB of Gandalf %q - %s.", addr, err.Error()))
 	}
 	defer conn.Close()
+	parsed, err := prepareKeys(keys, name, expiresAt, 0)
+	if err != nil {
+		return nil, err
+	}
 	if err := conn.User().Insert(&u); err != nil {
 		if mgo.IsDup(err) {
 			return nil, ErrUserAlreadyExists
@@ -50,7 +64,10 @@ func New(name string, keys map[string]string) (*User, error) {
 		log.Errorf("user.New: %s", err)
 		return nil, err
 	}
-	return u, addKeys(keys, u.Name)
+	if err = insertKeys(parsed); err != nil {
+		return u, err
+	}
+	return u, writeCertAuthorities(u.Name)
 }
 
 func (u *User) isValid() (isValid bool, err error) {
@@ -86,7 +103,10 @@ func Remove(name string) error {
 	if err := conn.User().RemoveId(u.Name); err != nil {
 		return fmt.Errorf("Could not remove user: %s", err.Error())
 	}
-	return removeUserKeys(u.Name)
+	if err := removeUserKeys(u.Name); err != nil {
+		return err
+	}
+	return removeCertAuthorities(u.Name)
 }
 
 func (u *User) handleAssociatedRepositories() error {
@@ -122,6 +142,12 @@ func (u *User) handleAssociatedRepositories() error {
 //
 // Returns an error in case the user does not exist.
 func AddKey(username string, k map[string]string) error {
+	return AddKeyWithExpiry(username, k, time.Time{})
+}
+
+// AddKeyWithExpiry adds new SSH keys to the user, which are refused after
+// expiresAt, unless it's zero.
+func AddKeyWithExpiry(username string, k map[string]string, expiresAt time.Time) error {
 	var u User
 	conn, err := db.Conn()
 	if err != nil {
@@ -131,10 +157,10 @@ func AddKey(username string, k map[string]string) error {
 	if err := conn.User().FindId(username).One(&u); err != nil {
 		return ErrUserNotFound
 	}
-	return addKeys(k, u.Name)
+	return addKeys(k, u.Name, expiresAt)
 }
 
-// UpdateKey updates the content of the given key.
+// UpdateKey updates the content and the expiry date of the given key.
 func UpdateKey(username string, k Key) error {
 	var u User
 	conn, err := db.Conn()
@@ -145,7 +171,7 @@ func UpdateKey(username string, k Key) error {
 	if err := conn.User().FindId(username).One(&u); err != nil {
 		return ErrUserNotFound
 	}
-	return updateKey(k.Name, k.Body, u.Name)
+	return updateKey(k.Name, k.Body, u.Name, k.ExpiresAt)
 }
 
 // RemoveKey removes the key from the database and from authorized_keys file.
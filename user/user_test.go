@@ -158,6 +158,8 @@ func (s *S) TestIsValid(c *check.C) {
 		{"r2d2", true},
 		{"gopher", true},
 		{"go-pher", true},
+		{"-gopher", false},
+		{DeployKeyFlag, false},
 	}
 	for _, t := range tests {
 		u := User{Name: t.input}
@@ -8,15 +8,32 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/api"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/mirror"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/search"
+	"github.com/tsuru/gandalf/sshd"
 	"github.com/tsuru/tsuru/log"
 )
 
 const version = "0.7.3"
 
+// failInterruptedImports periodically marks as failed the imports whose
+// server stopped while running them.
+func failInterruptedImports() {
+	for {
+		if err := repository.FailInterruptedImports(); err != nil {
+			log.Errorf("Could not update interrupted imports: %s", err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
 func main() {
 	dry := flag.Bool("dry", false, "dry-run: does not start the server (for testing purpose)")
 	configFile := flag.String("config", "/etc/gandalf.conf", "Gandalf configuration file")
@@ -57,6 +74,22 @@ func main() {
 			panic("You should configure a git:bare:location for gandalf.")
 		}
 		fmt.Printf("Repository location: %s\n", bareLocation)
+		if err := db.Migrate(); err != nil {
+			log.Fatalf("Could not migrate the database: %s", err)
+		}
+		if search.Enabled() {
+			go search.IndexAll()
+			go search.Run(nil)
+		}
+		go failInterruptedImports()
+		go mirror.Run(nil)
+		if sshd.Enabled() {
+			go func() {
+				if err := sshd.ListenAndServe(); err != nil {
+					log.Fatalf("Could not start the SSH server: %s", err)
+				}
+			}()
+		}
 		fmt.Printf("gandalf-webserver %s listening on %s\n", version, bind)
 		http.ListenAndServe(bind, router)
 	}